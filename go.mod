@@ -3,8 +3,8 @@ module github.com/harveysanders/picoplayground
 go 1.24
 
 require (
-	github.com/soypat/cyw43439 v0.0.0-20260112220010-064a839f63bb
-	github.com/soypat/lneto v0.0.0-20260115213117-80b740827f0a
+	github.com/soypat/cyw43439 v0.1.1
+	github.com/soypat/lneto v0.1.0
 	github.com/soypat/natiu-mqtt v0.6.0
 	tinygo.org/x/drivers v0.34.0
 )
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log/slog"
+	"machine"
+	"strconv"
+	"strings"
+
+	"github.com/harveysanders/picoplayground/mqttsensor/cyw43439"
+)
+
+// capturePorts turns on packet capture over the USB serial console: "all"
+// captures every frame, and a comma separated list of ports, e.g.
+// "1883,80", captures the IPv4 TCP and UDP traffic on those ports. Empty
+// disables capture. Can be passed via linker flags.
+//
+// Convert the console output to a .pcapng file with tools/pcapserial.
+var capturePorts string
+
+// startCapture attaches a packet capture to the stack if capturePorts asks
+// for one. It must be called before the packet processing loop starts.
+func startCapture(logger *slog.Logger, stack *cyw43439.Stack) {
+	if capturePorts == "" {
+		return
+	}
+	var cfg cyw43439.CaptureConfig
+	if capturePorts != "all" {
+		var ports []uint16
+		for _, f := range strings.Split(capturePorts, ",") {
+			p, err := strconv.ParseUint(strings.TrimSpace(f), 10, 16)
+			if err != nil || p == 0 {
+				logger.Error("capture:disabled", slog.String("reason", "invalid port "+strconv.Quote(f)))
+				return
+			}
+			ports = append(ports, uint16(p))
+		}
+		cfg.Filter = cyw43439.PortFilter(ports...)
+	}
+	c := cyw43439.NewCapture(machine.Serial, cfg)
+	stack.SetCapture(c)
+	go func() {
+		err := c.Run()
+		logger.Error("capture:stopped", slog.String("reason", err.Error()))
+	}()
+	logger.Info("capture:started", slog.String("ports", capturePorts))
+}
@@ -0,0 +1,191 @@
+// Package config persists device settings entered during provisioning in
+// the last erase block of the Pico's flash, so they survive reboots and
+// firmware updates that don't grow into that block.
+//
+// The record is a small header (magic, version, payload length), the
+// payload as length-prefixed strings followed by numeric settings, and a
+// CRC-32 of everything before it.
+// An erased or corrupt block reads as [ErrNotFound].
+package config
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	magic   = 0x50534346 // "PSCF"
+	version = 1
+
+	headerLen = 4 + 1 + 2
+	crcLen    = 4
+	// maxStringLen is the longest value a field may hold.
+	maxStringLen = 255
+	// maxRecordLen bounds the encoded record. It must fit in one erase block.
+	maxRecordLen = 1536
+
+	// MaxSampleIntervalSec is the longest sampling interval accepted.
+	MaxSampleIntervalSec = 3600
+)
+
+var (
+	// ErrNotFound is returned by [Load] if no valid settings are stored.
+	ErrNotFound = errors.New("config: no stored settings")
+
+	errFieldTooLong = errors.New("config: field longer than 255 bytes")
+	errRecordSize   = errors.New("config: record too large")
+	errSmallDevice  = errors.New("config: flash erase block too small")
+)
+
+// BlockDevice is the flash storage the settings are kept on. It is
+// satisfied by machine.Flash.
+type BlockDevice interface {
+	io.ReaderAt
+	io.WriterAt
+	Size() int64
+	WriteBlockSize() int64
+	EraseBlockSize() int64
+	EraseBlocks(start, len int64) error
+}
+
+// Config holds the settings entered in setup mode or on the web interface.
+type Config struct {
+	// SSID and Password of the WiFi network to join.
+	SSID     string
+	Password string
+	// BrokerURL is the MQTT broker, in the form accepted by mqtt.ParseBrokerURL.
+	BrokerURL string
+	// DeviceName is the MQTT client ID and DHCP hostname.
+	DeviceName string
+	// AdminPassword protects the web interface. It is disabled if empty.
+	AdminPassword string
+	// SampleIntervalSec is the sensor sampling interval in seconds.
+	// Zero selects the firmware default.
+	SampleIntervalSec uint16
+}
+
+// Validate checks that the settings are complete and can be stored.
+func (c Config) Validate() error {
+	if c.SSID == "" {
+		return errors.New("config: empty SSID")
+	} else if c.DeviceName == "" {
+		return errors.New("config: empty device name")
+	}
+	if c.Password != "" && (len(c.Password) < 8 || len(c.Password) > 63) {
+		return errors.New("config: WiFi password must be 8 to 63 characters")
+	}
+	if c.SampleIntervalSec > MaxSampleIntervalSec {
+		return errors.New("config: sample interval longer than an hour")
+	}
+	for _, field := range c.fields() {
+		if len(*field) > maxStringLen {
+			return errFieldTooLong
+		}
+	}
+	return nil
+}
+
+// fields returns the string fields in their encoding order. The sample
+// interval follows them. New fields go last so older records stay readable.
+func (c *Config) fields() []*string {
+	return []*string{&c.SSID, &c.Password, &c.BrokerURL, &c.DeviceName, &c.AdminPassword}
+}
+
+// Load reads the stored settings from dev.
+func Load(dev BlockDevice) (Config, error) {
+	var c Config
+	off, err := recordOffset(dev)
+	if err != nil {
+		return c, err
+	}
+	var hdr [headerLen]byte
+	_, err = dev.ReadAt(hdr[:], off)
+	if err != nil {
+		return c, err
+	}
+	if binary.LittleEndian.Uint32(hdr[0:4]) != magic || hdr[4] == 0 || hdr[4] > version {
+		return c, ErrNotFound
+	}
+	plen := int(binary.LittleEndian.Uint16(hdr[5:7]))
+	if headerLen+plen+crcLen > maxRecordLen {
+		return c, ErrNotFound
+	}
+	buf := make([]byte, headerLen+plen+crcLen)
+	_, err = dev.ReadAt(buf, off)
+	if err != nil {
+		return c, err
+	}
+	body := buf[:headerLen+plen]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(buf[len(body):]) {
+		return c, ErrNotFound
+	}
+	payload := body[headerLen:]
+	for _, field := range c.fields() {
+		if len(payload) == 0 {
+			break // Written by an older version.
+		}
+		n := int(payload[0])
+		if 1+n > len(payload) {
+			return Config{}, ErrNotFound
+		}
+		*field = string(payload[1 : 1+n])
+		payload = payload[1+n:]
+	}
+	if len(payload) >= 2 {
+		c.SampleIntervalSec = binary.LittleEndian.Uint16(payload)
+	}
+	return c, nil
+}
+
+// Save validates c and writes it to dev, replacing any stored settings.
+func Save(dev BlockDevice, c Config) error {
+	err := c.Validate()
+	if err != nil {
+		return err
+	}
+	off, err := recordOffset(dev)
+	if err != nil {
+		return err
+	}
+	// Writes must be whole write blocks; the padding reads as erased flash.
+	wbs := int(dev.WriteBlockSize())
+	buf := make([]byte, headerLen, maxRecordLen)
+	binary.LittleEndian.PutUint32(buf[0:4], magic)
+	buf[4] = version
+	for _, field := range c.fields() {
+		buf = append(buf, byte(len(*field)))
+		buf = append(buf, *field...)
+	}
+	buf = binary.LittleEndian.AppendUint16(buf, c.SampleIntervalSec)
+	if len(buf)+crcLen > maxRecordLen {
+		return errRecordSize
+	}
+	binary.LittleEndian.PutUint16(buf[5:7], uint16(len(buf)-headerLen))
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+	for wbs > 0 && len(buf)%wbs != 0 {
+		buf = append(buf, 0xff)
+	}
+
+	ebs := dev.EraseBlockSize()
+	err = dev.EraseBlocks(off/ebs, 1)
+	if err != nil {
+		return errors.New("config: erase: " + err.Error())
+	}
+	_, err = dev.WriteAt(buf, off)
+	if err != nil {
+		return errors.New("config: write: " + err.Error())
+	}
+	return nil
+}
+
+// recordOffset returns the offset of the last erase block, where the
+// settings are kept.
+func recordOffset(dev BlockDevice) (int64, error) {
+	ebs := dev.EraseBlockSize()
+	if ebs < maxRecordLen || dev.Size() < ebs {
+		return 0, errSmallDevice
+	}
+	return (dev.Size()/ebs - 1) * ebs, nil
+}
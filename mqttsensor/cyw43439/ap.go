@@ -0,0 +1,259 @@
+package cyw43439
+
+import (
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/soypat/cyw43439"
+	"github.com/soypat/lneto/ethernet"
+	"github.com/soypat/lneto/ipv4"
+	"github.com/soypat/lneto/x/xnet"
+)
+
+// Access point mode. The CYW43439 hosts its own network, typically for
+// provisioning: clients are leased addresses by a small DHCP server and,
+// optionally, every DNS lookup is answered with the device's address so
+// phones and laptops open its web page as a captive portal.
+
+const (
+	dnsPort = 53
+	// apMaxNeighbours is the number of clients whose hardware addresses
+	// are remembered for addressing outgoing frames.
+	apMaxNeighbours = 8
+	// maxDNSReply bounds captive DNS responses. Queries with longer names
+	// are ignored.
+	maxDNSReply = 512
+	// captiveDNSTTL is kept short so clients forget the fake answers
+	// quickly once they move to another network.
+	captiveDNSTTL = 10
+)
+
+var defaultAPAddr = netip.MustParsePrefix("192.168.4.1/24")
+
+// APConfig configures the access point started by [NewConfiguredPicoAP].
+type APConfig struct {
+	SSID string
+	// Password is the WPA2 passphrase, 8 to 63 characters long. If empty
+	// the network is open.
+	Password string
+	// Channel is the WiFi channel. Defaults to 1.
+	Channel uint8
+	// Addr is the device's address and the prefix of the network it hosts.
+	// Defaults to 192.168.4.1/24. Clients are leased the addresses that
+	// follow it.
+	Addr netip.Prefix
+	// CaptiveDNS answers every DNS A query with the device's address.
+	CaptiveDNS bool
+}
+
+// apState is the state of a Stack running as an access point.
+type apState struct {
+	captiveDNS bool
+	dhcp       dhcpServer
+
+	// lneto sends every IPv4 frame to the gateway hardware address. As an
+	// access point there's no gateway, so the destination of outgoing
+	// frames is looked up among the clients heard from.
+	mu        sync.Mutex
+	neighbour [apMaxNeighbours]hwCacheEntry
+	next      int
+
+	dnsbuf [maxDNSReply]byte // Only used from the packet processing goroutine.
+}
+
+// NewConfiguredPicoAP creates a stack with the CYW43439 acting as an access
+// point. The stack takes ap.Addr and serves DHCP to clients; it never
+// joins another network so it can't be used with a [Supervisor].
+func NewConfiguredPicoAP(ap APConfig, wificfg cyw43439.Config, cfg StackConfig) (*Stack, error) {
+	if cfg.Hostname == "" {
+		return nil, errors.New("empty hostname")
+	} else if ap.SSID == "" {
+		return nil, errors.New("empty access point SSID")
+	}
+	if !ap.Addr.IsValid() {
+		ap.Addr = defaultAPAddr
+	}
+	if ap.Channel == 0 {
+		ap.Channel = 1
+	}
+	subnet := ap.Addr.Masked()
+	err := StaticConfig{Addr: ap.Addr}.validate()
+	if err != nil {
+		return nil, errors.New("access point address: " + err.Error())
+	}
+
+	logger := cfg.logger()
+	start := time.Now()
+	dev, err := initDevice(wificfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	err = dev.StartAP(ap.SSID, ap.Password, ap.Channel)
+	if err != nil {
+		return nil, errors.New("start access point:" + err.Error())
+	}
+	mac, err := dev.HardwareAddr6()
+	if err != nil {
+		return nil, errors.New("get hardware address:" + err.Error())
+	}
+	logger.Info("ap:started", slog.String("ssid", ap.SSID), slog.Uint64("channel", uint64(ap.Channel)),
+		slog.String("mac", net.HardwareAddr(mac[:]).String()))
+
+	stack, err := newStack(dev, mac, cfg, logger, time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+	err = stack.s.AssimilateDHCPResults(&xnet.DHCPResults{
+		AssignedAddr:  ap.Addr.Addr(),
+		Subnet:        subnet,
+		BroadcastAddr: broadcastAddr(subnet),
+	})
+	if err != nil {
+		return nil, errors.New("assign access point address:" + err.Error())
+	}
+	stack.subnet = subnet
+	stack.ap = &apState{captiveDNS: ap.CaptiveDNS}
+	stack.ap.dhcp.reset(ap.Addr)
+	err = stack.HandleUDP(dhcpServerPort, stack.serveDHCP)
+	if err != nil {
+		return nil, err
+	}
+	if ap.CaptiveDNS {
+		err = stack.HandleUDP(dnsPort, stack.serveCaptiveDNS)
+		if err != nil {
+			return nil, err
+		}
+	}
+	logger.Info("ap:ready", slog.String("ip", ap.Addr.String()))
+	return stack, nil
+}
+
+// IsAccessPoint reports whether the stack was created by [NewConfiguredPicoAP].
+func (s *Stack) IsAccessPoint() bool {
+	return s.ap != nil
+}
+
+// learnNeighbour remembers the hardware address of on-subnet IPv4 senders
+// while running as an access point.
+func (s *Stack) learnNeighbour(pkt []byte) {
+	ap := s.ap
+	if ap == nil {
+		return
+	}
+	efrm, err := ethernet.NewFrame(pkt)
+	if err != nil || efrm.EtherTypeOrSize() != ethernet.TypeIPv4 {
+		return
+	}
+	ifrm, err := ipv4.NewFrame(pkt[ethHeaderLen:])
+	if err != nil {
+		return
+	}
+	src := netip.AddrFrom4(*ifrm.SourceAddr())
+	if !s.subnet.Contains(src) {
+		return // DHCP clients send from 0.0.0.0.
+	}
+	hw := *efrm.SourceHardwareAddr()
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+	for i := range ap.neighbour {
+		if ap.neighbour[i].addr == src {
+			ap.neighbour[i].hw = hw
+			return
+		}
+	}
+	ap.neighbour[ap.next] = hwCacheEntry{addr: src, hw: hw}
+	ap.next = (ap.next + 1) % apMaxNeighbours
+}
+
+// addressNeighbour sets the destination hardware address of an outgoing
+// IPv4 frame built by lneto while running as an access point.
+func (s *Stack) addressNeighbour(frame []byte) {
+	ap := s.ap
+	if ap == nil {
+		return
+	}
+	efrm, err := ethernet.NewFrame(frame)
+	if err != nil || efrm.EtherTypeOrSize() != ethernet.TypeIPv4 {
+		return
+	}
+	ifrm, err := ipv4.NewFrame(frame[ethHeaderLen:])
+	if err != nil {
+		return
+	}
+	dst := netip.AddrFrom4(*ifrm.DestinationAddr())
+	if hw, ok := ap.dhcp.hardwareAddr(dst); ok {
+		*efrm.DestinationHardwareAddr() = hw
+		return
+	}
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+	for i := range ap.neighbour {
+		if ap.neighbour[i].addr == dst {
+			*efrm.DestinationHardwareAddr() = ap.neighbour[i].hw
+			return
+		}
+	}
+}
+
+// serveCaptiveDNS answers A queries with the stack's address. Other query
+// types get an empty answer so clients don't wait for a timeout.
+func (s *Stack) serveCaptiveDNS(pkt *UDPPacket) bool {
+	const (
+		headerLen = 12
+		typeA     = 1
+		classIN   = 1
+	)
+	q := pkt.Payload
+	if len(q) < headerLen || q[2]&0x80 != 0 || q[2]&0x78 != 0 {
+		return true // Not a standard query.
+	} else if binary.BigEndian.Uint16(q[4:6]) != 1 {
+		return true
+	}
+	// Skip the question name, which is uncompressed in queries.
+	off := headerLen
+	for off < len(q) && q[off] != 0 {
+		if q[off]&0xc0 != 0 {
+			return true
+		}
+		off += int(q[off]) + 1
+	}
+	off++
+	if off+4 > len(q) {
+		return true
+	}
+	qtype := binary.BigEndian.Uint16(q[off:])
+	qclass := binary.BigEndian.Uint16(q[off+2:])
+	off += 4
+	const answerLen = 16
+	if off+answerLen > maxDNSReply {
+		return true
+	}
+
+	ap := s.ap
+	resp := ap.dnsbuf[:off]
+	copy(resp, q[:off])
+	resp[2] = 0x84 | q[2]&0x01 // Response, authoritative, recursion desired copied.
+	resp[3] = 0x80             // Recursion available, no error.
+	binary.BigEndian.PutUint16(resp[6:8], 0)
+	binary.BigEndian.PutUint32(resp[8:12], 0) // No authority or additional records.
+	if qtype == typeA && qclass == classIN {
+		binary.BigEndian.PutUint16(resp[6:8], 1)
+		addr := s.Addr().As4()
+		resp = append(resp,
+			0xc0, headerLen, // Pointer to the question name.
+			0, typeA, 0, classIN,
+			0, 0, 0, captiveDNSTTL,
+			0, 4, addr[0], addr[1], addr[2], addr[3],
+		)
+	}
+	err := s.SendUDPTo(pkt.SrcHW, dnsPort, pkt.Src, resp)
+	if err != nil {
+		s.log.Error("ap:dns-reply", slog.String("err", err.Error()))
+	}
+	return true
+}
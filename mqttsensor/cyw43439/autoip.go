@@ -0,0 +1,359 @@
+package cyw43439
+
+import (
+	"errors"
+	"hash/fnv"
+	"log/slog"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/soypat/lneto"
+	"github.com/soypat/lneto/arp"
+	"github.com/soypat/lneto/dhcpv4"
+	"github.com/soypat/lneto/ethernet"
+	"github.com/soypat/lneto/ipv4"
+	"github.com/soypat/lneto/udp"
+	"github.com/soypat/lneto/x/xnet"
+)
+
+// IPv4 link-local address configuration per RFC 3927, used when DHCP fails
+// and [DHCPConfig.LinkLocalFallback] is set. A pseudo-random address in
+// 169.254.1.0-169.254.254.255 is probed with ARP, claimed with
+// announcements and defended against later conflicts. DHCP keeps being
+// retried in the background and replaces the link-local address on success.
+
+// Timing constants from RFC 3927 section 9.
+const (
+	llProbeWait        = 1 * time.Second
+	llProbeNum         = 3
+	llProbeMin         = 1 * time.Second
+	llProbeMax         = 2 * time.Second
+	llAnnounceWait     = 2 * time.Second
+	llAnnounceNum      = 2
+	llAnnounceInterval = 2 * time.Second
+	llMaxConflicts     = 10
+	llRateLimit        = 60 * time.Second
+	llDefendInterval   = 10 * time.Second
+
+	// llDHCPRetry is how often DHCP is retried while on a link-local address.
+	llDHCPRetry = time.Minute
+	arpFrameLen = ethHeaderLen + 28
+)
+
+var linkLocalPrefix = netip.MustParsePrefix("169.254.0.0/16")
+
+var errLinkLocalConflict = errors.New("link-local address conflict")
+
+type autoIPState uint8
+
+const (
+	autoIPIdle autoIPState = iota
+	autoIPProbing
+	autoIPClaimed
+)
+
+// autoIP is the link-local address state shared with the receive path,
+// which watches ARP traffic for conflicts.
+type autoIP struct {
+	mu        sync.Mutex
+	state     autoIPState
+	addr      netip.Addr // Candidate while probing, claimed address after.
+	conflict  bool       // Conflict seen while probing.
+	lost      bool       // Claimed address lost to another host.
+	defended  time.Time  // Last time the claimed address was defended.
+	conflicts int        // Conflicts since the last successful claim.
+}
+
+// IsLinkLocal reports whether the stack is using a self-assigned
+// link-local address.
+func (s *Stack) IsLinkLocal() bool {
+	ll := &s.autoip
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	return ll.state == autoIPClaimed
+}
+
+// claimLinkLocal selects, probes and announces a link-local address and
+// assigns it to the stack. It blocks for several seconds.
+func (s *Stack) claimLinkLocal() (*xnet.DHCPResults, error) {
+	ll := &s.autoip
+	s.s.SetIPAddr(netip.AddrFrom4([4]byte{}))
+	s.s.SetGateway6([6]byte{}) // There's no router on a link-local network.
+	s.flushHWCache()
+
+	mac := s.s.HardwareAddress()
+	h := fnv.New32a()
+	h.Write(mac[:])
+	// The first candidate derives from the MAC so the device tends to get
+	// the same address across reboots.
+	seed := h.Sum32()
+	for {
+		candidate := linkLocalCandidate(seed)
+		seed = s.Prand32()
+
+		ll.mu.Lock()
+		ll.state = autoIPProbing
+		ll.addr = candidate
+		ll.conflict = false
+		ll.lost = false
+		ratelimit := ll.conflicts >= llMaxConflicts
+		ll.mu.Unlock()
+		if ratelimit {
+			time.Sleep(llRateLimit)
+		}
+
+		s.log.Info("autoip:probing", slog.String("ip", candidate.String()))
+		err := s.probeLinkLocal(candidate)
+		if err == nil {
+			break
+		} else if err != errLinkLocalConflict {
+			s.resetLinkLocal()
+			return nil, err
+		}
+		s.log.Info("autoip:conflict", slog.String("ip", candidate.String()))
+		ll.mu.Lock()
+		ll.conflicts++
+		ll.mu.Unlock()
+	}
+
+	ll.mu.Lock()
+	ll.state = autoIPClaimed
+	ll.conflicts = 0
+	addr := ll.addr
+	ll.mu.Unlock()
+	results := &xnet.DHCPResults{
+		AssignedAddr:  addr,
+		Subnet:        linkLocalPrefix,
+		BroadcastAddr: broadcastAddr(linkLocalPrefix),
+	}
+	err := s.s.AssimilateDHCPResults(results)
+	if err != nil {
+		s.resetLinkLocal()
+		return nil, errors.New("assign link-local:" + err.Error())
+	}
+	s.subnet = linkLocalPrefix
+	for i := 0; i < llAnnounceNum; i++ {
+		if i > 0 {
+			time.Sleep(llAnnounceInterval)
+		}
+		s.sendARP(addr, [6]byte{}, addr)
+	}
+	s.log.Info("autoip:claimed", slog.String("ip", addr.String()))
+	return results, nil
+}
+
+// probeLinkLocal sends ARP probes for candidate and waits for conflicting
+// replies or probes from other hosts.
+func (s *Stack) probeLinkLocal(candidate netip.Addr) error {
+	ll := &s.autoip
+	conflicted := func() bool {
+		ll.mu.Lock()
+		defer ll.mu.Unlock()
+		return ll.conflict
+	}
+	time.Sleep(s.randDuration(0, llProbeWait))
+	for i := 0; i < llProbeNum; i++ {
+		if conflicted() {
+			return errLinkLocalConflict
+		}
+		err := s.sendARP(netip.AddrFrom4([4]byte{}), [6]byte{}, candidate)
+		if err != nil {
+			return err
+		}
+		if i < llProbeNum-1 {
+			time.Sleep(s.randDuration(llProbeMin, llProbeMax))
+		}
+	}
+	time.Sleep(llAnnounceWait)
+	if conflicted() {
+		return errLinkLocalConflict
+	}
+	return nil
+}
+
+// resetLinkLocal stops using or probing a link-local address.
+func (s *Stack) resetLinkLocal() {
+	ll := &s.autoip
+	ll.mu.Lock()
+	ll.state = autoIPIdle
+	ll.addr = netip.Addr{}
+	ll.lost = false
+	ll.mu.Unlock()
+}
+
+// maintainLinkLocal retries DHCP in the background and replaces the
+// link-local address if it was lost to a conflict. It returns true if the
+// stack's address changed.
+func (s *Stack) maintainLinkLocal() (addrChanged bool, err error) {
+	l := &s.lease
+	ll := &s.autoip
+	ll.mu.Lock()
+	lost := ll.lost
+	ll.mu.Unlock()
+	if lost {
+		s.log.Error("autoip:address-lost", slog.String("ip", s.Addr().String()))
+		_, err = s.claimLinkLocal()
+		if err != nil {
+			return true, err
+		}
+		return true, nil
+	}
+
+	l.mu.Lock()
+	retry := !time.Now().Before(l.nextTx)
+	l.mu.Unlock()
+	if !retry {
+		return false, nil
+	}
+	cfg := s.dhcpCfg
+	cfg.RequestedAddr = netip.Addr{}
+	cfg.LinkLocalFallback = false
+	_, err = s.setupWithDHCP(cfg, netip.Addr{})
+	if err != nil {
+		s.setLinkLocalPhase()
+		return false, err
+	}
+	return true, nil
+}
+
+// setLinkLocalPhase marks the lease as on a link-local address so
+// maintainLease retries DHCP later.
+func (s *Stack) setLinkLocalPhase() {
+	l := &s.lease
+	l.mu.Lock()
+	l.phase = leaseLinkLocal
+	l.nextTx = time.Now().Add(llDHCPRetry)
+	l.mu.Unlock()
+}
+
+// watchARP inspects received ARP packets for link-local conflicts. It never
+// consumes the frame; lneto still answers requests for our address.
+func (s *Stack) watchARP(pkt []byte) {
+	efrm, err := ethernet.NewFrame(pkt)
+	if err != nil || efrm.EtherTypeOrSize() != ethernet.TypeARP {
+		return
+	}
+	afrm, err := arp.NewFrame(pkt[ethHeaderLen:])
+	if err != nil {
+		return
+	}
+	_, hlen := afrm.Hardware()
+	if _, plen := afrm.Protocol(); plen != 4 || hlen != 6 {
+		return
+	}
+	ll := &s.autoip
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	if ll.state == autoIPIdle {
+		return
+	}
+	senderHW, senderIP := afrm.Sender4()
+	_, targetIP := afrm.Target4()
+	if *senderHW == s.s.HardwareAddress() {
+		return
+	}
+	addr := ll.addr.As4()
+	switch ll.state {
+	case autoIPProbing:
+		// Someone uses the address, or is probing for it too.
+		if *senderIP == addr || (*senderIP == [4]byte{} && *targetIP == addr && afrm.Operation() == arp.OpRequest) {
+			ll.conflict = true
+		}
+	case autoIPClaimed:
+		if *senderIP != addr {
+			return
+		}
+		now := time.Now()
+		if !ll.defended.IsZero() && now.Sub(ll.defended) < llDefendInterval {
+			// Second conflict within DEFEND_INTERVAL: give up the address.
+			ll.lost = true
+			return
+		}
+		ll.defended = now
+		s.sendARP(ll.addr, [6]byte{}, ll.addr) // Defend with an announcement.
+	}
+}
+
+// sendARP queues a broadcast ARP request. A probe has an unspecified
+// sender address and an announcement has equal sender and target addresses.
+func (s *Stack) sendARP(sender netip.Addr, targetHW [6]byte, target netip.Addr) error {
+	u := &s.udp
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	buf, err := u.nextFrame(arpFrameLen)
+	if err != nil {
+		return err
+	}
+	mac := s.s.HardwareAddress()
+	efrm, _ := ethernet.NewFrame(buf)
+	*efrm.DestinationHardwareAddr() = ethernet.BroadcastAddr()
+	*efrm.SourceHardwareAddr() = mac
+	efrm.SetEtherType(ethernet.TypeARP)
+
+	afrm, _ := arp.NewFrame(buf[ethHeaderLen:])
+	afrm.SetHardware(1, 6)
+	afrm.SetProtocol(ethernet.TypeIPv4, 4)
+	afrm.SetOperation(arp.OpRequest)
+	senderHW, senderIP := afrm.Sender4()
+	*senderHW = mac
+	*senderIP = sender.As4()
+	tHW, tIP := afrm.Target4()
+	*tHW = targetHW
+	*tIP = target.As4()
+	u.pushFrame(arpFrameLen)
+	s.Notify()
+	return nil
+}
+
+// readdressDHCPReply rewrites the destination of DHCP replies to the
+// link-local address while DHCP is retried in the background. lneto drops
+// datagrams not addressed to the stack's own address, which includes
+// broadcast offers once a link-local address is assigned.
+func (s *Stack) readdressDHCPReply(pkt []byte) {
+	ll := &s.autoip
+	ll.mu.Lock()
+	claimed := ll.state == autoIPClaimed
+	addr := ll.addr.As4()
+	ll.mu.Unlock()
+	if !claimed {
+		return
+	}
+	efrm, err := ethernet.NewFrame(pkt)
+	if err != nil || efrm.EtherTypeOrSize() != ethernet.TypeIPv4 {
+		return
+	}
+	ifrm, err := ipv4.NewFrame(pkt[ethHeaderLen:])
+	if err != nil || ifrm.Protocol() != lneto.IPProtoUDP || *ifrm.DestinationAddr() == addr {
+		return
+	}
+	ihl := ifrm.HeaderLength()
+	tl := int(ifrm.TotalLength())
+	if ihl < ipv4HeaderLen || tl > len(pkt)-ethHeaderLen || tl < ihl+udpHeaderLen {
+		return
+	}
+	ufrm, err := udp.NewFrame(pkt[ethHeaderLen+ihl : ethHeaderLen+tl])
+	if err != nil || ufrm.DestinationPort() != dhcpv4.DefaultClientPort {
+		return
+	}
+	*ifrm.DestinationAddr() = addr
+	ifrm.SetCRC(ifrm.CalculateHeaderCRC())
+	ufrm.SetCRC(0)
+	var crc lneto.CRC791
+	ifrm.CRCWriteUDPPseudo(&crc, ufrm.Length())
+	ufrm.SetCRC(lneto.NeverZeroSum(crc.PayloadSum16(ufrm.RawData())))
+}
+
+// linkLocalCandidate maps r onto 169.254.1.0-169.254.254.255.
+func linkLocalCandidate(r uint32) netip.Addr {
+	n := r%(254*256) + 256
+	return netip.AddrFrom4([4]byte{169, 254, byte(n >> 8), byte(n)})
+}
+
+// randDuration returns a pseudo-random duration in [lo, hi).
+func (s *Stack) randDuration(lo, hi time.Duration) time.Duration {
+	if hi <= lo {
+		return lo
+	}
+	return lo + time.Duration(int64(s.Prand32())%int64(hi-lo))
+}
@@ -0,0 +1,212 @@
+package cyw43439
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/harveysanders/picoplayground/mqttsensor/pcapng"
+	"github.com/soypat/lneto"
+	"github.com/soypat/lneto/ethernet"
+	"github.com/soypat/lneto/ipv4"
+)
+
+// Frames are copied into the capture ring on the packet processing
+// goroutine, so capturing never waits on the output. Capture.Run writes
+// them out as pcapng blocks framed by [pcapng.AppendLine]; frames arriving
+// while the ring is full are dropped and reported in statistics blocks.
+
+const (
+	defaultSnapLen       = 256
+	defaultCaptureFrames = 16
+)
+
+// CaptureConfig configures a [Capture].
+type CaptureConfig struct {
+	// Filter selects the frames to capture. Nil captures every frame.
+	// It is called on the packet processing goroutine and must not block
+	// or keep the frame.
+	Filter func(frame []byte) bool
+	// SnapLen is the number of bytes kept of each frame. Defaults to 256,
+	// enough for the headers and the start of the payload.
+	SnapLen int
+	// Frames is the number of frames that can await output. Defaults to 16.
+	Frames int
+}
+
+type capturedFrame struct {
+	ts      time.Time
+	origLen int
+	n       int
+	dir     pcapng.Direction
+}
+
+// Capture tees the frames a [Stack] sends and receives into a pcapng
+// stream. Attach it with [Stack.SetCapture] and call Run to write it out.
+type Capture struct {
+	w       io.Writer
+	filter  func([]byte) bool
+	snapLen int
+
+	mu     sync.Mutex
+	frames []capturedFrame
+	data   []byte // Frame i is at data[i*snapLen:].
+	head   int
+	queued int
+	seen   uint64
+	drops  uint64
+	ready  chan struct{}
+
+	// Used by Run.
+	block []byte
+	line  []byte
+}
+
+// NewCapture returns a capture that writes to w, usually the USB serial
+// console.
+func NewCapture(w io.Writer, cfg CaptureConfig) *Capture {
+	snapLen := cfg.SnapLen
+	if snapLen <= 0 || snapLen > mtu+ethHeaderLen {
+		snapLen = defaultSnapLen
+	}
+	n := cfg.Frames
+	if n <= 0 {
+		n = defaultCaptureFrames
+	}
+	// An enhanced packet block adds 44 bytes of header and options.
+	blockLen := snapLen + 48
+	return &Capture{
+		w:       w,
+		filter:  cfg.Filter,
+		snapLen: snapLen,
+		frames:  make([]capturedFrame, n),
+		data:    make([]byte, n*snapLen),
+		ready:   make(chan struct{}, 1),
+		block:   make([]byte, 0, blockLen),
+		line:    make([]byte, 0, len(pcapng.LinePrefix)+(blockLen+2)/3*4+1),
+	}
+}
+
+// SetCapture starts teeing frames into c, or stops if c is nil. It must be
+// called before the packet processing loop is started.
+func (s *Stack) SetCapture(c *Capture) {
+	s.capture = c
+}
+
+// Dropped returns the number of frames dropped because the ring was full.
+func (c *Capture) Dropped() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.drops
+}
+
+// tee copies frame into the ring if it passes the filter. c may be nil.
+func (c *Capture) tee(frame []byte, dir pcapng.Direction) {
+	if c == nil || (c.filter != nil && !c.filter(frame)) {
+		return
+	}
+	ts := time.Now()
+	c.mu.Lock()
+	c.seen++
+	if c.queued == len(c.frames) {
+		c.drops++
+		c.mu.Unlock()
+		return
+	}
+	i := (c.head + c.queued) % len(c.frames)
+	n := copy(c.data[i*c.snapLen:(i+1)*c.snapLen], frame)
+	c.frames[i] = capturedFrame{ts: ts, origLen: len(frame), n: n, dir: dir}
+	c.queued++
+	c.mu.Unlock()
+
+	select {
+	case c.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Run writes the section and interface headers, then the captured frames
+// as they arrive. It only returns if writing fails.
+func (c *Capture) Run() error {
+	c.block = pcapng.AppendSectionHeader(c.block[:0])
+	c.block = pcapng.AppendInterfaceDescription(c.block, pcapng.LinkTypeEthernet, uint32(c.snapLen))
+	// Two blocks, written as two lines.
+	shbLen := int(binary.LittleEndian.Uint32(c.block[4:]))
+	if err := c.writeBlock(c.block[:shbLen]); err != nil {
+		return err
+	}
+	if err := c.writeBlock(c.block[shbLen:]); err != nil {
+		return err
+	}
+
+	var reportedDrops uint64
+	for range c.ready {
+		for {
+			c.mu.Lock()
+			if c.queued == 0 {
+				seen, drops := c.seen, c.drops
+				c.mu.Unlock()
+				if drops != reportedDrops {
+					reportedDrops = drops
+					c.block = pcapng.AppendInterfaceStatistics(c.block[:0], time.Now(), seen, drops)
+					if err := c.writeBlock(c.block); err != nil {
+						return err
+					}
+				}
+				break
+			}
+			i := c.head
+			f := c.frames[i]
+			c.block = pcapng.AppendEnhancedPacket(c.block[:0], f.ts, c.data[i*c.snapLen:i*c.snapLen+f.n], f.origLen, f.dir)
+			c.head = (c.head + 1) % len(c.frames)
+			c.queued--
+			c.mu.Unlock()
+			if err := c.writeBlock(c.block); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeBlock writes the block as a single line, so it isn't split by log
+// output written between calls.
+func (c *Capture) writeBlock(block []byte) error {
+	c.line = pcapng.AppendLine(c.line[:0], block)
+	_, err := c.w.Write(c.line)
+	return err
+}
+
+// PortFilter returns a [CaptureConfig] filter that keeps IPv4 TCP and UDP
+// frames to or from any of the ports. Other frames, such as ARP, are
+// dropped.
+func PortFilter(ports ...uint16) func(frame []byte) bool {
+	return func(frame []byte) bool {
+		efrm, err := ethernet.NewFrame(frame)
+		if err != nil || efrm.EtherTypeOrSize() != ethernet.TypeIPv4 {
+			return false
+		}
+		ifrm, err := ipv4.NewFrame(frame[ethHeaderLen:])
+		if err != nil {
+			return false
+		}
+		if proto := ifrm.Protocol(); proto != lneto.IPProtoTCP && proto != lneto.IPProtoUDP {
+			return false
+		}
+		// TCP and UDP both start with the source and destination ports.
+		off := ethHeaderLen + ifrm.HeaderLength()
+		if len(frame) < off+4 {
+			return false
+		}
+		l4 := frame[off:]
+		src := binary.BigEndian.Uint16(l4[0:])
+		dst := binary.BigEndian.Uint16(l4[2:])
+		for _, p := range ports {
+			if p == src || p == dst {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -3,10 +3,19 @@
 //
 // This package simplifies the process of:
 //   - Initializing the CYW43439 WiFi device
-//   - Joining WPA2-secured or open WiFi networks
-//   - Performing DHCP configuration with fallback to static IP
+//   - Joining WPA2-secured or open WiFi networks, chosen by priority from a
+//     list of known networks
+//   - Performing DHCP configuration with fallback to static IP, and
+//     renewing the lease before it expires
+//   - Static IPv4 configuration with gateway, DNS and NTP servers
+//   - IPv4 link-local (AutoIP) addressing when DHCP is unavailable
 //   - DNS hostname resolution via lneto stack
+//   - IPv6 link-local and SLAAC addressing with neighbour discovery, for
+//     UDP and AAAA lookups
 //   - Asynchronous network packet handling
+//   - Supervising the WiFi link and rejoining after link loss
+//   - Running as an access point with a DHCP server and captive DNS
+//   - Capturing frames to a pcapng stream for Wireshark
 //
 // The code is adapted from the examples in the soypat/cyw43439 repository:
 // https://github.com/soypat/cyw43439/tree/main/examples/common
@@ -18,14 +27,22 @@ import (
 	"errors"
 	"io"
 	"log/slog"
+	"machine"
 	"net"
 	"net/netip"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/harveysanders/picoplayground/mqttsensor/pcapng"
 	"github.com/soypat/cyw43439"
+	"github.com/soypat/lneto"
+	"github.com/soypat/lneto/dhcpv4"
 	"github.com/soypat/lneto/x/xnet"
 )
 
+// mtu is the largest Ethernet payload; frames are up to
+// cyw43439.MaxFrameSize bytes with the header.
 const mtu = cyw43439.MTU
 
 var (
@@ -63,6 +80,12 @@ type DHCPConfig struct {
 	RequestedAddr netip.Addr
 	// Hostname is used in the DHCP request.
 	Hostname string
+	// Static, if enabled, is applied instead of performing DHCP.
+	Static StaticConfig
+	// LinkLocalFallback selects an RFC 3927 link-local address in
+	// 169.254.0.0/16 if DHCP fails and RequestedAddr is not set. DHCP is
+	// then retried in the background while the link-local address is used.
+	LinkLocalFallback bool
 }
 
 // Stack wraps the lneto StackAsync and CYW43439 device for network operations.
@@ -71,45 +94,84 @@ type Stack struct {
 	dev     *cyw43439.Device
 	log     *slog.Logger
 	sendbuf []byte
+
+	// networks are the known networks and network the joined one, kept
+	// so the link can be re-established by a Supervisor.
+	networks []Network
+	network  Network
+	// dhcpCfg is the configuration of the last SetupWithDHCP call.
+	dhcpCfg DHCPConfig
+	// subnet is the local network prefix, invalid if unknown.
+	subnet netip.Prefix
+	// ntpServers are those of the static configuration, guarded by
+	// lease.mu.
+	ntpServers []netip.Addr
+	// dnsServers are the IPv4 DNS servers from DHCP or the static
+	// configuration, kept for lookups lneto can't do.
+	dnsServers []netip.Addr
+	lease      dhcpLease
+	autoip     autoIP
+	udp        udpState
+	ip6        ipv6State
+	tcp6       tcp6State
+	// ap is set when running as an access point.
+	ap *apState
+	// capture, if set, receives a copy of every frame sent and received.
+	capture  *Capture
+	counters stackCounters
+
+	// wificfg is the device configuration, kept to reinitialise the chip
+	// after it was powered off.
+	wificfg cyw43439.Config
+	// radioMu is held while the device is polled and while it is powered
+	// off or on, so neither happens midway through the other. radioOff is
+	// set while it is off.
+	radioMu  sync.Mutex
+	radioOff bool
+	// mcast holds the hardware addresses of the joined multicast groups,
+	// which the chip's filter passes up. Guarded by radioMu.
+	mcast [][6]byte
+
+	// wake wakes Loop; see Notify. It has a buffer of one and is only ever
+	// sent to without blocking, which lets the interrupt handler use it.
+	// onHostWake is the interrupt handler Loop arms, and fastPoll counts
+	// callers of PollFast.
+	wake       chan struct{}
+	onHostWake func(machine.Pin)
+	fastPoll   atomic.Int32
 }
 
 // NewConfiguredPicoWithStack creates a new WiFi stack with the given configuration.
 // It initializes the CYW43439 device, joins the WiFi network, and prepares the stack.
 func NewConfiguredPicoWithStack(ssid, pass string, wificfg cyw43439.Config, cfg StackConfig) (*Stack, error) {
+	return NewConfiguredPicoWithNetworks([]Network{{SSID: ssid, Password: pass}}, wificfg, cfg)
+}
+
+// NewConfiguredPicoWithNetworks is like [NewConfiguredPicoWithStack] but
+// selects among several known networks. They are tried by priority, the
+// next one when a join fails, and the whole list is retried until a join
+// succeeds.
+func NewConfiguredPicoWithNetworks(nets []Network, wificfg cyw43439.Config, cfg StackConfig) (*Stack, error) {
 	if cfg.Hostname == "" {
 		return nil, errors.New("empty hostname")
 	}
 
-	logger := cfg.Logger
-	if logger == nil {
-		logger = slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{
-			Level: slog.Level(127), // Make temporary logger that does no logging.
-		}))
-	}
-
+	logger := cfg.logger()
 	start := time.Now()
-	dev := cyw43439.NewPicoWDevice()
-	dev.SetLogger(logger)
-
-	logger.Info("initializing pico W device...")
-	err := dev.Init(wificfg)
+	dev, err := initDevice(wificfg, logger)
 	if err != nil {
-		return nil, errors.New("wifi init failed:" + err.Error())
+		return nil, err
 	}
-	logger.Info("cyw43439:Init", slog.Duration("duration", time.Since(start)))
 
-	if len(pass) == 0 {
-		logger.Info("joining open network:", slog.String("ssid", ssid))
-	} else {
-		logger.Info("joining WPA secure network", slog.String("ssid", ssid), slog.Int("passlen", len(pass)))
+	if len(nets) == 0 {
+		return nil, errors.New("no WiFi networks configured")
 	}
-
+	var joined Network
 	for {
-		err = dev.JoinWPA2(ssid, pass)
+		joined, err = joinBest(dev, nets, logger)
 		if err == nil {
 			break
 		}
-		logger.Error("wifi join failed", slog.String("err", err.Error()))
 		time.Sleep(5 * time.Second)
 	}
 
@@ -117,65 +179,140 @@ func NewConfiguredPicoWithStack(ssid, pass string, wificfg cyw43439.Config, cfg
 	if err != nil {
 		return nil, errors.New("get hardware address:" + err.Error())
 	}
-	logger.Info("wifi join success!", slog.String("mac", net.HardwareAddr(mac[:]).String()))
+	logger.Info("wifi join success!", slog.String("ssid", joined.SSID), slog.String("mac", net.HardwareAddr(mac[:]).String()))
 
-	// Configure Stack
+	stack, err := newStack(dev, mac, cfg, logger, time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+	stack.networks = nets
+	stack.network = joined
+	stack.wificfg = wificfg
+	return stack, nil
+}
+
+func (cfg StackConfig) logger() *slog.Logger {
+	if cfg.Logger != nil {
+		return cfg.Logger
+	}
+	return slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{
+		Level: slog.Level(127), // Make temporary logger that does no logging.
+	}))
+}
+
+// initDevice powers up the CYW43439 and loads its firmware.
+func initDevice(wificfg cyw43439.Config, logger *slog.Logger) (*cyw43439.Device, error) {
+	start := time.Now()
+	dev := cyw43439.NewPicoWDevice()
+	dev.SetLogger(logger)
+
+	logger.Info("initializing pico W device...")
+	err := dev.Init(wificfg)
+	if err != nil {
+		return nil, errors.New("wifi init failed:" + err.Error())
+	}
+	logger.Info("cyw43439:Init", slog.Duration("duration", time.Since(start)))
+	return dev, nil
+}
+
+// newStack resets the lneto stack on top of an initialized device and
+// hooks up the receive path.
+func newStack(dev *cyw43439.Device, mac [6]byte, cfg StackConfig, logger *slog.Logger, elapsed time.Duration) (*Stack, error) {
 	stack := &Stack{
 		dev:     dev,
 		log:     logger,
-		sendbuf: make([]byte, mtu),
+		sendbuf: make([]byte, cyw43439.MaxFrameSize),
+		wake:    make(chan struct{}, 1),
 	}
 
-	maxTCP := cfg.MaxTCPPorts
-	if maxTCP < 1 {
-		maxTCP = 1
-	}
+	maxTCP := min(max(cfg.MaxTCPPorts, 1), 0xffff)
 
-	elapsed := time.Since(start)
-	err = stack.s.Reset(xnet.StackConfig{
-		Hostname:        cfg.Hostname,
-		MaxTCPConns:     maxTCP,
-		RandSeed:        elapsed.Nanoseconds() ^ cfg.RandSeed,
-		HardwareAddress: mac,
-		MTU:             mtu,
+	err := stack.s.Reset(xnet.StackConfig{
+		Hostname:          cfg.Hostname,
+		MaxActiveTCPPorts: uint16(maxTCP),
+		RandSeed:          elapsed.Nanoseconds() ^ cfg.RandSeed,
+		HardwareAddress:   mac,
+		MTU:               mtu,
 	})
 	if err != nil {
 		return nil, errors.New("stack reset:" + err.Error())
 	}
 
 	dev.RecvEthHandle(func(pkt []byte) error {
-		return stack.s.Demux(pkt, 0)
+		stack.counters.framesIn.Add(1)
+		stack.counters.bytesIn.Add(uint64(len(pkt)))
+		stack.capture.tee(pkt, pcapng.DirInbound)
+		stack.watchARP(pkt)
+		stack.readdressDHCPReply(pkt)
+		stack.learnNeighbour(pkt)
+		if stack.handleIPv6(pkt) || stack.demuxUDP(pkt) {
+			return nil
+		}
+		return stack.s.IngressEthernet(pkt)
 	})
+	stack.HandleUDP(dhcpv4.DefaultClientPort, stack.handleLeaseReply)
 
 	return stack, nil
 }
 
 // SetupWithDHCP performs DHCP configuration and returns the results.
+// If cfg.Static is enabled it is applied instead and the results describe
+// the static configuration.
+// The configuration is kept so a [Supervisor] can redo it after link loss.
 func (s *Stack) SetupWithDHCP(cfg DHCPConfig) (*xnet.DHCPResults, error) {
-	if !cfg.RequestedAddr.Is4() {
-		// If no address provided, use a zero address
-		if !cfg.RequestedAddr.IsValid() {
-			cfg.RequestedAddr = netip.AddrFrom4([4]byte{0, 0, 0, 0})
-		} else {
-			return nil, errors.New("only dhcpv4 supported")
-		}
+	s.dhcpCfg = cfg
+	return s.setupWithDHCP(cfg, netip.Addr{})
+}
+
+// setupWithDHCP is SetupWithDHCP without keeping cfg. A valid hint is the
+// address asked of the server in place of cfg.RequestedAddr, e.g. the one
+// held before the link was lost. Unlike cfg.RequestedAddr it is never
+// assigned without the server's consent, since another host may have it by
+// now.
+func (s *Stack) setupWithDHCP(cfg DHCPConfig, hint netip.Addr) (*xnet.DHCPResults, error) {
+	if cfg.Static.IsEnabled() {
+		return s.setupStatic(cfg.Static)
+	}
+	if cfg.RequestedAddr.IsValid() && !cfg.RequestedAddr.Is4() {
+		return nil, errors.New("only dhcpv4 supported")
+	}
+	requested := netip.AddrFrom4([4]byte{0, 0, 0, 0})
+	if hint.Is4() {
+		requested = hint
+	} else if cfg.RequestedAddr.IsValid() {
+		requested = cfg.RequestedAddr
 	}
 
 	const pollTime = 50 * time.Millisecond
-	rstack := s.s.StackRetrying(pollTime)
+	rstack := s.s.StackRetrying(pollEvery(pollTime))
 
 	s.log.Info("DHCP:starting")
+	s.stopLease()
 
-	dhcpResults, err := rstack.DoDHCPv4(cfg.RequestedAddr.As4(), 3*time.Second, 3)
+	defer s.PollFast()()
+	start := time.Now()
+	s.counters.dhcpAttempts.Add(1)
+	dhcpResults, err := rstack.DoDHCPv4(requested.As4(), 3*time.Second, 3)
 	if err != nil {
+		s.counters.dhcpFailures.Add(1)
 		// If DHCP fails but we have a requested address, use it as static IP
 		if cfg.RequestedAddr.IsValid() && !cfg.RequestedAddr.IsUnspecified() {
 			s.log.Info("DHCP did not complete, assigning static IP", slog.String("ip", cfg.RequestedAddr.String()))
 			s.s.SetIPAddr(cfg.RequestedAddr)
+			s.subnet = netip.Prefix{}
 			return &xnet.DHCPResults{
 				AssignedAddr: cfg.RequestedAddr,
 			}, nil
 		}
+		if cfg.LinkLocalFallback {
+			s.log.Info("DHCP did not complete, using link-local address", slog.String("err", err.Error()))
+			results, llerr := s.claimLinkLocal()
+			if llerr == nil {
+				s.setLinkLocalPhase()
+				return results, nil
+			}
+			err = errors.Join(err, llerr)
+		}
 		return nil, errors.New("dhcp failed:" + err.Error())
 	}
 
@@ -186,17 +323,26 @@ func (s *Stack) SetupWithDHCP(cfg DHCPConfig) (*xnet.DHCPResults, error) {
 	}
 
 	// Resolve and set the router hardware address as the gateway
-	gatewayHW, err := rstack.DoResolveHardwareAddress6(dhcpResults.Router, 500*time.Millisecond, 4)
+	gatewayHW, err := s.resolveHardwareAddr(dhcpResults.Router, pollTime, 4)
 	if err != nil {
 		return nil, errors.New("resolve gateway:" + err.Error())
 	}
 	s.s.SetGateway6(gatewayHW)
+	s.subnet = dhcpResults.Subnet
+	s.lease.mu.Lock()
+	s.ntpServers = s.ntpServers[:0] // Use those from DHCP.
+	s.lease.mu.Unlock()
+	s.dnsServers = append(s.dnsServers[:0], dhcpResults.DNSServers...)
+	s.resetLinkLocal()
+	s.flushHWCache()
+	s.startLease(dhcpResults, start)
 
 	s.log.Info("DHCP complete",
 		slog.String("ourIP", dhcpResults.AssignedAddr.String()),
 		slog.String("gateway", dhcpResults.Gateway.String()),
 		slog.String("router", dhcpResults.Router.String()),
 		slog.Uint64("lease_sec", uint64(dhcpResults.TLease)),
+		slog.Int("ntp", len(s.NTPServers())),
 	)
 
 	return dhcpResults, nil
@@ -204,40 +350,122 @@ func (s *Stack) SetupWithDHCP(cfg DHCPConfig) (*xnet.DHCPResults, error) {
 
 // RecvAndSend processes incoming and outgoing packets.
 // Returns the number of bytes sent and received, and any error.
-// This should be called in a loop from a goroutine.
+// [Stack.Loop] calls it; use it directly only to drive the stack from a
+// loop of your own.
 func (s *Stack) RecvAndSend() (send, recv int, err error) {
+	s.radioMu.Lock()
+	defer s.radioMu.Unlock()
+	if s.radioOff {
+		return 0, 0, nil
+	}
+
 	// Poll for incoming packets
 	gotPacket, errRecv := s.dev.PollOne()
 	if gotPacket {
 		recv = 1
 	}
 	if errRecv != nil {
+		s.counters.pollErrors.Add(1)
 		s.log.Error("RecvAndSend:PollOne", slog.String("err", errRecv.Error()))
 	}
 
-	// Handle outgoing packets via Encapsulate
-	send, err = s.s.Encapsulate(s.sendbuf, -1, 0)
+	// Frames from the UDP side channel go out first. They are already
+	// complete so only the lneto stack needs encapsulation below.
+	sentUDP, errUDP := s.sendQueuedUDP()
+	if errUDP != nil {
+		s.log.Error("RecvAndSend:SendUDP", slog.Int("plen", sentUDP), slog.String("err", errUDP.Error()))
+	}
+
+	// Handle outgoing packets via EgressEthernet
+	send, err = s.s.EgressEthernet(s.sendbuf)
 	if err != nil {
-		s.log.Error("RecvAndSend:Encapsulate", slog.Int("plen", send), slog.String("err", err.Error()))
+		s.counters.encapsulateErrors.Add(1)
+		s.log.Error("RecvAndSend:EgressEthernet", slog.Int("plen", send), slog.String("err", err.Error()))
 	} else {
 		err = errRecv // Pass receive error if encapsulate succeeded
 	}
+	if send == 0 {
+		// lneto only carries IPv4; connections dialed over IPv6 go next.
+		var err6 error
+		send, err6 = s.egressTCP6(s.sendbuf)
+		if err6 != nil {
+			s.counters.encapsulateErrors.Add(1)
+			s.log.Error("RecvAndSend:EgressTCP6", slog.String("err", err6.Error()))
+			err = err6
+		}
+	}
 
 	if send == 0 {
-		return send, recv, err
+		return sentUDP, recv, err
 	}
+	s.addressNeighbour(s.sendbuf[:send])
 
 	// Send the encapsulated packet
-	err = s.dev.SendEth(s.sendbuf[:send])
+	err = s.sendEth(s.sendbuf[:send])
 	if err != nil {
 		s.log.Error("RecvAndSend:SendEth", slog.Int("plen", send), slog.String("err", err.Error()))
 	}
 
-	return send, recv, err
+	return send + sentUDP, recv, err
+}
+
+// sendEth transmits a complete frame.
+func (s *Stack) sendEth(frame []byte) error {
+	s.capture.tee(frame, pcapng.DirOutbound)
+	err := s.dev.SendEth(frame)
+	if err != nil {
+		s.counters.sendErrors.Add(1)
+		return err
+	}
+	s.counters.framesOut.Add(1)
+	s.counters.bytesOut.Add(uint64(len(frame)))
+	return nil
+}
+
+// Network returns the network the device joined most recently.
+func (s *Stack) Network() Network {
+	return s.network
+}
+
+// rejoin joins the best of the known networks and restores the multicast
+// filter, which powering the chip off clears.
+func (s *Stack) rejoin() error {
+	nw, err := joinBest(s.dev, s.networks, s.log)
+	if err != nil {
+		return err
+	}
+	s.network = nw
+	s.radioMu.Lock()
+	defer s.radioMu.Unlock()
+	if len(s.mcast) > 0 {
+		err = s.dev.SetMulticastList(s.mcast)
+		if err != nil {
+			return errors.New("restore multicast filter: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// IsLinkUp reports whether the device is associated with the access point.
+func (s *Stack) IsLinkUp() bool {
+	return !s.IsRadioOff() && s.dev.IsLinkUp()
+}
+
+// LookupIP resolves host via the stack's DNS servers, trying up to retries
+// times with the given timeout each.
+func (s *Stack) LookupIP(host string, timeout time.Duration, retries int) ([]netip.Addr, error) {
+	const pollTime = 5 * time.Millisecond
+	defer s.PollFast()()
+	s.counters.dnsLookups.Add(1)
+	addrs, err := s.s.StackRetrying(pollEvery(pollTime)).DoLookupIP(host, timeout, retries)
+	if err != nil {
+		s.counters.dnsFailures.Add(1)
+	}
+	return addrs, err
 }
 
 // LnetoStack returns the underlying lneto StackAsync for direct access.
-// This is needed for operations like TCP connections and DNS lookups.
+// This is needed for operations like TCP connections and NTP requests.
 func (s *Stack) LnetoStack() *xnet.StackAsync {
 	return &s.s
 }
@@ -251,3 +479,9 @@ func (s *Stack) Prand32() uint32 {
 func (s *Stack) Addr() netip.Addr {
 	return s.s.Addr()
 }
+
+// pollEvery is the backoff of blocking stack operations: they poll for
+// their result every d.
+func pollEvery(d time.Duration) lneto.BackoffStrategy {
+	return func(uint) time.Duration { return d }
+}
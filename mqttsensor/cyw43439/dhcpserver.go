@@ -0,0 +1,211 @@
+package cyw43439
+
+import (
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/soypat/lneto/dhcpv4"
+	"github.com/soypat/lneto/ethernet"
+)
+
+// A minimal DHCP server for access point mode. It leases a small pool of
+// addresses following the device's own and hands out the device as router
+// and DNS server. lneto's dhcpv4.Server omits the subnet mask and lease
+// time, which phones require before they'll use a network.
+
+const (
+	dhcpServerPort = dhcpv4.DefaultServerPort
+	// dhcpPoolSize is the number of addresses leased to clients.
+	dhcpPoolSize = 8
+	// dhcpServerLease is the lease time handed to clients.
+	dhcpServerLease = 2 * time.Hour
+	// dhcpOfferHold is how long an offered address is reserved for a
+	// client that does not follow up with a request.
+	dhcpOfferHold = time.Minute
+	// dhcpReplyLen fits the fixed header plus the options we send and is
+	// above the 300 byte minimum some BOOTP clients expect.
+	dhcpReplyLen = dhcpv4.OptionsOffset + 64
+)
+
+type dhcpBinding struct {
+	hw      [6]byte
+	expires time.Time // Zero if the address is free.
+}
+
+// dhcpServer holds the bindings of the access point's DHCP server.
+// bindings[i] leases the address first+i.
+type dhcpServer struct {
+	mu       sync.Mutex
+	self     netip.Prefix
+	first    netip.Addr
+	bindings [dhcpPoolSize]dhcpBinding
+	txbuf    [dhcpReplyLen]byte
+}
+
+// reset clears all bindings and sets the server's address. The pool starts
+// right after self and is cut short by the end of the subnet.
+func (d *dhcpServer) reset(self netip.Prefix) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.self = self
+	d.first = self.Addr().Next()
+	d.bindings = [dhcpPoolSize]dhcpBinding{}
+}
+
+// poolAddr returns the address of binding i, invalid if it falls outside the subnet.
+func (d *dhcpServer) poolAddr(i int) netip.Addr {
+	a := d.first.As4()
+	host := uint32(a[0])<<24 | uint32(a[1])<<16 | uint32(a[2])<<8 | uint32(a[3])
+	host += uint32(i)
+	addr := netip.AddrFrom4([4]byte{byte(host >> 24), byte(host >> 16), byte(host >> 8), byte(host)})
+	if !d.self.Contains(addr) || addr == broadcastAddr(d.self.Masked()) {
+		return netip.Addr{}
+	}
+	return addr
+}
+
+// binding returns the index of the binding of hw, allocating a free or
+// expired one if alloc is set. It returns -1 if none is available.
+// d.mu must be held.
+func (d *dhcpServer) binding(hw [6]byte, alloc bool, now time.Time) int {
+	free := -1
+	for i := range d.bindings {
+		b := &d.bindings[i]
+		if b.hw == hw && !b.expires.IsZero() {
+			return i
+		} else if free < 0 && (b.expires.IsZero() || now.After(b.expires)) && d.poolAddr(i).IsValid() {
+			free = i
+		}
+	}
+	if !alloc || free < 0 {
+		return -1
+	}
+	d.bindings[free] = dhcpBinding{hw: hw, expires: now.Add(dhcpOfferHold)}
+	return free
+}
+
+// hardwareAddr returns the hardware address of the client leasing addr.
+func (d *dhcpServer) hardwareAddr(addr netip.Addr) (hw [6]byte, ok bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	for i := range d.bindings {
+		b := &d.bindings[i]
+		if !b.expires.IsZero() && now.Before(b.expires) && d.poolAddr(i) == addr {
+			return b.hw, true
+		}
+	}
+	return hw, false
+}
+
+// serveDHCP is the UDP handler for the DHCP server port.
+func (s *Stack) serveDHCP(pkt *UDPPacket) bool {
+	frm, err := dhcpv4.NewFrame(pkt.Payload)
+	if err != nil || frm.Op() != dhcpv4.OpRequest || frm.MagicCookie() != dhcpv4.MagicCookie {
+		return true
+	}
+	var msgType dhcpv4.MessageType
+	var requested, serverID netip.Addr
+	frm.ForEachOption(func(_ int, opt dhcpv4.OptNum, data []byte) error {
+		switch {
+		case opt == dhcpv4.OptMessageType && len(data) == 1:
+			msgType = dhcpv4.MessageType(data[0])
+		case opt == dhcpv4.OptRequestedIPaddress && len(data) == 4:
+			requested = netip.AddrFrom4([4]byte(data))
+		case opt == dhcpv4.OptServerIdentification && len(data) == 4:
+			serverID = netip.AddrFrom4([4]byte(data))
+		}
+		return nil
+	})
+
+	d := &s.ap.dhcp
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	hw := *frm.CHAddrAs6()
+	now := time.Now()
+	self := d.self.Addr()
+	switch msgType {
+	case dhcpv4.MsgDiscover:
+		i := d.binding(hw, true, now)
+		if i < 0 {
+			s.log.Error("ap:dhcp-pool-exhausted", slog.String("mac", net.HardwareAddr(hw[:]).String()))
+			return true
+		}
+		s.dhcpReply(frm, dhcpv4.MsgOffer, d.poolAddr(i))
+
+	case dhcpv4.MsgRequest:
+		if serverID.IsValid() && serverID != self {
+			// The client picked another server's offer.
+			if i := d.binding(hw, false, now); i >= 0 {
+				d.bindings[i] = dhcpBinding{}
+			}
+			return true
+		}
+		if !requested.IsValid() {
+			requested = netip.AddrFrom4(*frm.CIAddr()) // Renewing or rebinding.
+		}
+		i := d.binding(hw, true, now)
+		if i < 0 || d.poolAddr(i) != requested {
+			s.dhcpReply(frm, dhcpv4.MsgNack, netip.Addr{})
+			return true
+		}
+		d.bindings[i].expires = now.Add(dhcpServerLease)
+		s.log.Info("ap:dhcp-lease", slog.String("ip", requested.String()), slog.String("mac", net.HardwareAddr(hw[:]).String()))
+		s.dhcpReply(frm, dhcpv4.MsgAck, requested)
+
+	case dhcpv4.MsgRelease, dhcpv4.MsgDecline:
+		if i := d.binding(hw, false, now); i >= 0 {
+			d.bindings[i] = dhcpBinding{}
+		}
+	}
+	return true
+}
+
+// dhcpReply broadcasts a reply to the request req. s.ap.dhcp.mu must be held.
+func (s *Stack) dhcpReply(req dhcpv4.Frame, msgType dhcpv4.MessageType, yiaddr netip.Addr) {
+	d := &s.ap.dhcp
+	buf := d.txbuf[:]
+	clear(buf)
+	frm, _ := dhcpv4.NewFrame(buf)
+	frm.SetOp(dhcpv4.OpReply)
+	frm.SetHardware(1, 6, 0)
+	frm.SetXID(req.XID())
+	frm.SetFlags(req.Flags())
+	*frm.GIAddr() = *req.GIAddr()
+	*frm.CHAddr() = *req.CHAddr()
+	self := d.self.Addr().As4()
+	if msgType != dhcpv4.MsgNack {
+		*frm.YIAddr() = yiaddr.As4()
+		*frm.SIAddr() = self
+	}
+	frm.SetMagicCookie(dhcpv4.MagicCookie)
+
+	opts := frm.OptionsPayload()
+	n, _ := dhcpv4.EncodeOption(opts, dhcpv4.OptMessageType, byte(msgType))
+	nn, _ := dhcpv4.EncodeOption(opts[n:], dhcpv4.OptServerIdentification, self[:]...)
+	n += nn
+	if msgType != dhcpv4.MsgNack {
+		mask := net.CIDRMask(d.self.Bits(), 32)
+		nn, _ = dhcpv4.EncodeOption32(opts[n:], dhcpv4.OptIPAddressLeaseTime, uint32(dhcpServerLease/time.Second))
+		n += nn
+		nn, _ = dhcpv4.EncodeOption(opts[n:], dhcpv4.OptSubnetMask, mask...)
+		n += nn
+		nn, _ = dhcpv4.EncodeOption(opts[n:], dhcpv4.OptRouter, self[:]...)
+		n += nn
+		if s.ap.captiveDNS {
+			nn, _ = dhcpv4.EncodeOption(opts[n:], dhcpv4.OptDNSServers, self[:]...)
+			n += nn
+		}
+	}
+	opts[n] = byte(dhcpv4.OptEnd)
+
+	// The client has no address yet, so replies are broadcast.
+	dst := netip.AddrPortFrom(netip.AddrFrom4([4]byte{255, 255, 255, 255}), dhcpv4.DefaultClientPort)
+	err := s.sendUDPFrom(d.self.Addr(), ethernet.BroadcastAddr(), dhcpServerPort, dst, buf)
+	if err != nil {
+		s.log.Error("ap:dhcp-reply", slog.String("type", msgType.String()), slog.String("err", err.Error()))
+	}
+}
@@ -0,0 +1,763 @@
+package cyw43439
+
+import (
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/soypat/lneto"
+	"github.com/soypat/lneto/ethernet"
+	"github.com/soypat/lneto/ipv6"
+	"github.com/soypat/lneto/udp"
+)
+
+// lneto's IP layer only speaks IPv4, so IPv6 is handled here alongside it:
+// frames with the IPv6 EtherType are consumed before they reach lneto. The
+// stack configures a link-local address and SLAAC addresses from router
+// advertisements (RFC 4862), takes part in neighbour discovery (RFC 4861),
+// answers echo requests and carries UDP to and from the handlers registered
+// with HandleUDP, and TCP for connections dialed with DialTCP6. Listening
+// for TCP over IPv6 is not supported; this is a known limit of the
+// experimental IPv6 support, recorded in the README and TODO.
+
+const (
+	ipv6HeaderLen = 40
+
+	icmp6EchoRequest   = 128
+	icmp6EchoReply     = 129
+	icmp6RouterSolicit = 133
+	icmp6RouterAdvert  = 134
+	icmp6NeighSolicit  = 135
+	icmp6NeighAdvert   = 136
+
+	ndOptSourceLL = 1
+	ndOptTargetLL = 2
+	ndOptPrefix   = 3
+	ndOptRDNSS    = 25
+
+	ndFlagSolicited = 0x40
+	ndFlagOverride  = 0x20
+	prefixFlagL     = 0x80
+	prefixFlagA     = 0x40
+
+	// maxSLAACAddrs is the number of addresses kept from advertised prefixes.
+	maxSLAACAddrs = 2
+	maxRDNSS      = 2
+	ndCacheLen    = 4
+
+	// Protocol constants from RFC 4861 section 10.
+	maxRouterSolicits = 3
+	routerSolicitWait = 4 * time.Second
+	retransTimer      = time.Second
+
+	// twoHours is the lower bound RFC 4862 section 5.5.3 puts on shortening
+	// an address's valid lifetime from an unauthenticated advertisement.
+	twoHours = 2 * time.Hour
+
+	// ipv6SetupTimeout is how long a Supervisor waits for a router after
+	// rejoining.
+	ipv6SetupTimeout = 10 * time.Second
+)
+
+var (
+	errIPv6Disabled  = errors.New("ipv6 not set up")
+	errIPv6Duplicate = errors.New("ipv6 link-local address in use by another host")
+	errNoIPv6Router  = errors.New("no ipv6 router")
+	errNoIPv6Source  = errors.New("no usable ipv6 source address")
+
+	allNodes   = netip.AddrFrom16([16]byte{0: 0xff, 1: 0x02, 15: 1})
+	allRouters = netip.AddrFrom16([16]byte{0: 0xff, 1: 0x02, 15: 2})
+)
+
+// addr6 is one of the stack's IPv6 addresses.
+type addr6 struct {
+	addr   netip.Addr
+	prefix netip.Prefix
+	onLink bool
+	// dadDone is when duplicate address detection completes; the address
+	// is tentative until then.
+	dadDone time.Time
+	dup     bool
+	// validUntil and preferredUntil are zero for the link-local address,
+	// which never expires.
+	validUntil     time.Time
+	preferredUntil time.Time
+}
+
+func (a *addr6) usable(now time.Time) bool {
+	return a.addr.IsValid() && !a.dup && !now.Before(a.dadDone) &&
+		(a.validUntil.IsZero() || now.Before(a.validUntil))
+}
+
+func (a *addr6) tentative(now time.Time) bool {
+	return a.addr.IsValid() && !a.dup && now.Before(a.dadDone)
+}
+
+// ipv6State holds the Stack's IPv6 configuration, learned from router
+// advertisements on the packet processing goroutine.
+type ipv6State struct {
+	mu      sync.Mutex
+	enabled bool
+	iid     [8]byte
+	// addrs[0] is the link-local address.
+	addrs       [1 + maxSLAACAddrs]addr6
+	router      netip.Addr
+	routerHW    [6]byte
+	routerUntil time.Time
+	gotRA       bool
+	rdnss       [maxRDNSS]netip.Addr
+	rdnssUntil  time.Time
+
+	neighbours    [ndCacheLen]hwCacheEntry
+	nextNeighbour int
+}
+
+// SetupIPv6 enables IPv6. It configures a link-local address derived from
+// the hardware address, solicits router advertisements for up to timeout
+// and adds SLAAC addresses for the advertised prefixes. It returns once the
+// link-local address passed duplicate address detection and either a
+// router answered or timeout passed; later advertisements keep updating
+// the addresses and router.
+func (s *Stack) SetupIPv6(timeout time.Duration) error {
+	p := &s.ip6
+	mac := s.s.HardwareAddress()
+	p.mu.Lock()
+	p.enabled = true
+	// Modified EUI-64 interface identifier, RFC 4291 appendix A.
+	p.iid = [8]byte{mac[0] ^ 0x02, mac[1], mac[2], 0xff, 0xfe, mac[3], mac[4], mac[5]}
+	var ll [16]byte
+	ll[0], ll[1] = 0xfe, 0x80
+	copy(ll[8:], p.iid[:])
+	p.addrs = [len(p.addrs)]addr6{{
+		addr:    netip.AddrFrom16(ll),
+		prefix:  netip.PrefixFrom(netip.AddrFrom16(ll), 64).Masked(),
+		onLink:  true,
+		dadDone: time.Now().Add(retransTimer),
+	}}
+	p.router = netip.Addr{}
+	p.routerUntil = time.Time{}
+	p.gotRA = false
+	p.rdnss = [maxRDNSS]netip.Addr{}
+	p.neighbours = [ndCacheLen]hwCacheEntry{}
+	linkLocal := p.addrs[0].addr
+	p.mu.Unlock()
+
+	// Router advertisements and neighbour solicitations are multicast.
+	for _, group := range [...]netip.Addr{allNodes, solicitedNode(linkLocal)} {
+		err := s.joinMulticastHW(multicastHW6(group))
+		if err != nil {
+			return errors.New("ipv6 join " + group.String() + ": " + err.Error())
+		}
+	}
+
+	s.log.Info("ipv6:dad", slog.String("addr", linkLocal.String()))
+	err := s.sendNeighSolicit(netip.IPv6Unspecified(), linkLocal)
+	if err != nil {
+		return errors.New("ipv6 dad: " + err.Error())
+	}
+	time.Sleep(retransTimer)
+	p.mu.Lock()
+	dup := p.addrs[0].dup
+	p.mu.Unlock()
+	if dup {
+		return errIPv6Duplicate
+	}
+
+	deadline := time.Now().Add(timeout)
+	for i := 0; i < maxRouterSolicits && time.Now().Before(deadline); i++ {
+		err = s.sendRouterSolicit()
+		if err != nil {
+			s.log.Error("ipv6:router-solicit", slog.String("err", err.Error()))
+		}
+		wait := min(routerSolicitWait, time.Until(deadline))
+		for end := time.Now().Add(wait); time.Now().Before(end) && !s.gotRouterAdvert(); {
+			time.Sleep(50 * time.Millisecond)
+		}
+		if s.gotRouterAdvert() {
+			// Leave time for DAD of the SLAAC addresses.
+			time.Sleep(retransTimer)
+			break
+		}
+	}
+	s.log.Info("ipv6:configured", slog.Any("addrs", s.Addrs6()), slog.String("router", s.Router6().String()))
+	return nil
+}
+
+// ipv6Enabled reports whether SetupIPv6 was called.
+func (s *Stack) ipv6Enabled() bool {
+	s.ip6.mu.Lock()
+	defer s.ip6.mu.Unlock()
+	return s.ip6.enabled
+}
+
+func (s *Stack) gotRouterAdvert() bool {
+	s.ip6.mu.Lock()
+	defer s.ip6.mu.Unlock()
+	return s.ip6.gotRA
+}
+
+// Addrs6 returns the usable IPv6 addresses, link-local first. Tentative,
+// duplicate and expired addresses are left out.
+func (s *Stack) Addrs6() []netip.Addr {
+	p := &s.ip6
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	var addrs []netip.Addr
+	for i := range p.addrs {
+		if p.addrs[i].usable(now) {
+			addrs = append(addrs, p.addrs[i].addr)
+		}
+	}
+	return addrs
+}
+
+// Router6 returns the default IPv6 router, or the invalid address if no
+// router advertised itself or its lifetime ran out.
+func (s *Stack) Router6() netip.Addr {
+	p := &s.ip6
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.router.IsValid() || time.Now().After(p.routerUntil) {
+		return netip.Addr{}
+	}
+	return p.router
+}
+
+// source6 returns the address to send to dst from: the link-local address
+// for link-local and multicast destinations, otherwise a preferred SLAAC
+// address.
+func (p *ipv6State) source6(dst netip.Addr) (netip.Addr, error) {
+	now := time.Now()
+	if !dst.IsLinkLocalUnicast() && !dst.IsLinkLocalMulticast() && !dst.IsInterfaceLocalMulticast() {
+		var fallback netip.Addr
+		for i := 1; i < len(p.addrs); i++ {
+			a := &p.addrs[i]
+			if !a.usable(now) {
+				continue
+			}
+			if now.Before(a.preferredUntil) {
+				return a.addr, nil
+			}
+			fallback = a.addr // Deprecated, but still valid.
+		}
+		if fallback.IsValid() {
+			return fallback, nil
+		}
+		return netip.Addr{}, errNoIPv6Source
+	}
+	if !p.addrs[0].usable(now) {
+		return netip.Addr{}, errNoIPv6Source
+	}
+	return p.addrs[0].addr, nil
+}
+
+// isLocal6 reports whether addr is one of the stack's usable addresses.
+func (p *ipv6State) isLocal6(addr netip.Addr) bool {
+	now := time.Now()
+	for i := range p.addrs {
+		if p.addrs[i].addr == addr && p.addrs[i].usable(now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *ipv6State) neighbour(addr netip.Addr) (hw [6]byte, ok bool) {
+	for i := range p.neighbours {
+		if p.neighbours[i].addr == addr {
+			return p.neighbours[i].hw, true
+		}
+	}
+	return hw, false
+}
+
+func (p *ipv6State) learnNeighbour(addr netip.Addr, hw [6]byte) {
+	for i := range p.neighbours {
+		if p.neighbours[i].addr == addr {
+			p.neighbours[i].hw = hw
+			return
+		}
+	}
+	p.neighbours[p.nextNeighbour] = hwCacheEntry{addr: addr, hw: hw}
+	p.nextNeighbour = (p.nextNeighbour + 1) % ndCacheLen
+}
+
+// resolveHW6 returns the hardware address frames to addr should be sent
+// to. On-link neighbours are resolved with neighbour solicitations, which
+// may block; off-link destinations go to the router.
+func (s *Stack) resolveHW6(addr netip.Addr) (hw [6]byte, err error) {
+	if addr.IsMulticast() {
+		return multicastHW6(addr), nil
+	}
+	p := &s.ip6
+	p.mu.Lock()
+	if !p.enabled {
+		p.mu.Unlock()
+		return hw, errIPv6Disabled
+	}
+	onLink := false
+	for i := range p.addrs {
+		if p.addrs[i].onLink && p.addrs[i].prefix.Contains(addr) {
+			onLink = true
+		}
+	}
+	if !onLink {
+		router, routerHW, until := p.router, p.routerHW, p.routerUntil
+		p.mu.Unlock()
+		if !router.IsValid() || time.Now().After(until) {
+			return hw, errNoIPv6Router
+		}
+		return routerHW, nil
+	}
+	hw, ok := p.neighbour(addr)
+	p.mu.Unlock()
+	if ok {
+		return hw, nil
+	}
+
+	s.counters.arpResolves.Add(1)
+	for i := 0; i < 3; i++ {
+		p.mu.Lock()
+		src, err := p.source6(addr)
+		p.mu.Unlock()
+		if err != nil {
+			return hw, err
+		}
+		err = s.sendNeighSolicit(src, addr)
+		if err != nil {
+			return hw, err
+		}
+		for end := time.Now().Add(retransTimer); time.Now().Before(end); {
+			time.Sleep(10 * time.Millisecond)
+			p.mu.Lock()
+			hw, ok = p.neighbour(addr)
+			p.mu.Unlock()
+			if ok {
+				return hw, nil
+			}
+		}
+	}
+	s.counters.arpFailures.Add(1)
+	return hw, errors.New("resolve " + addr.String() + ": no neighbour advertisement")
+}
+
+// handleIPv6 processes IPv6 frames once IPv6 is set up. It reports whether
+// the frame was consumed.
+func (s *Stack) handleIPv6(pkt []byte) bool {
+	efrm, err := ethernet.NewFrame(pkt)
+	if err != nil || efrm.EtherTypeOrSize() != ethernet.TypeIPv6 || !s.ipv6Enabled() {
+		return false
+	}
+	i6, err := ipv6.NewFrame(pkt[ethHeaderLen:])
+	if err != nil || int(i6.PayloadLength()) > len(pkt)-ethHeaderLen-ipv6HeaderLen {
+		return true
+	}
+	if v, _, _ := i6.VersionTrafficAndFlow(); v != 6 {
+		return true
+	}
+	var crc lneto.CRC791
+	i6.CRCWritePseudo(&crc)
+	if crc.PayloadSum16(i6.Payload()) != 0 {
+		return true // Bad checksum; ICMPv6, UDP and TCP all require one.
+	}
+	src := netip.AddrFrom16(*i6.SourceAddr())
+	dst := netip.AddrFrom16(*i6.DestinationAddr())
+	switch i6.NextHeader() {
+	case lneto.IPProtoIPv6ICMP:
+		s.handleICMPv6(*efrm.SourceHardwareAddr(), src, dst, i6.HopLimit(), i6.Payload())
+	case lneto.IPProtoUDP:
+		s.demuxUDP6(*efrm.SourceHardwareAddr(), src, dst, i6.Payload())
+	case lneto.IPProtoTCP:
+		s.demuxTCP6(dst, pkt[ethHeaderLen:ethHeaderLen+ipv6HeaderLen+int(i6.PayloadLength())])
+	}
+	return true
+}
+
+func (s *Stack) handleICMPv6(srcHW [6]byte, src, dst netip.Addr, hopLimit uint8, msg []byte) {
+	if len(msg) < 8 {
+		return
+	}
+	switch msg[0] {
+	case icmp6EchoRequest:
+		s.handleEchoRequest(srcHW, src, dst, msg)
+	case icmp6RouterAdvert:
+		if hopLimit == 255 && src.IsLinkLocalUnicast() && len(msg) >= 16 {
+			s.handleRouterAdvert(srcHW, src, msg)
+		}
+	case icmp6NeighSolicit:
+		if hopLimit == 255 && len(msg) >= 24 {
+			s.handleNeighSolicit(srcHW, src, msg)
+		}
+	case icmp6NeighAdvert:
+		if hopLimit == 255 && len(msg) >= 24 {
+			s.handleNeighAdvert(srcHW, msg)
+		}
+	}
+}
+
+func (s *Stack) handleEchoRequest(srcHW [6]byte, src, dst netip.Addr, msg []byte) {
+	p := &s.ip6
+	p.mu.Lock()
+	from := dst
+	if dst.IsMulticast() {
+		from, _ = p.source6(src)
+	} else if !p.isLocal6(dst) {
+		from = netip.Addr{}
+	}
+	p.mu.Unlock()
+	if !from.IsValid() || src.IsUnspecified() || src.IsMulticast() {
+		return
+	}
+	hdr := [4]byte{icmp6EchoReply}
+	s.sendIPv6(srcHW, from, src, lneto.IPProtoIPv6ICMP, 64, hdr[:], msg[4:], 2)
+}
+
+// handleRouterAdvert applies a router advertisement, RFC 4861 section 6.3.4
+// and RFC 4862 section 5.5.3.
+func (s *Stack) handleRouterAdvert(srcHW [6]byte, src netip.Addr, msg []byte) {
+	p := &s.ip6
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	p.gotRA = true
+	lifetime := time.Duration(binary.BigEndian.Uint16(msg[6:])) * time.Second
+	if lifetime > 0 {
+		p.router = src
+		p.routerHW = srcHW
+		p.routerUntil = now.Add(lifetime)
+	} else if p.router == src {
+		p.router = netip.Addr{}
+	}
+
+	for opts := msg[16:]; len(opts) >= 8; {
+		n := int(opts[1]) * 8
+		if n == 0 || n > len(opts) {
+			return
+		}
+		opt := opts[:n]
+		opts = opts[n:]
+		switch opt[0] {
+		case ndOptSourceLL:
+			p.routerHW = [6]byte(opt[2:8])
+			p.learnNeighbour(src, p.routerHW)
+		case ndOptPrefix:
+			if n == 32 {
+				s.applyPrefix(now, opt)
+			}
+		case ndOptRDNSS:
+			life := time.Duration(binary.BigEndian.Uint32(opt[4:])) * time.Second
+			p.rdnss = [maxRDNSS]netip.Addr{}
+			for i, a := 0, opt[8:]; i < maxRDNSS && len(a) >= 16; i, a = i+1, a[16:] {
+				p.rdnss[i] = netip.AddrFrom16([16]byte(a[:16]))
+			}
+			p.rdnssUntil = now.Add(life)
+		}
+	}
+}
+
+// applyPrefix handles a prefix information option. p.mu must be held.
+func (s *Stack) applyPrefix(now time.Time, opt []byte) {
+	p := &s.ip6
+	plen := int(opt[2])
+	flags := opt[3]
+	valid := time.Duration(binary.BigEndian.Uint32(opt[4:])) * time.Second
+	preferred := time.Duration(binary.BigEndian.Uint32(opt[8:])) * time.Second
+	prefix16 := [16]byte(opt[16:32])
+	prefix, err := netip.AddrFrom16(prefix16).Prefix(plen)
+	if err != nil || prefix.Addr().IsLinkLocalUnicast() || preferred > valid {
+		return
+	}
+	if flags&prefixFlagA == 0 || plen != 64 {
+		return // Only on-link information, or not usable for SLAAC.
+	}
+	var a16 [16]byte
+	copy(a16[:8], prefix16[:8])
+	copy(a16[8:], p.iid[:])
+	addr := netip.AddrFrom16(a16)
+
+	free := -1
+	for i := 1; i < len(p.addrs); i++ {
+		a := &p.addrs[i]
+		if a.addr == addr {
+			remaining := a.validUntil.Sub(now)
+			if valid > twoHours || valid > remaining {
+				a.validUntil = now.Add(valid)
+			} else if remaining > twoHours {
+				a.validUntil = now.Add(twoHours)
+			}
+			a.preferredUntil = now.Add(preferred)
+			a.onLink = flags&prefixFlagL != 0
+			return
+		}
+		if free < 0 && (!a.addr.IsValid() || a.dup || !now.Before(a.validUntil)) {
+			free = i
+		}
+	}
+	if free < 0 || valid == 0 {
+		return
+	}
+	p.addrs[free] = addr6{
+		addr:           addr,
+		prefix:         prefix,
+		onLink:         flags&prefixFlagL != 0,
+		dadDone:        now.Add(retransTimer),
+		validUntil:     now.Add(valid),
+		preferredUntil: now.Add(preferred),
+	}
+	// The lock is held, so this can't use sendNeighSolicit's lookups.
+	s.sendIPv6(multicastHW6(solicitedNode(addr)), netip.IPv6Unspecified(), solicitedNode(addr),
+		lneto.IPProtoIPv6ICMP, 255, neighSolicit(addr, nil), nil, 2)
+	s.log.Info("ipv6:slaac", slog.String("addr", addr.String()), slog.Duration("valid", valid))
+}
+
+func (s *Stack) handleNeighSolicit(srcHW [6]byte, src netip.Addr, msg []byte) {
+	target := netip.AddrFrom16([16]byte(msg[8:24]))
+	var srcLL [6]byte
+	hasSrcLL := false
+	for opts := msg[24:]; len(opts) >= 8; {
+		n := int(opts[1]) * 8
+		if n == 0 || n > len(opts) {
+			return
+		}
+		if opts[0] == ndOptSourceLL {
+			srcLL, hasSrcLL = [6]byte(opts[2:8]), true
+		}
+		opts = opts[n:]
+	}
+
+	p := &s.ip6
+	p.mu.Lock()
+	now := time.Now()
+	ours := false
+	for i := range p.addrs {
+		a := &p.addrs[i]
+		if a.addr != target {
+			continue
+		}
+		if a.tentative(now) {
+			if src.IsUnspecified() {
+				// Another host is probing the same address.
+				a.dup = true
+				s.log.Error("ipv6:duplicate", slog.String("addr", target.String()))
+			}
+			p.mu.Unlock()
+			return
+		}
+		ours = a.usable(now)
+	}
+	if !ours {
+		p.mu.Unlock()
+		return
+	}
+	if !src.IsUnspecified() && hasSrcLL {
+		p.learnNeighbour(src, srcLL)
+	}
+	p.mu.Unlock()
+
+	dst, dstHW := src, srcHW
+	flags := byte(ndFlagSolicited | ndFlagOverride)
+	if src.IsUnspecified() {
+		dst, dstHW = allNodes, multicastHW6(allNodes)
+		flags = ndFlagOverride
+	} else if hasSrcLL {
+		dstHW = srcLL
+	}
+	mac := s.s.HardwareAddress()
+	na := [32]byte{0: icmp6NeighAdvert, 4: flags, 24: ndOptTargetLL, 25: 1}
+	copy(na[8:24], msg[8:24])
+	copy(na[26:32], mac[:])
+	s.sendIPv6(dstHW, target, dst, lneto.IPProtoIPv6ICMP, 255, na[:], nil, 2)
+}
+
+func (s *Stack) handleNeighAdvert(srcHW [6]byte, msg []byte) {
+	target := netip.AddrFrom16([16]byte(msg[8:24]))
+	hw := srcHW
+	for opts := msg[24:]; len(opts) >= 8; {
+		n := int(opts[1]) * 8
+		if n == 0 || n > len(opts) {
+			return
+		}
+		if opts[0] == ndOptTargetLL {
+			hw = [6]byte(opts[2:8])
+		}
+		opts = opts[n:]
+	}
+	p := &s.ip6
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for i := range p.addrs {
+		a := &p.addrs[i]
+		if a.addr == target && (a.tentative(now) || a.usable(now)) {
+			a.dup = true
+			s.log.Error("ipv6:duplicate", slog.String("addr", target.String()), slog.String("hw", net.HardwareAddr(hw[:]).String()))
+			return
+		}
+	}
+	p.learnNeighbour(target, hw)
+}
+
+// neighSolicit returns a neighbour solicitation for target, with a source
+// link-layer address option if srcLL is set.
+func neighSolicit(target netip.Addr, srcLL []byte) []byte {
+	ns := make([]byte, 24, 32)
+	ns[0] = icmp6NeighSolicit
+	t := target.As16()
+	copy(ns[8:], t[:])
+	if srcLL != nil {
+		ns = append(ns, ndOptSourceLL, 1)
+		ns = append(ns, srcLL...)
+	}
+	return ns
+}
+
+// sendNeighSolicit queues a solicitation for target. An unspecified src
+// makes it a duplicate address detection probe.
+func (s *Stack) sendNeighSolicit(src, target netip.Addr) error {
+	var srcLL []byte
+	if !src.IsUnspecified() {
+		mac := s.s.HardwareAddress()
+		srcLL = mac[:]
+	}
+	dst := solicitedNode(target)
+	return s.sendIPv6(multicastHW6(dst), src, dst, lneto.IPProtoIPv6ICMP, 255, neighSolicit(target, srcLL), nil, 2)
+}
+
+func (s *Stack) sendRouterSolicit() error {
+	s.ip6.mu.Lock()
+	src, err := s.ip6.source6(allRouters)
+	s.ip6.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	mac := s.s.HardwareAddress()
+	rs := [16]byte{0: icmp6RouterSolicit, 8: ndOptSourceLL, 9: 1}
+	copy(rs[10:], mac[:])
+	return s.sendIPv6(multicastHW6(allRouters), src, allRouters, lneto.IPProtoIPv6ICMP, 255, rs[:], nil, 2)
+}
+
+// sendIPv6 queues an IPv6 packet whose payload is hdr followed by data.
+// The checksum is computed and stored at csumOff in hdr, which must be
+// zero there.
+func (s *Stack) sendIPv6(dstHW [6]byte, src, dst netip.Addr, proto lneto.IPProto, hopLimit uint8, hdr, data []byte, csumOff int) error {
+	plen := len(hdr) + len(data)
+	n := ethHeaderLen + ipv6HeaderLen + plen
+	if n > udpFrameSize {
+		return errUDPPayloadSize
+	}
+	u := &s.udp
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	buf, err := u.nextFrame(n)
+	if err != nil {
+		return err
+	}
+	efrm, _ := ethernet.NewFrame(buf)
+	*efrm.DestinationHardwareAddr() = dstHW
+	*efrm.SourceHardwareAddr() = s.s.HardwareAddress()
+	efrm.SetEtherType(ethernet.TypeIPv6)
+
+	i6, _ := ipv6.NewFrame(buf[ethHeaderLen:])
+	i6.ClearHeader()
+	i6.SetVersionTrafficAndFlow(6, 0, 0)
+	i6.SetPayloadLength(uint16(plen))
+	i6.SetNextHeader(proto)
+	i6.SetHopLimit(hopLimit)
+	*i6.SourceAddr() = src.As16()
+	*i6.DestinationAddr() = dst.As16()
+
+	l4 := buf[ethHeaderLen+ipv6HeaderLen:]
+	copy(l4, hdr)
+	copy(l4[len(hdr):], data)
+	var crc lneto.CRC791
+	i6.CRCWritePseudo(&crc)
+	sum := crc.PayloadSum16(l4)
+	if sum == 0 && proto == lneto.IPProtoUDP {
+		sum = 0xffff // Zero would mean no checksum.
+	}
+	binary.BigEndian.PutUint16(l4[csumOff:], sum)
+	u.pushFrame(n)
+	s.Notify()
+	return nil
+}
+
+// sendUDP6 queues a datagram over IPv6, choosing the source address for dst.
+func (s *Stack) sendUDP6(dstHW [6]byte, srcPort uint16, dst netip.AddrPort, payload []byte) error {
+	s.ip6.mu.Lock()
+	src, err := s.ip6.source6(dst.Addr())
+	s.ip6.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	var hdr [udpHeaderLen]byte
+	ufrm, _ := udp.NewFrame(hdr[:])
+	ufrm.SetSourcePort(srcPort)
+	ufrm.SetDestinationPort(dst.Port())
+	ufrm.SetLength(uint16(udpHeaderLen + len(payload)))
+	hopLimit := uint8(64)
+	if dst.Addr().IsMulticast() {
+		hopLimit = 255
+	}
+	return s.sendIPv6(dstHW, src, dst.Addr(), lneto.IPProtoUDP, hopLimit, hdr[:], payload, 6)
+}
+
+// demuxUDP6 passes a datagram addressed to one of the stack's addresses to
+// its port's handler.
+func (s *Stack) demuxUDP6(srcHW [6]byte, src, dst netip.Addr, payload []byte) {
+	ufrm, err := udp.NewFrame(payload)
+	if err != nil || int(ufrm.Length()) < udpHeaderLen || int(ufrm.Length()) > len(payload) {
+		return
+	}
+	s.ip6.mu.Lock()
+	local := s.ip6.isLocal6(dst)
+	s.ip6.mu.Unlock()
+	if !local {
+		return
+	}
+	h := s.udpHandler(ufrm.DestinationPort())
+	if h == nil {
+		return
+	}
+	h(&UDPPacket{
+		SrcHW:   srcHW,
+		Src:     netip.AddrPortFrom(src, ufrm.SourcePort()),
+		Dst:     netip.AddrPortFrom(dst, ufrm.DestinationPort()),
+		Payload: payload[udpHeaderLen:ufrm.Length()],
+	})
+}
+
+// dnsServers6 returns the recursive DNS servers from router advertisements
+// (RFC 8106) whose lifetime has not run out.
+func (s *Stack) dnsServers6() []netip.Addr {
+	p := &s.ip6
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if time.Now().After(p.rdnssUntil) {
+		return nil
+	}
+	var servers []netip.Addr
+	for _, a := range p.rdnss {
+		if a.IsValid() {
+			servers = append(servers, a)
+		}
+	}
+	return servers
+}
+
+// solicitedNode returns the solicited-node multicast address of addr.
+func solicitedNode(addr netip.Addr) netip.Addr {
+	a := addr.As16()
+	return netip.AddrFrom16([16]byte{0: 0xff, 1: 0x02, 11: 1, 12: 0xff, 13: a[13], 14: a[14], 15: a[15]})
+}
+
+// multicastHW6 returns the hardware address IPv6 multicast to group is
+// sent to, RFC 2464 section 7.
+func multicastHW6(group netip.Addr) [6]byte {
+	g := group.As16()
+	return [6]byte{0x33, 0x33, g[12], g[13], g[14], g[15]}
+}
@@ -0,0 +1,415 @@
+package cyw43439
+
+import (
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"math/bits"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/soypat/lneto/dhcpv4"
+	"github.com/soypat/lneto/x/xnet"
+)
+
+// lneto's DHCP client stops once bound, so the lease is kept alive here per
+// RFC 2131 section 4.4.5: at T1 the client unicasts a DHCPREQUEST to the
+// server that granted the lease (RENEWING), at T2 it broadcasts it to any
+// server (REBINDING). A NAK or an expired lease drops the address and
+// restarts discovery. An ACK that moves us to another address or router
+// resolves the router's hardware address again.
+
+const (
+	// minLeaseRetry is the shortest wait between RENEW/REBIND retransmissions.
+	// RFC 2131 recommends 60s.
+	minLeaseRetry = time.Minute
+	// maxHostnameOpt is the longest hostname sent in renewals.
+	maxHostnameOpt = 32
+	// dhcpMsgSize fits a DHCPREQUEST with our options and the longest
+	// client identifier and hostname lneto accepts.
+	dhcpMsgSize = dhcpv4.OptionsOffset + 3 + 2*(2+maxHostnameOpt) + 9 + 1
+	// maxDHCPNTP bounds the NTP servers kept from option 42.
+	maxDHCPNTP = 4
+)
+
+// leasePhase is the DHCP client state while bound.
+type leasePhase uint8
+
+const (
+	leaseNone leasePhase = iota // No DHCP lease, e.g. static address.
+	leaseBound
+	leaseRenewing
+	leaseRebinding
+	leaseInit      // Address lost and discovery failed; retrying.
+	leaseLinkLocal // On a link-local address; retrying DHCP.
+)
+
+func (p leasePhase) String() string {
+	switch p {
+	case leaseBound:
+		return "bound"
+	case leaseRenewing:
+		return "renewing"
+	case leaseRebinding:
+		return "rebinding"
+	case leaseInit:
+		return "init"
+	case leaseLinkLocal:
+		return "link-local"
+	default:
+		return "none"
+	}
+}
+
+// dhcpLease tracks the lease obtained by the last successful DHCP exchange.
+type dhcpLease struct {
+	mu       sync.Mutex
+	phase    leasePhase
+	addr     netip.Addr
+	server   netip.Addr
+	router   netip.Addr
+	acquired time.Time // Time the granting request was sent.
+	t1, t2   time.Duration
+	lease    time.Duration
+
+	// Pending RENEW/REBIND transaction.
+	xid    uint32
+	sentAt time.Time
+	nextTx time.Time
+	// Reply to the pending transaction, set by the port 68 handler and
+	// consumed by maintainLease. replyRouter and replySubnet are invalid
+	// if the ACK didn't carry them.
+	reply       dhcpv4.MessageType
+	replyAddr   netip.Addr
+	replyRouter netip.Addr
+	replySubnet netip.Prefix
+	replyT1     uint32
+	replyT2     uint32
+	replyTL     uint32
+	txbuf       [dhcpMsgSize]byte
+
+	// NTP servers (option 42) of the last ACK, from lneto's discovery or
+	// a renewal. lneto parses the option but doesn't report it.
+	ntp  [maxDHCPNTP]netip.Addr
+	nntp int
+}
+
+// startLease records the lease granted by a completed DHCP exchange.
+// requestedAt is when the exchange began.
+func (s *Stack) startLease(res *xnet.DHCPResults, requestedAt time.Time) {
+	l := &s.lease
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.xid = 0
+	l.reply = 0
+	if res.TLease == 0 || res.TLease == 0xffffffff {
+		// No lease time or infinite lease: nothing to maintain.
+		l.phase = leaseNone
+		return
+	}
+	l.phase = leaseBound
+	l.addr = res.AssignedAddr
+	l.server = res.ServerAddr
+	l.router = res.Router
+	l.acquired = requestedAt
+	l.setTimes(res.TRenewal, res.TRebind, res.TLease)
+}
+
+// stopLease forgets the current lease, e.g. when a static address is used.
+func (s *Stack) stopLease() {
+	l := &s.lease
+	l.mu.Lock()
+	l.phase = leaseNone
+	l.xid = 0
+	l.nntp = 0
+	l.mu.Unlock()
+}
+
+// setTimes sets the lease timers, defaulting T1 and T2 to 0.5 and 0.875
+// of the lease time as RFC 2131 recommends.
+func (l *dhcpLease) setTimes(t1, t2, lease uint32) {
+	l.lease = time.Duration(lease) * time.Second
+	if t1 == 0 || t1 >= lease {
+		l.t1 = l.lease / 2
+	} else {
+		l.t1 = time.Duration(t1) * time.Second
+	}
+	if t2 == 0 || t2 >= lease || time.Duration(t2)*time.Second < l.t1 {
+		l.t2 = l.lease * 7 / 8
+	} else {
+		l.t2 = time.Duration(t2) * time.Second
+	}
+}
+
+// LeaseExpiry returns when the current DHCP lease expires. ok is false when
+// the address was not obtained via DHCP or the lease is infinite.
+func (s *Stack) LeaseExpiry() (expiry time.Time, ok bool) {
+	l := &s.lease
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.phase == leaseNone || l.phase >= leaseInit {
+		return time.Time{}, false
+	}
+	return l.acquired.Add(l.lease), true
+}
+
+// maintainLease advances the lease state machine and should be called
+// periodically, at least every few seconds. It returns true if the stack's
+// address changed, in which case established connections must be redone.
+func (s *Stack) maintainLease() (addrChanged bool, err error) {
+	l := &s.lease
+	l.mu.Lock()
+	now := time.Now()
+	switch {
+	case l.phase == leaseNone:
+		l.mu.Unlock()
+		return false, nil
+	case l.phase == leaseInit:
+		retry := !now.Before(l.nextTx)
+		l.mu.Unlock()
+		if !retry {
+			return false, nil
+		}
+		return s.rediscover()
+	case l.phase == leaseLinkLocal:
+		l.mu.Unlock()
+		return s.maintainLinkLocal()
+	}
+
+	switch l.reply {
+	case dhcpv4.MsgAck:
+		oldAddr, oldRouter := l.addr, l.router
+		l.acquired = l.sentAt
+		l.setTimes(l.replyT1, l.replyT2, l.replyTL)
+		l.addr = l.replyAddr
+		if l.replyRouter.IsValid() {
+			l.router = l.replyRouter
+		}
+		l.phase = leaseBound
+		l.xid = 0
+		l.reply = 0
+		addr, router, subnet, expiry := l.addr, l.router, l.replySubnet, l.acquired.Add(l.lease)
+		l.mu.Unlock()
+		s.log.Info("dhcp:renewed", slog.String("ip", addr.String()), slog.Time("expiry", expiry))
+		if addr == oldAddr && router == oldRouter {
+			return false, nil
+		}
+		if addr != oldAddr {
+			s.s.SetIPAddr(addr)
+			if subnet.IsValid() {
+				s.subnet = subnet
+				s.s.SetSubnet(subnet)
+			}
+		}
+		s.flushHWCache()
+		// The gateway's hardware address is that of the old router, or
+		// may be off-link from the new address.
+		const pollTime = 50 * time.Millisecond
+		gatewayHW, err := s.resolveHardwareAddr(router, pollTime, 4)
+		if err != nil {
+			s.log.Error("dhcp:resolve-gateway", slog.String("router", router.String()), slog.String("err", err.Error()))
+			return s.rediscover()
+		}
+		s.s.SetGateway6(gatewayHW)
+		s.log.Info("dhcp:gateway", slog.String("router", router.String()))
+		return addr != oldAddr, nil
+
+	case dhcpv4.MsgNack:
+		s.counters.dhcpFailures.Add(1)
+		l.phase = leaseNone
+		l.xid = 0
+		l.reply = 0
+		l.mu.Unlock()
+		s.log.Error("dhcp:nak", slog.String("ip", s.Addr().String()))
+		return s.rediscover()
+	}
+
+	elapsed := now.Sub(l.acquired)
+	var phase leasePhase
+	switch {
+	case elapsed >= l.lease:
+		s.counters.dhcpFailures.Add(1)
+		l.phase = leaseNone
+		l.xid = 0
+		l.mu.Unlock()
+		s.log.Error("dhcp:lease-expired", slog.String("ip", s.Addr().String()))
+		return s.rediscover()
+	case elapsed >= l.t2:
+		phase = leaseRebinding
+	case elapsed >= l.t1:
+		phase = leaseRenewing
+	default:
+		l.mu.Unlock()
+		return false, nil
+	}
+	if phase == l.phase && now.Before(l.nextTx) {
+		l.mu.Unlock()
+		return false, nil
+	}
+
+	// (Re)transmit, waiting half the time remaining until the next phase.
+	next := l.t2
+	if phase == leaseRebinding {
+		next = l.lease
+	}
+	l.phase = phase
+	l.nextTx = now.Add(max((next-elapsed)/2, minLeaseRetry))
+	if l.xid == 0 {
+		l.xid = s.Prand32() | 1
+	}
+	l.sentAt = now
+	s.counters.dhcpAttempts.Add(1)
+	msg := s.leaseRequest(l)
+	addr, server, xid := l.addr, l.server, l.xid
+	l.mu.Unlock()
+
+	s.log.Info("dhcp:"+phase.String(), slog.String("ip", addr.String()), slog.String("server", server.String()))
+	// Renewal is unicast to the granting server, rebinding is broadcast.
+	dst := netip.AddrFrom4([4]byte{255, 255, 255, 255})
+	if phase == leaseRenewing && server.IsValid() {
+		dst = server
+	}
+	err = s.SendUDP(dhcpv4.DefaultClientPort, netip.AddrPortFrom(dst, dhcpv4.DefaultServerPort), msg)
+	if err != nil {
+		return false, errors.New("dhcp " + phase.String() + " xid " + strconv.FormatUint(uint64(xid), 16) + ": " + err.Error())
+	}
+	return false, nil
+}
+
+// leaseRequest builds a RENEWING/REBINDING DHCPREQUEST in l.txbuf. Unlike
+// the initial request it carries our address in ciaddr and omits the
+// requested address and server identifier options. l.mu must be held.
+func (s *Stack) leaseRequest(l *dhcpLease) []byte {
+	buf := l.txbuf[:]
+	clear(buf)
+	frm, _ := dhcpv4.NewFrame(buf)
+	frm.SetOp(dhcpv4.OpRequest)
+	frm.SetHardware(1, 6, 0)
+	frm.SetXID(l.xid)
+	frm.SetSecs(uint16(min(time.Since(l.acquired)/time.Second, 0xffff)))
+	*frm.CIAddr() = l.addr.As4()
+	*frm.CHAddrAs6() = s.s.HardwareAddress()
+	frm.SetMagicCookie(dhcpv4.MagicCookie)
+
+	opts := frm.OptionsPayload()
+	n, _ := dhcpv4.EncodeOption(opts, dhcpv4.OptMessageType, byte(dhcpv4.MsgRequest))
+	// Same client identifier lneto uses so the server finds our binding.
+	hostname := s.s.Hostname()
+	nn, _ := dhcpv4.EncodeOptionString(opts[n:], dhcpv4.OptClientIdentifier, "lneto-"+hostname)
+	n += nn
+	if len(hostname) <= maxHostnameOpt {
+		nn, _ = dhcpv4.EncodeOptionString(opts[n:], dhcpv4.OptHostName, hostname)
+		n += nn
+	}
+	nn, _ = dhcpv4.EncodeOption(opts[n:], dhcpv4.OptParameterRequestList,
+		byte(dhcpv4.OptSubnetMask), byte(dhcpv4.OptRouter), byte(dhcpv4.OptDNSServers),
+		byte(dhcpv4.OptIPAddressLeaseTime), byte(dhcpv4.OptRenewTimeValue), byte(dhcpv4.OptRebindingTimeValue),
+		byte(dhcpv4.OptNTPServersAddresses))
+	n += nn
+	opts[n] = byte(dhcpv4.OptEnd)
+	n++
+	return buf[:dhcpv4.OptionsOffset+n]
+}
+
+// handleLeaseReply is the UDP handler for the DHCP client port. It consumes
+// replies to a pending RENEW/REBIND and passes everything else on to lneto,
+// which runs the initial discovery. The NTP servers of every ACK to us are
+// kept.
+func (s *Stack) handleLeaseReply(pkt *UDPPacket) bool {
+	frm, err := dhcpv4.NewFrame(pkt.Payload)
+	if err != nil || frm.Op() != dhcpv4.OpReply || frm.MagicCookie() != dhcpv4.MagicCookie {
+		return false
+	}
+	var msgType dhcpv4.MessageType
+	var t1, t2, tl uint32
+	var router netip.Addr
+	maskBits := -1
+	var ntp [maxDHCPNTP]netip.Addr
+	var nntp int
+	frm.ForEachOption(func(_ int, opt dhcpv4.OptNum, data []byte) error {
+		switch {
+		case opt == dhcpv4.OptMessageType && len(data) == 1:
+			msgType = dhcpv4.MessageType(data[0])
+		case opt == dhcpv4.OptRenewTimeValue && len(data) == 4:
+			t1 = binary.BigEndian.Uint32(data)
+		case opt == dhcpv4.OptRebindingTimeValue && len(data) == 4:
+			t2 = binary.BigEndian.Uint32(data)
+		case opt == dhcpv4.OptIPAddressLeaseTime && len(data) == 4:
+			tl = binary.BigEndian.Uint32(data)
+		case opt == dhcpv4.OptRouter && len(data) >= 4:
+			router = netip.AddrFrom4([4]byte(data[:4]))
+		case opt == dhcpv4.OptSubnetMask && len(data) == 4:
+			maskBits = prefixLen(binary.BigEndian.Uint32(data))
+		case opt == dhcpv4.OptNTPServersAddresses && len(data)%4 == 0:
+			for i := 0; i < len(data) && nntp < len(ntp); i += 4 {
+				ntp[nntp] = netip.AddrFrom4([4]byte(data[i : i+4]))
+				nntp++
+			}
+		}
+		return nil
+	})
+	l := &s.lease
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if msgType == dhcpv4.MsgAck && *frm.CHAddrAs6() == s.s.HardwareAddress() {
+		l.ntp, l.nntp = ntp, nntp
+	}
+	if l.xid == 0 || frm.XID() != l.xid || l.reply != 0 {
+		return false
+	}
+	switch msgType {
+	case dhcpv4.MsgAck:
+		if tl == 0 {
+			return true // Malformed ACK, keep waiting.
+		}
+		l.reply = msgType
+		l.replyAddr = netip.AddrFrom4(*frm.YIAddr())
+		l.replyRouter = router
+		l.replySubnet = netip.Prefix{}
+		if maskBits >= 0 {
+			l.replySubnet, _ = l.replyAddr.Prefix(maskBits)
+		}
+		l.replyT1, l.replyT2, l.replyTL = t1, t2, tl
+		if l.phase == leaseRebinding {
+			// Any server may answer a rebind; it now holds our lease.
+			l.server = pkt.Src.Addr()
+		}
+	case dhcpv4.MsgNack:
+		l.reply = msgType
+	}
+	return true
+}
+
+// rediscover drops the current address and runs DHCP discovery again.
+// On failure discovery is retried by later maintainLease calls.
+func (s *Stack) rediscover() (addrChanged bool, err error) {
+	const retryDiscover = 10 * time.Second
+	unspecified := netip.AddrFrom4([4]byte{})
+	old := s.Addr()
+	s.s.SetIPAddr(unspecified)
+	s.flushHWCache()
+	cfg := s.dhcpCfg
+	cfg.RequestedAddr = netip.Addr{} // Don't fall back to a static address.
+	_, err = s.setupWithDHCP(cfg, netip.Addr{})
+	if err != nil {
+		l := &s.lease
+		l.mu.Lock()
+		l.phase = leaseInit
+		l.nextTx = time.Now().Add(retryDiscover)
+		l.mu.Unlock()
+		return old != unspecified, err
+	}
+	return s.Addr() != old, nil
+}
+
+// prefixLen returns the length of the IPv4 prefix of a subnet mask, or -1
+// if the mask is not contiguous.
+func prefixLen(mask uint32) int {
+	ones := bits.LeadingZeros32(^mask)
+	if mask<<ones != 0 {
+		return -1
+	}
+	return ones
+}
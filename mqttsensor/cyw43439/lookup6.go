@@ -0,0 +1,198 @@
+package cyw43439
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lneto's DNS client only asks for A records, so AAAA lookups are done
+// here over the UDP side channel.
+
+const (
+	dnsHeaderLen = 12
+	dnsTypeAAAA  = 28
+	dnsClassIN   = 1
+	// maxAAAA bounds the addresses a lookup returns.
+	maxAAAA = 4
+)
+
+var (
+	errNoDNSServer = errors.New("no dns server")
+	errDNSTimeout  = errors.New("dns: no answer")
+)
+
+// aaaaLookup collects the answer to a query. The handler fills it on the
+// packet processing goroutine while LookupIP6 waits.
+type aaaaLookup struct {
+	id    uint16
+	mu    sync.Mutex
+	addrs []netip.Addr
+	err   error
+	done  chan struct{}
+}
+
+// LookupIP6 resolves the IPv6 addresses of host with AAAA queries, trying
+// up to retries times with the given timeout each. Queries go to the DNS
+// servers from router advertisements if IPv6 is set up, and to the IPv4
+// servers from DHCP or the static configuration otherwise.
+func (s *Stack) LookupIP6(host string, timeout time.Duration, retries int) ([]netip.Addr, error) {
+	s.counters.dnsLookups.Add(1)
+	addrs, err := s.lookupIP6(host, timeout, retries)
+	if err != nil {
+		s.counters.dnsFailures.Add(1)
+		return nil, errors.New("lookup " + host + ": " + err.Error())
+	}
+	return addrs, nil
+}
+
+func (s *Stack) lookupIP6(host string, timeout time.Duration, retries int) ([]netip.Addr, error) {
+	servers := s.dnsServers6()
+	if len(servers) == 0 {
+		servers = s.dnsServers
+	}
+	if len(servers) == 0 {
+		return nil, errNoDNSServer
+	}
+	l := &aaaaLookup{
+		id:   uint16(s.Prand32()),
+		done: make(chan struct{}, 1),
+	}
+	query, err := appendAAAAQuery(make([]byte, 0, dnsHeaderLen+256+4), l.id, host)
+	if err != nil {
+		return nil, err
+	}
+	port := uint16(49152 + s.Prand32()%16384)
+	err = s.HandleUDP(port, l.handle)
+	if err != nil {
+		return nil, err
+	}
+	defer s.HandleUDP(port, nil)
+
+	err = errDNSTimeout
+	for i := 0; i < max(retries, 1); i++ {
+		server := servers[i%len(servers)]
+		err = s.SendUDP(port, netip.AddrPortFrom(server, dnsPort), query)
+		if err != nil {
+			continue
+		}
+		select {
+		case <-l.done:
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			return l.addrs, l.err
+		case <-time.After(timeout):
+			err = errDNSTimeout
+		}
+	}
+	return nil, err
+}
+
+func (l *aaaaLookup) handle(pkt *UDPPacket) bool {
+	m := pkt.Payload
+	if pkt.Src.Port() != dnsPort || len(m) < dnsHeaderLen || binary.BigEndian.Uint16(m) != l.id || m[2]&0x80 == 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil || l.addrs != nil {
+		return true // Already answered.
+	}
+	switch rcode := m[3] & 0x0f; rcode {
+	case 0:
+	case 3:
+		l.err = errors.New("no such host")
+	default:
+		l.err = errors.New("dns: server error " + strconv.Itoa(int(rcode)))
+	}
+	if l.err == nil {
+		l.addrs, l.err = parseAAAAAnswers(m)
+	}
+	select {
+	case l.done <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// parseAAAAAnswers returns the addresses of the AAAA records in the answer
+// section of the DNS message m. CNAME records are skipped over, since
+// recursive servers include the records they lead to.
+func parseAAAAAnswers(m []byte) ([]netip.Addr, error) {
+	errMalformed := errors.New("dns: malformed reply")
+	qd := int(binary.BigEndian.Uint16(m[4:]))
+	an := int(binary.BigEndian.Uint16(m[6:]))
+	off := dnsHeaderLen
+	var ok bool
+	for i := 0; i < qd; i++ {
+		off, ok = skipDNSName(m, off)
+		if !ok || off+4 > len(m) {
+			return nil, errMalformed
+		}
+		off += 4
+	}
+	addrs := make([]netip.Addr, 0, maxAAAA)
+	for i := 0; i < an && len(addrs) < maxAAAA; i++ {
+		off, ok = skipDNSName(m, off)
+		if !ok || off+10 > len(m) {
+			return nil, errMalformed
+		}
+		typ := binary.BigEndian.Uint16(m[off:])
+		class := binary.BigEndian.Uint16(m[off+2:])
+		rdlen := int(binary.BigEndian.Uint16(m[off+8:]))
+		off += 10
+		if off+rdlen > len(m) {
+			return nil, errMalformed
+		}
+		if typ == dnsTypeAAAA && class == dnsClassIN && rdlen == 16 {
+			addrs = append(addrs, netip.AddrFrom16([16]byte(m[off:off+16])))
+		}
+		off += rdlen
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no AAAA records")
+	}
+	return addrs, nil
+}
+
+// skipDNSName returns the offset past the possibly compressed name at off.
+func skipDNSName(m []byte, off int) (int, bool) {
+	for off < len(m) {
+		switch n := m[off]; {
+		case n == 0:
+			return off + 1, true
+		case n&0xc0 == 0xc0:
+			return off + 2, off+2 <= len(m)
+		case n&0xc0 != 0:
+			return 0, false
+		default:
+			off += int(n) + 1
+		}
+	}
+	return 0, false
+}
+
+// appendAAAAQuery appends a recursive AAAA query for host to dst.
+func appendAAAAQuery(dst []byte, id uint16, host string) ([]byte, error) {
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || len(host) > 253 {
+		return nil, errors.New("invalid host name " + host)
+	}
+	dst = binary.BigEndian.AppendUint16(dst, id)
+	dst = append(dst, 0x01, 0x00) // Standard query, recursion desired.
+	dst = append(dst, 0, 1, 0, 0, 0, 0, 0, 0)
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 {
+			return nil, errors.New("invalid host name " + host)
+		}
+		dst = append(dst, byte(len(label)))
+		dst = append(dst, label...)
+	}
+	dst = append(dst, 0)
+	dst = binary.BigEndian.AppendUint16(dst, dnsTypeAAAA)
+	return binary.BigEndian.AppendUint16(dst, dnsClassIN), nil
+}
@@ -0,0 +1,133 @@
+package cyw43439
+
+import (
+	"log/slog"
+	"machine"
+	"runtime"
+	"time"
+)
+
+// The CYW43439 signals pending frames on its host-wake interrupt. The Pico
+// W has no separate pin for it: GPIO24 is also the gSPI data line, and only
+// while chip select is high does the chip drive it high to signal a frame.
+// Every SPI transfer toggles the same pin, so like the Pico SDK driver Loop
+// arms a rising edge interrupt only while it waits, and the handler
+// disarms it again, so bus traffic from polling or from other goroutines'
+// ioctls can't cause an interrupt storm.
+const hostWake = machine.GPIO24
+
+const (
+	defaultMinPoll = time.Millisecond
+	defaultMaxPoll = 50 * time.Millisecond
+)
+
+// LoopConfig configures [Stack.Loop].
+type LoopConfig struct {
+	// MinPoll is how soon the device is polled again after traffic.
+	// Defaults to 1ms.
+	MinPoll time.Duration
+	// MaxPoll is the longest the loop waits without a wakeup. The wait
+	// doubles from MinPoll up to it while there is no traffic. Defaults to
+	// 50ms.
+	MaxPoll time.Duration
+	// NoInterrupt disables waking on the chip's interrupt, leaving only
+	// polling and [Stack.Notify]. The interrupt shares GPIO24 with the SPI
+	// data line; see hostWake.
+	NoInterrupt bool
+}
+
+// Loop processes packets until the program ends. This must run in a
+// background goroutine for networking to function.
+//
+// Between polls of the device it sleeps until the chip signals a received
+// frame, [Stack.Notify] is called or the poll interval runs out. The
+// interval is short after traffic and backs off while the link is quiet;
+// it stays short during DHCP, DNS and ARP exchanges, whose requests are
+// queued inside lneto where Notify can't see them.
+func (s *Stack) Loop(cfg LoopConfig) {
+	if cfg.MinPoll <= 0 {
+		cfg.MinPoll = defaultMinPoll
+	}
+	if cfg.MaxPoll < cfg.MinPoll {
+		cfg.MaxPoll = max(defaultMaxPoll, cfg.MinPoll)
+	}
+	useIRQ := !cfg.NoInterrupt
+	if useIRQ {
+		// onHostWake runs in interrupt context, so it must not block or
+		// allocate: it only disarms the pin, bumps an atomic counter and
+		// makes a non-blocking send on the 1-buffered wake channel. A
+		// wakeup already pending is enough to make the loop poll.
+		s.onHostWake = func(machine.Pin) {
+			// Disarm until the loop has polled; see hostWake.
+			hostWake.SetInterrupt(machine.PinRising, nil)
+			s.counters.hostWakeups.Add(1)
+			select {
+			case s.wake <- struct{}{}:
+			default:
+			}
+		}
+	}
+
+	timer := time.NewTimer(cfg.MaxPoll)
+	wait := cfg.MinPoll
+	for {
+		start := time.Now()
+		send, recv, _ := s.RecvAndSend()
+		s.counters.polls.Add(1)
+		s.counters.pollNanos.Add(uint64(time.Since(start)))
+		if send != 0 || recv != 0 {
+			// More may be waiting; let the goroutines that handle this
+			// frame run before polling again.
+			wait = cfg.MinPoll
+			runtime.Gosched()
+			continue
+		}
+		if s.fastPoll.Load() > 0 {
+			wait = cfg.MinPoll
+		}
+
+		if useIRQ && !s.IsRadioOff() {
+			err := hostWake.SetInterrupt(machine.PinRising, s.onHostWake)
+			if err != nil {
+				s.log.Error("loop:interrupt", slog.String("err", err.Error()))
+				useIRQ = false
+			} else if hostWake.Get() {
+				s.onHostWake(hostWake) // Raised before the edge was armed.
+			}
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-s.wake:
+		case <-timer.C:
+		}
+		if useIRQ {
+			hostWake.SetInterrupt(machine.PinRising, nil)
+		}
+		wait = min(2*wait, cfg.MaxPoll)
+	}
+}
+
+// Notify wakes [Stack.Loop] to send queued data without waiting for the
+// next poll, e.g. after writing to a TCP connection. It never blocks.
+func (s *Stack) Notify() {
+	s.counters.notifies.Add(1)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// PollFast keeps [Stack.Loop] polling at its shortest interval until done
+// is called. Use it around exchanges run on the lneto stack directly, such
+// as StackRetrying's DoDialTCP, whose requests Loop can't see.
+func (s *Stack) PollFast() (done func()) {
+	s.fastPoll.Add(1)
+	s.Notify()
+	return func() { s.fastPoll.Add(-1) }
+}
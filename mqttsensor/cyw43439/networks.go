@@ -0,0 +1,88 @@
+package cyw43439
+
+import (
+	"cmp"
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// networks is an optional list of additional WiFi networks set via linker
+// flags. Entries are separated by ';' and each is "ssid:password", with an
+// empty password for open networks; an entry without ':' is an open network
+// too. SSIDs may not contain ':' and passwords may not contain ';'. Earlier
+// entries have higher priority.
+//
+// Ex: -X '.../cyw43439.networks=lab:secret1;warehouse:secret2;office-guest:'
+var networks string
+
+// Network holds the credentials of a WiFi network the device may join.
+type Network struct {
+	SSID     string
+	Password string // Empty for open networks.
+	// Priority orders known networks; higher values are tried first.
+	// Networks of equal priority are tried in list order.
+	Priority int
+}
+
+// Networks returns the WiFi networks configured via linker flags, highest
+// priority first. The ssid/pass pair, if set, comes first, followed by the
+// entries of the networks list.
+func Networks() []Network {
+	var nets []Network
+	if ssid != "" {
+		nets = append(nets, Network{SSID: ssid, Password: pass})
+	}
+	for _, entry := range strings.Split(networks, ";") {
+		if entry == "" {
+			continue
+		}
+		name, password, _ := strings.Cut(entry, ":")
+		if name == "" {
+			continue
+		}
+		nets = append(nets, Network{SSID: name, Password: password})
+	}
+	for i := range nets {
+		nets[i].Priority = len(nets) - i
+	}
+	return nets
+}
+
+// rankNetworks returns known networks in the order they should be tried:
+// highest priority first, and in list order among equal priorities.
+func rankNetworks(known []Network) []Network {
+	ranked := slices.Clone(known)
+	slices.SortStableFunc(ranked, func(a, b Network) int {
+		return cmp.Compare(b.Priority, a.Priority)
+	})
+	return ranked
+}
+
+// joinBest attempts to join the known networks in ranked order, falling
+// through the list on failure. It returns the joined network. The driver
+// can't scan, so networks out of range are only skipped once their join
+// times out.
+func joinBest(dev interface {
+	JoinWPA2(ssid, pass string) error
+}, known []Network, logger *slog.Logger) (Network, error) {
+	if len(known) == 0 {
+		return Network{}, errors.New("no WiFi networks configured")
+	}
+	var errs []error
+	for _, nw := range rankNetworks(known) {
+		if len(nw.Password) == 0 {
+			logger.Info("joining open network:", slog.String("ssid", nw.SSID))
+		} else {
+			logger.Info("joining WPA secure network", slog.String("ssid", nw.SSID), slog.Int("passlen", len(nw.Password)))
+		}
+		err := dev.JoinWPA2(nw.SSID, nw.Password)
+		if err == nil {
+			return nw, nil
+		}
+		logger.Error("wifi join failed", slog.String("ssid", nw.SSID), slog.String("err", err.Error()))
+		errs = append(errs, errors.New(nw.SSID+": "+err.Error()))
+	}
+	return Network{}, errors.Join(errs...)
+}
@@ -0,0 +1,111 @@
+package cyw43439
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"slices"
+	"testing"
+)
+
+func TestNetworks(t *testing.T) {
+	tests := []struct {
+		ssid, pass, networks string
+		want                 []Network
+	}{
+		{"", "", "", nil},
+		{"home", "secret", "", []Network{{"home", "secret", 1}}},
+		{"", "", "lab:secret1;warehouse:secret2", []Network{
+			{"lab", "secret1", 2},
+			{"warehouse", "secret2", 1},
+		}},
+		// The ssid/pass pair comes first.
+		{"home", "secret", "lab:secret1", []Network{
+			{"home", "secret", 2},
+			{"lab", "secret1", 1},
+		}},
+		// Empty passwords and entries without ':' are open networks.
+		{"", "", "guest:;cafe", []Network{
+			{"guest", "", 2},
+			{"cafe", "", 1},
+		}},
+		// Empty entries and entries without an SSID are skipped.
+		{"", "", ";lab:secret1;;:orphan;", []Network{{"lab", "secret1", 1}}},
+		{"", "", ";;", nil},
+		// Only the first ':' separates, so passwords may contain it.
+		{"", "", "lab:a:b", []Network{{"lab", "a:b", 1}}},
+	}
+	defer func(s, p, n string) { ssid, pass, networks = s, p, n }(ssid, pass, networks)
+	for _, tt := range tests {
+		ssid, pass, networks = tt.ssid, tt.pass, tt.networks
+		got := Networks()
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("Networks() with ssid %q, pass %q, networks %q = %+v, want %+v",
+				tt.ssid, tt.pass, tt.networks, got, tt.want)
+		}
+	}
+}
+
+func TestRankNetworks(t *testing.T) {
+	tests := []struct {
+		name  string
+		known []Network
+		want  []string
+	}{
+		{"empty", nil, nil},
+		{"by priority", []Network{{"a", "", 1}, {"b", "", 3}, {"c", "", 2}}, []string{"b", "c", "a"}},
+		{"ties in list order", []Network{{"a", "", 1}, {"b", "", 2}, {"c", "", 1}, {"d", "", 2}}, []string{"b", "d", "a", "c"}},
+		{"zero and negative", []Network{{"a", "", -1}, {"b", "", 0}, {"c", "", 0}}, []string{"b", "c", "a"}},
+	}
+	for _, tt := range tests {
+		known := slices.Clone(tt.known)
+		var got []string
+		for _, nw := range rankNetworks(known) {
+			got = append(got, nw.SSID)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: rankNetworks = %q, want %q", tt.name, got, tt.want)
+		}
+		if !slices.Equal(known, tt.known) {
+			t.Errorf("%s: rankNetworks reordered its argument", tt.name)
+		}
+	}
+}
+
+// fakeJoiner joins the networks in up and records every attempt.
+type fakeJoiner struct {
+	up    map[string]bool
+	tried []string
+}
+
+func (j *fakeJoiner) JoinWPA2(ssid, pass string) error {
+	j.tried = append(j.tried, ssid)
+	if !j.up[ssid] {
+		return errors.New("join timeout")
+	}
+	return nil
+}
+
+func TestJoinBestFallsThrough(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	known := []Network{{"lab", "", 1}, {"office", "", 3}, {"warehouse", "", 2}}
+
+	j := &fakeJoiner{up: map[string]bool{"lab": true}}
+	nw, err := joinBest(j, known, logger)
+	if err != nil || nw.SSID != "lab" {
+		t.Errorf("joinBest = %q, %v, want lab, nil", nw.SSID, err)
+	}
+	if want := []string{"office", "warehouse", "lab"}; !slices.Equal(j.tried, want) {
+		t.Errorf("tried %q, want %q", j.tried, want)
+	}
+
+	j = &fakeJoiner{}
+	_, err = joinBest(j, known, logger)
+	if err == nil {
+		t.Error("joinBest with no network up succeeded")
+	}
+	_, err = joinBest(j, nil, logger)
+	if err == nil {
+		t.Error("joinBest with no networks succeeded")
+	}
+}
@@ -0,0 +1,45 @@
+package cyw43439
+
+import (
+	"errors"
+	"machine"
+)
+
+// wlRegOn powers the CYW43439 on the Pico W. NewPicoWDevice configures it
+// as an output; the driver only drives it low while power-cycling the chip,
+// so it is driven here to keep the radio off.
+const wlRegOn = machine.GPIO23
+
+// powerDown turns the radio off. The packet processing loop idles until
+// powerUp.
+func (s *Stack) powerDown() {
+	s.radioMu.Lock()
+	defer s.radioMu.Unlock()
+	s.radioOff = true
+	s.stopLease()
+	wlRegOn.Low()
+}
+
+// powerUp powers the radio on and reloads its firmware. The network must
+// be joined again afterwards.
+func (s *Stack) powerUp() error {
+	// Init power-cycles the chip through WL_REG_ON before loading the
+	// firmware. radioMu keeps the packet loop and multicast filter
+	// updates off the bus until it is done.
+	s.radioMu.Lock()
+	defer s.radioMu.Unlock()
+	err := s.dev.Init(s.wificfg)
+	if err != nil {
+		return errors.New("wifi init failed:" + err.Error())
+	}
+	s.radioOff = false
+	return nil
+}
+
+// IsRadioOff reports whether the radio is powered off by
+// [Supervisor.Suspend].
+func (s *Stack) IsRadioOff() bool {
+	s.radioMu.Lock()
+	defer s.radioMu.Unlock()
+	return s.radioOff
+}
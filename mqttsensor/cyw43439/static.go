@@ -0,0 +1,178 @@
+package cyw43439
+
+import (
+	"errors"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/soypat/lneto/x/xnet"
+)
+
+// Static IPv4 configuration set via linker flags. Leaving staticAddr empty
+// selects DHCP. Server lists are comma separated.
+//
+// Ex: -X '.../cyw43439.staticAddr=192.168.4.20/24' -X '.../cyw43439.staticGateway=192.168.4.1'
+// -X '.../cyw43439.staticDNS=192.168.4.1,1.1.1.1' -X '.../cyw43439.staticNTP=192.168.4.1'
+var (
+	staticAddr    string
+	staticGateway string
+	staticDNS     string
+	staticNTP     string
+)
+
+// StaticConfig is a complete IPv4 configuration used instead of DHCP.
+type StaticConfig struct {
+	// Addr is the address and prefix length of the local network,
+	// e.g. 192.168.1.50/24.
+	Addr netip.Prefix
+	// Gateway is the default router. It must be within Addr's subnet.
+	// If invalid, only on-subnet hosts are reachable.
+	Gateway netip.Addr
+	// DNSServers are used for hostname lookups. Only the first is used by
+	// the lneto stack.
+	DNSServers []netip.Addr
+	// NTPServers are used for time synchronization. See [Stack.NTPServers].
+	NTPServers []netip.Addr
+}
+
+// IsEnabled reports whether the configuration selects static addressing.
+func (sc StaticConfig) IsEnabled() bool {
+	return sc.Addr.IsValid()
+}
+
+// validate checks that the configuration is usable by the IPv4-only stack.
+func (sc StaticConfig) validate() error {
+	addr := sc.Addr.Addr()
+	if !addr.Is4() || addr.IsUnspecified() || addr.IsMulticast() {
+		return errors.New("static address must be a unicast IPv4 address")
+	}
+	if bits := sc.Addr.Bits(); bits < 1 || bits > 30 {
+		return errors.New("static prefix length must be between 1 and 30")
+	}
+	subnet := sc.Addr.Masked()
+	if addr == subnet.Addr() || addr == broadcastAddr(subnet) {
+		return errors.New("static address is the network or broadcast address")
+	}
+	if sc.Gateway.IsValid() && (!sc.Gateway.Is4() || !subnet.Contains(sc.Gateway) || sc.Gateway == addr) {
+		return errors.New("gateway " + sc.Gateway.String() + " not a neighbour within " + subnet.String())
+	}
+	for _, a := range sc.DNSServers {
+		if !a.Is4() {
+			return errors.New("DNS server " + a.String() + " must be IPv4")
+		}
+	}
+	for _, a := range sc.NTPServers {
+		if !a.Is4() {
+			return errors.New("NTP server " + a.String() + " must be IPv4")
+		}
+	}
+	return nil
+}
+
+// StaticIPConfig returns the static configuration set via linker flags.
+// The result is not enabled if no static address was set.
+func StaticIPConfig() (StaticConfig, error) {
+	var sc StaticConfig
+	if staticAddr == "" {
+		return sc, nil
+	}
+	var err error
+	sc.Addr, err = netip.ParsePrefix(staticAddr)
+	if err != nil {
+		return sc, errors.New("static address: " + err.Error())
+	}
+	if staticGateway != "" {
+		sc.Gateway, err = netip.ParseAddr(staticGateway)
+		if err != nil {
+			return sc, errors.New("static gateway: " + err.Error())
+		}
+	}
+	sc.DNSServers, err = parseAddrList(staticDNS)
+	if err != nil {
+		return sc, errors.New("static DNS: " + err.Error())
+	}
+	sc.NTPServers, err = parseAddrList(staticNTP)
+	if err != nil {
+		return sc, errors.New("static NTP: " + err.Error())
+	}
+	return sc, sc.validate()
+}
+
+func parseAddrList(list string) ([]netip.Addr, error) {
+	var addrs []netip.Addr
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		addr, err := netip.ParseAddr(field)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// setupStatic applies a static configuration and resolves the gateway. The
+// results are reported in the same form as a DHCP exchange.
+func (s *Stack) setupStatic(sc StaticConfig) (*xnet.DHCPResults, error) {
+	err := sc.validate()
+	if err != nil {
+		return nil, err
+	}
+	s.stopLease()
+	s.resetLinkLocal()
+	subnet := sc.Addr.Masked()
+	results := &xnet.DHCPResults{
+		AssignedAddr:  sc.Addr.Addr(),
+		Subnet:        subnet,
+		Router:        sc.Gateway,
+		BroadcastAddr: broadcastAddr(subnet),
+		DNSServers:    sc.DNSServers,
+	}
+	err = s.s.AssimilateDHCPResults(results)
+	if err != nil {
+		return nil, errors.New("apply static config:" + err.Error())
+	}
+	s.subnet = subnet
+	s.lease.mu.Lock()
+	s.ntpServers = append(s.ntpServers[:0], sc.NTPServers...)
+	s.lease.mu.Unlock()
+	s.dnsServers = append(s.dnsServers[:0], sc.DNSServers...)
+	s.flushHWCache()
+
+	if sc.Gateway.IsValid() {
+		const pollTime = 50 * time.Millisecond
+		gatewayHW, err := s.resolveHardwareAddr(sc.Gateway, pollTime, 4)
+		if err != nil {
+			return nil, errors.New("resolve gateway:" + err.Error())
+		}
+		s.s.SetGateway6(gatewayHW)
+	}
+
+	s.log.Info("static IP configured",
+		slog.String("ourIP", sc.Addr.String()),
+		slog.String("gateway", sc.Gateway.String()),
+		slog.Int("dns", len(sc.DNSServers)),
+		slog.Int("ntp", len(sc.NTPServers)),
+	)
+	return results, nil
+}
+
+// NTPServers returns the NTP servers of the static configuration or, with
+// DHCP, those the server advertised in option 42. It is empty when there
+// are none, in which case callers pick their own. It is safe to call from
+// other goroutines.
+func (s *Stack) NTPServers() []netip.Addr {
+	l := &s.lease
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(s.ntpServers) > 0 {
+		return slices.Clone(s.ntpServers)
+	}
+	return slices.Clone(l.ntp[:l.nntp])
+}
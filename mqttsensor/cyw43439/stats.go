@@ -0,0 +1,120 @@
+package cyw43439
+
+import (
+	"net/netip"
+	"sync/atomic"
+	"time"
+)
+
+// Stats counts a [Stack]'s traffic and the outcome of its network
+// operations since it was created or the counters were last reset.
+type Stats struct {
+	FramesIn  uint64
+	BytesIn   uint64
+	FramesOut uint64
+	BytesOut  uint64
+
+	// PollErrors counts failed reads from the device.
+	PollErrors uint64
+	// EncapsulateErrors counts failures of the lneto stack to build an
+	// outgoing frame.
+	EncapsulateErrors uint64
+	// SendErrors counts frames the device failed to send. They are not
+	// included in FramesOut.
+	SendErrors uint64
+
+	// DHCPAttempts counts discoveries and lease renewal requests.
+	// DHCPFailures counts discoveries that timed out and leases that were
+	// refused or expired.
+	DHCPAttempts uint64
+	DHCPFailures uint64
+	// DNSLookups counts [Stack.LookupIP] calls, and DNSFailures those that
+	// returned an error.
+	DNSLookups  uint64
+	DNSFailures uint64
+	// ARPResolves counts hardware address resolutions that went out to the
+	// network, and ARPFailures those that got no reply.
+	ARPResolves uint64
+	ARPFailures uint64
+
+	// Polls counts the times [Stack.Loop] polled the device, and PollTime
+	// the time spent doing so; the rest of the time the loop sleeps.
+	Polls    uint64
+	PollTime time.Duration
+	// HostWakeups counts wakeups of the loop by the chip's interrupt, and
+	// Notifies calls to [Stack.Notify], including the stack's own.
+	HostWakeups uint64
+	Notifies    uint64
+}
+
+// stackCounters are updated from the packet processing goroutine and read
+// from others, so they are atomic rather than guarded by a lock.
+type stackCounters struct {
+	framesIn, bytesIn   atomic.Uint64
+	framesOut, bytesOut atomic.Uint64
+	pollErrors          atomic.Uint64
+	encapsulateErrors   atomic.Uint64
+	sendErrors          atomic.Uint64
+	dhcpAttempts        atomic.Uint64
+	dhcpFailures        atomic.Uint64
+	dnsLookups          atomic.Uint64
+	dnsFailures         atomic.Uint64
+	arpResolves         atomic.Uint64
+	arpFailures         atomic.Uint64
+	polls               atomic.Uint64
+	pollNanos           atomic.Uint64
+	hostWakeups         atomic.Uint64
+	notifies            atomic.Uint64
+}
+
+// Stats returns a snapshot of the stack's counters. The counters are read
+// one at a time, so a snapshot taken while traffic flows may be off by a
+// frame between related counters.
+func (s *Stack) Stats() Stats {
+	c := &s.counters
+	return Stats{
+		FramesIn:          c.framesIn.Load(),
+		BytesIn:           c.bytesIn.Load(),
+		FramesOut:         c.framesOut.Load(),
+		BytesOut:          c.bytesOut.Load(),
+		PollErrors:        c.pollErrors.Load(),
+		EncapsulateErrors: c.encapsulateErrors.Load(),
+		SendErrors:        c.sendErrors.Load(),
+		DHCPAttempts:      c.dhcpAttempts.Load(),
+		DHCPFailures:      c.dhcpFailures.Load(),
+		DNSLookups:        c.dnsLookups.Load(),
+		DNSFailures:       c.dnsFailures.Load(),
+		ARPResolves:       c.arpResolves.Load(),
+		ARPFailures:       c.arpFailures.Load(),
+		Polls:             c.polls.Load(),
+		PollTime:          time.Duration(c.pollNanos.Load()),
+		HostWakeups:       c.hostWakeups.Load(),
+		Notifies:          c.notifies.Load(),
+	}
+}
+
+// ResetStats sets all counters to zero.
+func (s *Stack) ResetStats() {
+	c := &s.counters
+	for _, v := range [...]*atomic.Uint64{
+		&c.framesIn, &c.bytesIn, &c.framesOut, &c.bytesOut,
+		&c.pollErrors, &c.encapsulateErrors, &c.sendErrors,
+		&c.dhcpAttempts, &c.dhcpFailures,
+		&c.dnsLookups, &c.dnsFailures,
+		&c.arpResolves, &c.arpFailures,
+		&c.polls, &c.pollNanos, &c.hostWakeups, &c.notifies,
+	} {
+		v.Store(0)
+	}
+}
+
+// resolveHardwareAddr resolves addr via ARP, polling every pollTime.
+func (s *Stack) resolveHardwareAddr(addr netip.Addr, pollTime time.Duration, retries int) ([6]byte, error) {
+	defer s.PollFast()()
+	s.counters.arpResolves.Add(1)
+	hw, err := s.s.StackRetrying(pollEvery(pollTime)).DoResolveHardwareAddress6(addr, 500*time.Millisecond, retries)
+	if err != nil {
+		s.counters.arpFailures.Add(1)
+	}
+	return hw, err
+}
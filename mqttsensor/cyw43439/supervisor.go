@@ -0,0 +1,282 @@
+package cyw43439
+
+import (
+	"log/slog"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LinkState is the state of the WiFi link as seen by a [Supervisor].
+type LinkState uint8
+
+const (
+	// LinkDown means association with the access point was lost.
+	LinkDown LinkState = iota
+	// LinkUp means the network is joined and IP configuration is complete.
+	LinkUp
+	// LinkAddrChanged means the link stayed up but the DHCP lease moved
+	// the stack to a different address, or the address was lost and is
+	// being rediscovered. Connections bound to the old address are dead.
+	LinkAddrChanged
+)
+
+func (ls LinkState) String() string {
+	switch ls {
+	case LinkUp:
+		return "up"
+	case LinkAddrChanged:
+		return "addr-changed"
+	default:
+		return "down"
+	}
+}
+
+// LinkEvent is a link transition published to [Supervisor] subscribers.
+type LinkEvent struct {
+	State LinkState
+	// Addr is the stack's IP address after the transition.
+	// It is invalid for LinkDown events and unspecified for LinkAddrChanged
+	// events while a new address is being obtained.
+	Addr netip.Addr
+}
+
+// SupervisorConfig configures a [Supervisor].
+type SupervisorConfig struct {
+	// CheckInterval is how often the link state is checked. Defaults to 1s.
+	CheckInterval time.Duration
+	// MinBackoff is the delay after the first failed rejoin. Defaults to 1s.
+	MinBackoff time.Duration
+	// MaxBackoff caps the delay between rejoin attempts. Defaults to 1m.
+	MaxBackoff time.Duration
+}
+
+// Supervisor watches the WiFi association of a [Stack] and restores
+// connectivity after the link is lost. On link loss it rejoins the best of
+// the stack's known networks with exponential backoff, then re-runs DHCP and gateway ARP resolution
+// using the configuration of the last [Stack.SetupWithDHCP] call.
+//
+// The address held before the link was lost is asked of the DHCP server
+// again, but only assigned if the server grants it. If DHCP fails the
+// rejoin is retried, or a link-local address taken if so configured.
+//
+// While the link is up the supervisor also maintains the DHCP lease,
+// renewing it at T1 and rebinding at T2, and publishes LinkAddrChanged if
+// the address changes as a result.
+//
+// Link transitions are published to subscribers without blocking;
+// subscribers with full channels miss the event.
+//
+// For duty-cycled operation the radio can be turned off with Suspend and
+// back on with Resume; the link is not watched in between.
+type Supervisor struct {
+	stack *Stack
+	cfg   SupervisorConfig
+	subs  []chan<- LinkEvent
+	up    atomic.Bool
+
+	// mu is held by Run while it checks the link or makes an attempt to
+	// restore it, but not while it backs off, and by Suspend and Resume.
+	mu        sync.Mutex
+	suspended bool
+}
+
+// NewSupervisor returns a Supervisor for stack. The link is assumed to be up,
+// as it is after [NewConfiguredPicoWithStack] and [Stack.SetupWithDHCP].
+func NewSupervisor(stack *Stack, cfg SupervisorConfig) *Supervisor {
+	if cfg.CheckInterval <= 0 {
+		cfg.CheckInterval = time.Second
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = time.Second
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = max(time.Minute, cfg.MinBackoff)
+	}
+	sv := &Supervisor{
+		stack: stack,
+		cfg:   cfg,
+	}
+	sv.up.Store(true)
+	return sv
+}
+
+// Subscribe registers ch to receive link transitions.
+// It must be called before Run.
+func (sv *Supervisor) Subscribe(ch chan<- LinkEvent) {
+	sv.subs = append(sv.subs, ch)
+}
+
+// IsUp reports whether the supervisor considers the link usable. It is
+// safe to call from other goroutines.
+func (sv *Supervisor) IsUp() bool {
+	return sv.up.Load()
+}
+
+// Run monitors the link forever. It should be called in a separate goroutine
+// alongside the packet processing loop, which is what delivers the link
+// change events from the device.
+func (sv *Supervisor) Run() {
+	for {
+		time.Sleep(sv.cfg.CheckInterval)
+		sv.check()
+	}
+}
+
+// check maintains the lease while the link is up and restores it once lost.
+func (sv *Supervisor) check() {
+	sv.mu.Lock()
+	if sv.suspended {
+		sv.mu.Unlock()
+		return
+	}
+	if sv.stack.IsLinkUp() {
+		sv.maintainLease()
+		sv.mu.Unlock()
+		return
+	}
+	sv.stack.log.Error("supervisor:link-down", slog.String("ssid", sv.stack.network.SSID))
+	sv.up.Store(false)
+	sv.publish(LinkEvent{State: LinkDown})
+	sv.mu.Unlock()
+
+	sv.restore()
+}
+
+// Suspend powers the radio off and publishes LinkDown. If the link is being
+// restored, Suspend waits for the attempt in progress and restoring stops;
+// Resume brings the link back.
+func (sv *Supervisor) Suspend() {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	if sv.suspended {
+		return
+	}
+	sv.suspended = true
+	sv.up.Store(false)
+	sv.stack.powerDown()
+	sv.stack.log.Info("supervisor:suspended")
+	sv.publish(LinkEvent{State: LinkDown})
+}
+
+// Resume powers the radio on, joins the best known network, redoes the IP
+// configuration and publishes LinkUp. Unlike recovery from link loss it
+// makes a single attempt: on failure the radio is powered off again and the
+// error returned, so a duty cycle can retry at its next wakeup rather than
+// drain the battery retrying.
+func (sv *Supervisor) Resume() (netip.Addr, error) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	if !sv.suspended {
+		return sv.stack.Addr(), nil
+	}
+	err := sv.stack.powerUp()
+	if err == nil {
+		err = sv.stack.rejoin()
+	}
+	if err == nil {
+		err = sv.reconfigure()
+	}
+	if err != nil {
+		sv.stack.powerDown()
+		return netip.Addr{}, err
+	}
+	sv.suspended = false
+	sv.up.Store(true)
+	addr := sv.stack.Addr()
+	sv.stack.log.Info("supervisor:resumed", slog.String("ip", addr.String()))
+	sv.publish(LinkEvent{State: LinkUp, Addr: addr})
+	return addr, nil
+}
+
+// maintainLease keeps the DHCP lease alive and publishes address changes.
+func (sv *Supervisor) maintainLease() {
+	log := sv.stack.log
+	changed, err := sv.stack.maintainLease()
+	if err != nil {
+		log.Error("supervisor:dhcp", slog.String("err", err.Error()))
+	}
+	if changed {
+		addr := sv.stack.Addr()
+		log.Info("supervisor:addr-changed", slog.String("ip", addr.String()))
+		sv.publish(LinkEvent{State: LinkAddrChanged, Addr: addr})
+	}
+}
+
+// restore rejoins the network and redoes IP configuration, retrying with
+// backoff until both succeed, then publishes LinkUp. It gives up if the
+// supervisor is suspended meanwhile. mu is only held during attempts, so
+// Suspend need not wait out a backoff.
+func (sv *Supervisor) restore() {
+	log := sv.stack.log
+	backoff := sv.cfg.MinBackoff
+	for attempt := 1; ; attempt++ {
+		sv.mu.Lock()
+		if sv.suspended {
+			sv.mu.Unlock()
+			return
+		}
+		err := sv.stack.rejoin()
+		if err == nil {
+			err = sv.reconfigure()
+		}
+		if err == nil {
+			addr := sv.stack.Addr()
+			sv.up.Store(true)
+			log.Info("supervisor:link-up", slog.String("ip", addr.String()))
+			sv.publish(LinkEvent{State: LinkUp, Addr: addr})
+			sv.mu.Unlock()
+			return
+		}
+		sv.mu.Unlock()
+
+		log.Error("supervisor:rejoin-failed",
+			slog.Int("attempt", attempt),
+			slog.Duration("backoff", backoff),
+			slog.String("err", err.Error()),
+		)
+		time.Sleep(sv.jitter(backoff))
+		backoff = min(2*backoff, sv.cfg.MaxBackoff)
+	}
+}
+
+// reconfigure re-runs DHCP and gateway resolution, asking for the address
+// held before the link was lost. That address is only a hint to the
+// server: after a roam or once the lease lapsed it may belong to another
+// host, so a DHCP failure is returned rather than the address kept.
+func (sv *Supervisor) reconfigure() error {
+	var hint netip.Addr
+	if addr := sv.stack.Addr(); addr.IsValid() && !addr.IsUnspecified() && !addr.IsLinkLocalUnicast() {
+		hint = addr
+	}
+	_, err := sv.stack.setupWithDHCP(sv.stack.dhcpCfg, hint)
+	if err == nil && sv.stack.ipv6Enabled() {
+		// IPv4 is what connections need, so IPv6 problems are only logged.
+		err6 := sv.stack.SetupIPv6(ipv6SetupTimeout)
+		if err6 != nil {
+			sv.stack.log.Error("ipv6:setup", slog.String("err", err6.Error()))
+		}
+	}
+	return err
+}
+
+// jitter spreads d by up to ±25% so devices sharing an AP don't rejoin in lockstep.
+func (sv *Supervisor) jitter(d time.Duration) time.Duration {
+	spread := int64(d / 4)
+	if spread <= 0 {
+		return d
+	}
+	r := int64(sv.stack.Prand32()) % (2 * spread)
+	return d - time.Duration(spread) + time.Duration(r)
+}
+
+func (sv *Supervisor) publish(ev LinkEvent) {
+	for _, ch := range sv.subs {
+		select {
+		case ch <- ev:
+		default:
+			// Subscriber not keeping up - drop event.
+		}
+	}
+}
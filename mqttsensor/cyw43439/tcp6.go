@@ -0,0 +1,233 @@
+package cyw43439
+
+import (
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/soypat/lneto"
+	"github.com/soypat/lneto/ethernet"
+	"github.com/soypat/lneto/ipv6"
+	"github.com/soypat/lneto/tcp"
+)
+
+// lneto's tcp.Conn does not depend on the IP version, but its stack only
+// carries connections over IPv4. Connections dialed with DialTCP6 are
+// carried here instead: segments arriving over IPv6 are passed to the
+// connection, and RecvAndSend frames its outgoing segments in IPv6 once
+// lneto has nothing to send.
+
+const (
+	// maxTCP6Conns is the number of connections DialTCP6 can carry.
+	maxTCP6Conns = 2
+	// ipv6MinMTU is the packet size every IPv6 link carries (RFC 8200
+	// section 5). Segments are kept within it since there is no path MTU
+	// discovery, which also keeps the MSS the connection advertises small
+	// enough for any path.
+	ipv6MinMTU = 1280
+	// tcpCRCOff is the offset of the checksum in the TCP header.
+	tcpCRCOff = 16
+)
+
+var (
+	errTCP6ConnsFull = errors.New("too many tcp connections over ipv6")
+	errDialTimeout   = errors.New("tcp handshake timed out")
+	errDialRefused   = errors.New("tcp connection refused or reset")
+)
+
+// tcp6Conn is a connection dialed over IPv6 with the addresses its
+// segments are framed with.
+type tcp6Conn struct {
+	conn  *tcp.Conn
+	src   netip.Addr
+	dstHW [6]byte
+	// sent is set once the connection sent a segment. A connection is
+	// closed before it sends its SYN too, so only then does that mean it
+	// ended.
+	sent bool
+}
+
+type tcp6State struct {
+	mu    sync.Mutex
+	conns [maxTCP6Conns]tcp6Conn
+	// next is the connection RecvAndSend asks for a segment first, so one
+	// busy connection can't starve the other.
+	next int
+}
+
+// DialTCP6 opens conn to the IPv6 address raddr from localPort, waiting up
+// to timeout for the handshake and trying up to retries times. conn must
+// have been configured. The connection keeps the source address and next
+// hop chosen here until it is dialed again. [Stack.SetupIPv6] must have
+// been called.
+func (s *Stack) DialTCP6(conn *tcp.Conn, localPort uint16, raddr netip.AddrPort, timeout time.Duration, retries int) error {
+	dst := raddr.Addr()
+	if !dst.Is6() || dst.Is4In6() || dst.IsMulticast() {
+		return errors.New("not an IPv6 unicast address: " + dst.String())
+	}
+	s.ip6.mu.Lock()
+	src, err := s.ip6.source6(dst)
+	s.ip6.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	dstHW, err := s.resolveHW6(dst)
+	if err != nil {
+		return err
+	}
+
+	const pollTime = 5 * time.Millisecond
+	defer s.PollFast()()
+	err = errDialTimeout
+	for i := 0; i < max(retries, 1); i++ {
+		conn.Abort()
+		err = conn.OpenActive(localPort, raddr, tcp.Value(s.Prand32()))
+		if err != nil {
+			return err
+		}
+		err = s.tcp6.add(tcp6Conn{conn: conn, src: src, dstHW: dstHW})
+		if err != nil {
+			conn.Abort()
+			return err
+		}
+		s.Notify()
+		err = awaitEstablished(conn, time.Now().Add(timeout), pollTime)
+		if err == nil {
+			return nil
+		}
+	}
+	conn.Abort()
+	return errors.New("dial " + raddr.String() + ": " + err.Error())
+}
+
+// awaitEstablished waits for the handshake of conn, just opened, to
+// complete.
+func awaitEstablished(conn *tcp.Conn, deadline time.Time, pollTime time.Duration) error {
+	synSent := false
+	for {
+		switch state := conn.State(); {
+		case state == tcp.StateEstablished:
+			return nil
+		case !state.IsClosed():
+			synSent = true
+		case synSent:
+			return errDialRefused
+		}
+		if time.Now().After(deadline) {
+			return errDialTimeout
+		}
+		time.Sleep(pollTime)
+	}
+}
+
+// add starts carrying c, replacing an earlier dial of the same connection
+// and any connection that has closed since.
+func (t *tcp6State) add(c tcp6Conn) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	free := -1
+	for i := range t.conns {
+		e := &t.conns[i]
+		if e.conn == c.conn || e.conn == nil || e.sent && e.conn.State().IsClosed() {
+			*e = tcp6Conn{}
+			if free < 0 {
+				free = i
+			}
+		}
+	}
+	if free < 0 {
+		return errTCP6ConnsFull
+	}
+	t.conns[free] = c
+	return nil
+}
+
+// demuxTCP6 passes a segment addressed to one of the stack's addresses to
+// the connection it belongs to. i6 is the IPv6 packet, with a checksum
+// already verified.
+func (s *Stack) demuxTCP6(dst netip.Addr, i6 []byte) {
+	tfrm, err := tcp.NewFrame(i6[ipv6HeaderLen:])
+	if err != nil {
+		return
+	}
+	s.ip6.mu.Lock()
+	local := s.ip6.isLocal6(dst)
+	s.ip6.mu.Unlock()
+	if !local {
+		return
+	}
+	t := &s.tcp6
+	t.mu.Lock()
+	var conn *tcp.Conn
+	for i := range t.conns {
+		c := t.conns[i].conn
+		if c != nil && c.LocalPort() == tfrm.DestinationPort() && c.RemotePort() == tfrm.SourcePort() {
+			conn = c
+			break
+		}
+	}
+	t.mu.Unlock()
+	if conn == nil {
+		return // Nothing listens over IPv6.
+	}
+	err = conn.Demux(i6, ipv6HeaderLen)
+	if err != nil && err != lneto.ErrPacketDrop {
+		s.log.Debug("tcp6:demux", slog.String("err", err.Error()))
+	}
+}
+
+// egressTCP6 writes the next segment of the connections dialed over IPv6
+// to buf as a complete frame and returns its length, or 0 if none has
+// anything to send.
+func (s *Stack) egressTCP6(buf []byte) (int, error) {
+	t := &s.tcp6
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	buf = buf[:min(len(buf), ethHeaderLen+ipv6MinMTU)]
+	for range t.conns {
+		c := &t.conns[t.next]
+		t.next = (t.next + 1) % maxTCP6Conns
+		if c.conn == nil {
+			continue
+		}
+		n, err := frameTCP6(buf, c.conn, s.s.HardwareAddress(), c.dstHW, c.src)
+		if err != nil && !c.conn.State().IsClosed() {
+			return 0, err
+		} else if n > 0 {
+			c.sent = true
+			return n, nil
+		}
+	}
+	return 0, nil
+}
+
+// frameTCP6 writes conn's next segment to buf as a frame from src and
+// returns its length, or 0 if conn has nothing to send.
+func frameTCP6(buf []byte, conn *tcp.Conn, srcHW, dstHW [6]byte, src netip.Addr) (int, error) {
+	efrm, _ := ethernet.NewFrame(buf)
+	*efrm.DestinationHardwareAddr() = dstHW
+	*efrm.SourceHardwareAddr() = srcHW
+	efrm.SetEtherType(ethernet.TypeIPv6)
+	i6, _ := ipv6.NewFrame(buf[ethHeaderLen:])
+	i6.ClearHeader()
+	i6.SetVersionTrafficAndFlow(6, 0, 0)
+	i6.SetNextHeader(lneto.IPProtoTCP)
+	i6.SetHopLimit(64)
+	*i6.SourceAddr() = src.As16()
+
+	// Encapsulate sets the destination address.
+	n, err := conn.Encapsulate(buf, ethHeaderLen, ethHeaderLen+ipv6HeaderLen)
+	if err != nil || n == 0 {
+		return 0, err
+	}
+	i6.SetPayloadLength(uint16(n))
+	seg := buf[ethHeaderLen+ipv6HeaderLen : ethHeaderLen+ipv6HeaderLen+n]
+	binary.BigEndian.PutUint16(seg[tcpCRCOff:], 0)
+	var crc lneto.CRC791
+	i6.CRCWritePseudo(&crc)
+	binary.BigEndian.PutUint16(seg[tcpCRCOff:], crc.PayloadSum16(seg))
+	return ethHeaderLen + ipv6HeaderLen + n, nil
+}
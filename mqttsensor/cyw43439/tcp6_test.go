@@ -0,0 +1,130 @@
+package cyw43439
+
+import (
+	"io"
+	"log/slog"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/soypat/lneto"
+	"github.com/soypat/lneto/ethernet"
+	"github.com/soypat/lneto/ipv6"
+	"github.com/soypat/lneto/tcp"
+)
+
+func TestTCP6(t *testing.T) {
+	local := netip.MustParseAddr("2001:db8::1")
+	peer := netip.MustParseAddr("2001:db8::2")
+	peerHW := [6]byte{0x02, 0, 0, 0, 0, 0x02}
+
+	s := &Stack{log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	s.ip6.enabled = true
+	s.ip6.addrs[1] = addr6{
+		addr:           local,
+		prefix:         netip.MustParsePrefix("2001:db8::/64"),
+		onLink:         true,
+		validUntil:     time.Now().Add(time.Hour),
+		preferredUntil: time.Now().Add(time.Hour),
+	}
+	s.ip6.learnNeighbour(peer, peerHW)
+
+	var conn, pconn tcp.Conn
+	for _, c := range []*tcp.Conn{&conn, &pconn} {
+		err := c.Configure(tcp.ConnConfig{
+			RxBuf:             make([]byte, 2048),
+			TxBuf:             make([]byte, 2048),
+			TxPacketQueueSize: 3,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := pconn.OpenListen(1883, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// pump carries segments between the stack and the peer until done.
+	buf, pbuf := make([]byte, 2048), make([]byte, 2048)
+	pump := func(what string, done func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(2 * time.Second); !done(); time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal(what + ": timed out")
+			}
+			n, err := s.egressTCP6(buf)
+			if err != nil {
+				t.Fatal("egressTCP6: ", err)
+			}
+			if n > 0 {
+				efrm, _ := ethernet.NewFrame(buf[:n])
+				i6, _ := ipv6.NewFrame(buf[ethHeaderLen:n])
+				var crc lneto.CRC791
+				i6.CRCWritePseudo(&crc)
+				switch {
+				case n > ethHeaderLen+ipv6MinMTU:
+					t.Fatalf("%s: sent a %d byte frame, want at most %d", what, n, ethHeaderLen+ipv6MinMTU)
+				case *efrm.DestinationHardwareAddr() != peerHW || efrm.EtherTypeOrSize() != ethernet.TypeIPv6:
+					t.Fatalf("%s: sent to %x type %v", what, *efrm.DestinationHardwareAddr(), efrm.EtherTypeOrSize())
+				case netip.AddrFrom16(*i6.SourceAddr()) != local || netip.AddrFrom16(*i6.DestinationAddr()) != peer:
+					t.Fatalf("%s: sent from %x to %x", what, *i6.SourceAddr(), *i6.DestinationAddr())
+				case crc.PayloadSum16(i6.Payload()) != 0:
+					t.Fatal(what + ": sent a segment with a bad checksum")
+				}
+				pconn.Demux(buf[ethHeaderLen:n], ipv6HeaderLen)
+			}
+			n, err = frameTCP6(pbuf, &pconn, peerHW, [6]byte{}, peer)
+			if err != nil && pconn.State() != tcp.StateListen {
+				t.Fatal("peer: ", err)
+			}
+			if n > 0 && !s.handleIPv6(pbuf[:n]) {
+				t.Fatal(what + ": IPv6 frame not consumed")
+			}
+		}
+	}
+
+	dialed := make(chan error, 1)
+	go func() {
+		dialed <- s.DialTCP6(&conn, 49152, netip.AddrPortFrom(peer, 1883), time.Second, 1)
+	}()
+	err = nil
+	pump("dial", func() bool {
+		select {
+		case err = <-dialed:
+			return true
+		default:
+			return false
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = conn.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pump("send", func() bool { return pconn.BufferedInput() == 5 })
+	_, err = pconn.Write([]byte("world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pump("receive", func() bool { return conn.BufferedInput() == 5 })
+	got := make([]byte, 5)
+	_, err = conn.Read(got)
+	if err != nil || string(got) != "world" {
+		t.Errorf("Read = %q, %v, want %q", got, err, "world")
+	}
+
+	// A segment from another port of the peer isn't the connection's.
+	var stray tcp.Conn
+	stray.Configure(tcp.ConnConfig{RxBuf: make([]byte, 2048), TxBuf: make([]byte, 2048), TxPacketQueueSize: 1})
+	stray.OpenActive(1884, netip.AddrPortFrom(local, 49152), 5000)
+	if n, _ := frameTCP6(pbuf, &stray, peerHW, [6]byte{}, peer); n > 0 {
+		s.handleIPv6(pbuf[:n])
+	}
+	if conn.State() != tcp.StateEstablished || conn.BufferedInput() != 0 {
+		t.Errorf("stray segment reached the connection: state %v, %d bytes buffered", conn.State(), conn.BufferedInput())
+	}
+}
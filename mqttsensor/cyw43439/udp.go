@@ -0,0 +1,388 @@
+package cyw43439
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/soypat/cyw43439/whd"
+	"github.com/soypat/lneto"
+	"github.com/soypat/lneto/ethernet"
+	"github.com/soypat/lneto/ipv4"
+	"github.com/soypat/lneto/udp"
+)
+
+// The lneto StackAsync only exposes its built-in UDP clients (DHCP, DNS and
+// NTP). Other UDP traffic is handled here: incoming datagrams are matched
+// against registered handlers before the frame reaches lneto, and outgoing
+// datagrams are framed by hand and queued for RecvAndSend to transmit.
+
+const (
+	ethHeaderLen  = 14
+	ipv4HeaderLen = 20
+	udpHeaderLen  = 8
+	udpHeadersLen = ethHeaderLen + ipv4HeaderLen + udpHeaderLen
+
+	// udpFrameSize is the size of each transmit queue slot.
+	udpFrameSize = 1024
+	// MaxUDPPayload is the largest datagram payload [Stack.SendUDP] accepts.
+	MaxUDPPayload = udpFrameSize - udpHeadersLen
+	// udpQueueLen is the number of frames that can await transmission.
+	udpQueueLen = 4
+	// maxUDPHandlers is the number of ports that can have handlers.
+	maxUDPHandlers = 8
+	// hwCacheLen is the number of resolved hardware addresses kept for SendUDP.
+	hwCacheLen = 4
+	// maxMulticastGroups is the size of the chip's multicast filter.
+	maxMulticastGroups = whd.MAX_MULTICAST_REGISTERED_ADDRESS
+)
+
+var (
+	errUDPQueueFull     = errors.New("udp transmit queue full")
+	errUDPPayloadSize   = errors.New("udp payload too large")
+	errUDPHandlersFull  = errors.New("too many udp handlers")
+	errUDPPortInUse     = errors.New("udp port already has a handler")
+	errNoGateway        = errors.New("no gateway hardware address")
+	errUnsupportedAddr4 = errors.New("only IPv4 destinations supported")
+	errMulticastFull    = errors.New("multicast filter full")
+)
+
+// UDPPacket is an incoming UDP datagram passed to a [UDPHandler].
+type UDPPacket struct {
+	SrcHW [6]byte // Sender's hardware address, for replying without ARP.
+	Src   netip.AddrPort
+	Dst   netip.AddrPort
+	// Payload is only valid for the duration of the handler call.
+	Payload []byte
+}
+
+// UDPHandler handles datagrams addressed to a local port. It is called from
+// the packet processing goroutine so it must not block; replies should be
+// sent with [Stack.SendUDPTo]. Returning false passes the frame on to the
+// lneto stack.
+type UDPHandler func(pkt *UDPPacket) (handled bool)
+
+type udpHandlerEntry struct {
+	port uint16
+	h    UDPHandler
+}
+
+type hwCacheEntry struct {
+	addr netip.Addr
+	hw   [6]byte
+}
+
+// udpState holds the Stack's UDP side channel.
+type udpState struct {
+	mu       sync.Mutex
+	handlers [maxUDPHandlers]udpHandlerEntry
+	// Transmit ring.
+	queue  *[udpQueueLen][udpFrameSize]byte // Allocated on first send.
+	lens   [udpQueueLen]int
+	head   int
+	queued int
+	ipID   uint16
+
+	hwcache [hwCacheLen]hwCacheEntry
+	hwnext  int
+}
+
+// HandleUDP registers h to receive datagrams sent to the local port.
+// A nil h removes the port's handler.
+func (s *Stack) HandleUDP(port uint16, h UDPHandler) error {
+	u := &s.udp
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	free := -1
+	for i := range u.handlers {
+		e := &u.handlers[i]
+		if e.h != nil && e.port == port {
+			if h != nil {
+				return errUDPPortInUse
+			}
+			*e = udpHandlerEntry{}
+			return nil
+		} else if e.h == nil && free < 0 {
+			free = i
+		}
+	}
+	if h == nil {
+		return nil
+	} else if free < 0 {
+		return errUDPHandlersFull
+	}
+	u.handlers[free] = udpHandlerEntry{port: port, h: h}
+	return nil
+}
+
+// JoinMulticast asks the WiFi chip to pass up frames sent to the IPv4
+// multicast group, so handlers registered with [Stack.HandleUDP] see them.
+// It must not be called from a [UDPHandler].
+func (s *Stack) JoinMulticast(group netip.Addr) error {
+	if !group.Is4() || !group.IsMulticast() {
+		return errors.New("not an IPv4 multicast group: " + group.String())
+	}
+	return s.joinMulticastHW(multicastHW(group.As4()))
+}
+
+// joinMulticastHW adds hw to the chip's multicast filter. Groups are
+// never left, so the filter only has to be written when one is joined.
+func (s *Stack) joinMulticastHW(hw [6]byte) error {
+	// The driver doesn't serialise the filter update with PollOne.
+	s.radioMu.Lock()
+	defer s.radioMu.Unlock()
+	if slices.Contains(s.mcast, hw) {
+		return nil
+	} else if len(s.mcast) == maxMulticastGroups {
+		return errMulticastFull
+	}
+	s.mcast = append(s.mcast, hw)
+	if s.radioOff {
+		return nil // Written by rejoin once the radio is back on.
+	}
+	err := s.dev.SetMulticastList(s.mcast)
+	if err != nil {
+		s.mcast = s.mcast[:len(s.mcast)-1]
+		return errors.New("set multicast filter: " + err.Error())
+	}
+	return nil
+}
+
+// SendUDP queues a datagram from srcPort to dst. The destination hardware
+// address is the broadcast or multicast address for such destinations, the
+// gateway for off-subnet destinations and is resolved via ARP, or neighbour
+// discovery for IPv6, otherwise, which may block. Use [Stack.SendUDPTo] from a [UDPHandler].
+func (s *Stack) SendUDP(srcPort uint16, dst netip.AddrPort, payload []byte) error {
+	hw, err := s.resolveHW(dst.Addr())
+	if err != nil {
+		return err
+	}
+	return s.SendUDPTo(hw, srcPort, dst, payload)
+}
+
+// SendUDPTo queues a datagram from srcPort to dst, addressed to the
+// hardware address dstHW. It never blocks. IPv6 destinations need
+// [Stack.SetupIPv6] to have been called.
+func (s *Stack) SendUDPTo(dstHW [6]byte, srcPort uint16, dst netip.AddrPort, payload []byte) error {
+	if dst.Addr().Is6() && !dst.Addr().Is4In6() {
+		return s.sendUDP6(dstHW, srcPort, dst, payload)
+	}
+	return s.sendUDPFrom(s.Addr(), dstHW, srcPort, dst, payload)
+}
+
+// sendUDPFrom is SendUDPTo with an explicit source address, as needed when
+// the stack's address is not the one to use (e.g: DHCP).
+func (s *Stack) sendUDPFrom(src netip.Addr, dstHW [6]byte, srcPort uint16, dst netip.AddrPort, payload []byte) error {
+	if len(payload) > MaxUDPPayload {
+		return errUDPPayloadSize
+	} else if !dst.Addr().Is4() || !src.Is4() {
+		return errUnsupportedAddr4
+	}
+	u := &s.udp
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	buf, err := u.nextFrame(udpHeadersLen + len(payload))
+	if err != nil {
+		return err
+	}
+
+	efrm, _ := ethernet.NewFrame(buf)
+	*efrm.DestinationHardwareAddr() = dstHW
+	*efrm.SourceHardwareAddr() = s.s.HardwareAddress()
+	efrm.SetEtherType(ethernet.TypeIPv4)
+
+	ifrm, _ := ipv4.NewFrame(buf[ethHeaderLen:])
+	ifrm.ClearHeader()
+	ifrm.SetVersionAndIHL(4, 5)
+	ifrm.SetTotalLength(uint16(ipv4HeaderLen + udpHeaderLen + len(payload)))
+	u.ipID++
+	ifrm.SetID(u.ipID)
+	ttl := uint8(64)
+	if dst.Addr().IsMulticast() {
+		ttl = 255 // Required by mDNS, harmless for other link-local multicast.
+	}
+	ifrm.SetTTL(ttl)
+	ifrm.SetProtocol(lneto.IPProtoUDP)
+	*ifrm.SourceAddr() = src.As4()
+	*ifrm.DestinationAddr() = dst.Addr().As4()
+	ifrm.SetCRC(ifrm.CalculateHeaderCRC())
+
+	ufrm, _ := udp.NewFrame(buf[ethHeaderLen+ipv4HeaderLen:])
+	ufrm.ClearHeader()
+	ufrm.SetSourcePort(srcPort)
+	ufrm.SetDestinationPort(dst.Port())
+	ufrm.SetLength(uint16(udpHeaderLen + len(payload)))
+	copy(ufrm.Payload(), payload)
+	var crc lneto.CRC791
+	ifrm.CRCWriteUDPPseudo(&crc, ufrm.Length())
+	// Zero means no checksum in UDP over IPv4.
+	ufrm.SetCRC(lneto.NeverZeroSum(crc.PayloadSum16(ufrm.RawData())))
+
+	u.pushFrame(len(buf))
+	s.Notify()
+	return nil
+}
+
+// nextFrame returns the free transmit slot, sized to n bytes. u.mu must be
+// held and pushFrame called once the frame is written.
+func (u *udpState) nextFrame(n int) ([]byte, error) {
+	if u.queued == udpQueueLen {
+		return nil, errUDPQueueFull
+	}
+	if u.queue == nil {
+		u.queue = new([udpQueueLen][udpFrameSize]byte)
+	}
+	slot := (u.head + u.queued) % udpQueueLen
+	return u.queue[slot][:n], nil
+}
+
+// pushFrame queues the n byte frame written to the slot from nextFrame.
+func (u *udpState) pushFrame(n int) {
+	u.lens[(u.head+u.queued)%udpQueueLen] = n
+	u.queued++
+}
+
+// demuxUDP passes pkt to a registered UDP handler if it is an IPv4 UDP
+// datagram for a handled port. It reports whether the frame was consumed.
+func (s *Stack) demuxUDP(pkt []byte) bool {
+	efrm, err := ethernet.NewFrame(pkt)
+	if err != nil || efrm.EtherTypeOrSize() != ethernet.TypeIPv4 {
+		return false
+	}
+	ifrm, err := ipv4.NewFrame(pkt[ethHeaderLen:])
+	if err != nil || ifrm.Protocol() != lneto.IPProtoUDP {
+		return false
+	}
+	ihl := ifrm.HeaderLength()
+	tl := int(ifrm.TotalLength())
+	if ihl < ipv4HeaderLen || tl > len(pkt)-ethHeaderLen || tl < ihl+udpHeaderLen {
+		return false
+	} else if flags := ifrm.Flags(); flags.MoreFragments() || flags.FragmentOffset() != 0 {
+		return false // Fragments are left to lneto.
+	}
+	ufrm, err := udp.NewFrame(pkt[ethHeaderLen+ihl : ethHeaderLen+tl])
+	if err != nil || int(ufrm.Length()) < udpHeaderLen || int(ufrm.Length()) > tl-ihl {
+		return false
+	}
+
+	h := s.udpHandler(ufrm.DestinationPort())
+	if h == nil {
+		return false
+	}
+	p := UDPPacket{
+		SrcHW:   *efrm.SourceHardwareAddr(),
+		Src:     netip.AddrPortFrom(netip.AddrFrom4(*ifrm.SourceAddr()), ufrm.SourcePort()),
+		Dst:     netip.AddrPortFrom(netip.AddrFrom4(*ifrm.DestinationAddr()), ufrm.DestinationPort()),
+		Payload: ufrm.Payload(),
+	}
+	return h(&p)
+}
+
+func (s *Stack) udpHandler(port uint16) UDPHandler {
+	u := &s.udp
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for i := range u.handlers {
+		if u.handlers[i].h != nil && u.handlers[i].port == port {
+			return u.handlers[i].h
+		}
+	}
+	return nil
+}
+
+// sendQueuedUDP transmits the oldest queued UDP frame, if any, and returns
+// its length.
+func (s *Stack) sendQueuedUDP() (int, error) {
+	u := &s.udp
+	u.mu.Lock()
+	if u.queued == 0 {
+		u.mu.Unlock()
+		return 0, nil
+	}
+	slot := u.head
+	frame := u.queue[slot][:u.lens[slot]]
+	u.mu.Unlock()
+
+	// SendEth copies the frame into the device's buffer, so the slot can
+	// be released once it returns.
+	err := s.sendEth(frame)
+
+	u.mu.Lock()
+	u.head = (u.head + 1) % udpQueueLen
+	u.queued--
+	u.mu.Unlock()
+	return len(frame), err
+}
+
+// resolveHW returns the hardware address frames to addr should be sent to.
+func (s *Stack) resolveHW(addr netip.Addr) (hw [6]byte, err error) {
+	if addr.Is6() && !addr.Is4In6() {
+		return s.resolveHW6(addr)
+	} else if !addr.Is4() {
+		return hw, errUnsupportedAddr4
+	}
+	a4 := addr.As4()
+	subnet := s.subnet
+	switch {
+	case a4 == [4]byte{255, 255, 255, 255} || (subnet.IsValid() && addr == broadcastAddr(subnet)):
+		return ethernet.BroadcastAddr(), nil
+	case addr.IsMulticast():
+		return multicastHW(a4), nil
+	case !subnet.IsValid() || !subnet.Contains(addr):
+		hw = s.s.Gateway6()
+		if hw == [6]byte{} {
+			return hw, errNoGateway
+		}
+		return hw, nil
+	}
+
+	u := &s.udp
+	u.mu.Lock()
+	for i := range u.hwcache {
+		if u.hwcache[i].addr == addr {
+			hw = u.hwcache[i].hw
+			u.mu.Unlock()
+			return hw, nil
+		}
+	}
+	u.mu.Unlock()
+
+	const pollTime = 5 * time.Millisecond
+	hw, err = s.resolveHardwareAddr(addr, pollTime, 3)
+	if err != nil {
+		return hw, errors.New("resolve " + addr.String() + ": " + err.Error())
+	}
+	u.mu.Lock()
+	u.hwcache[u.hwnext] = hwCacheEntry{addr: addr, hw: hw}
+	u.hwnext = (u.hwnext + 1) % hwCacheLen
+	u.mu.Unlock()
+	return hw, nil
+}
+
+// flushHWCache forgets resolved hardware addresses, e.g. after the
+// stack's address or network changes.
+func (s *Stack) flushHWCache() {
+	u := &s.udp
+	u.mu.Lock()
+	u.hwcache = [hwCacheLen]hwCacheEntry{}
+	u.mu.Unlock()
+}
+
+// multicastHW returns the hardware address of an IPv4 multicast group:
+// 01:00:5e followed by the low 23 bits of the group address (RFC 1112).
+func multicastHW(group [4]byte) [6]byte {
+	return [6]byte{0x01, 0x00, 0x5e, group[1] & 0x7f, group[2], group[3]}
+}
+
+// broadcastAddr returns the directed broadcast address of an IPv4 prefix.
+func broadcastAddr(p netip.Prefix) netip.Addr {
+	a := p.Addr().As4()
+	bits := p.Bits()
+	for i := range a {
+		hostBits := min(8, max(0, (i+1)*8-bits))
+		a[i] |= byte(1<<hostBits - 1)
+	}
+	return netip.AddrFrom4(a)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/harveysanders/picoplayground/mqttsensor/mqtt"
+)
+
+// historyLen is the number of readings kept for the dashboard chart, two
+// minutes at the default sample interval.
+const historyLen = 120
+
+// historySample is the part of a reading the dashboard charts.
+type historySample struct {
+	sinceBoot   time.Duration
+	timestamp   time.Time // Zero until the clock is set.
+	voltage     float32
+	temperature float32
+	humidity    float32
+}
+
+func newHistorySample(r mqtt.SensorReading) historySample {
+	return historySample{
+		sinceBoot:   r.SinceBootNS,
+		timestamp:   r.Timestamp,
+		voltage:     r.Voltage,
+		temperature: r.Temperature,
+		humidity:    r.Humidity,
+	}
+}
+
+// history is a ring buffer of the latest readings, kept in RAM so a
+// dashboard opened mid-run starts with a chart instead of a blank page.
+type history struct {
+	mu      sync.Mutex
+	samples [historyLen]historySample
+	next    int // Index the next sample is written to.
+	n       int // Number of valid samples.
+	untimed int // Samples, oldest first, that may lack a timestamp.
+}
+
+func (h *history) add(r mqtt.SensorReading) {
+	h.mu.Lock()
+	if h.n == historyLen && h.untimed > 0 {
+		h.untimed-- // The oldest is overwritten.
+	}
+	h.samples[h.next] = newHistorySample(r)
+	h.next = (h.next + 1) % historyLen
+	h.n = min(h.n+1, historyLen)
+	if r.Timestamp.IsZero() {
+		h.untimed = h.n
+	}
+	h.mu.Unlock()
+}
+
+// backfill timestamps the samples taken before the clock was set, which is
+// boot in wall time, as the MQTT client does for buffered readings.
+func (h *history) backfill(boot time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	start := h.next - h.n
+	for i := 0; i < h.untimed; i++ {
+		s := &h.samples[(start+i+historyLen)%historyLen]
+		if s.timestamp.IsZero() {
+			s.timestamp = boot.Add(s.sinceBoot)
+		}
+	}
+	h.untimed = 0
+}
+
+// each calls fn with the stored samples, oldest first.
+func (h *history) each(fn func(historySample)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	start := h.next - h.n
+	if start < 0 {
+		start += historyLen
+	}
+	for i := 0; i < h.n; i++ {
+		fn(h.samples[(start+i)%historyLen])
+	}
+}
+
+// appendCSV appends s as the dashboard's event data: seconds since boot,
+// voltage, temperature, humidity and the Unix time, 0 if not known.
+func (s historySample) appendCSV(dst []byte) []byte {
+	dst = strconv.AppendInt(dst, int64(s.sinceBoot/time.Second), 10)
+	dst = append(dst, ',')
+	dst = strconv.AppendFloat(dst, float64(s.voltage), 'f', 2, 32)
+	dst = append(dst, ',')
+	dst = strconv.AppendFloat(dst, float64(s.temperature), 'f', 1, 32)
+	dst = append(dst, ',')
+	dst = strconv.AppendFloat(dst, float64(s.humidity), 'f', 1, 32)
+	dst = append(dst, ',')
+	var unix int64
+	if !s.timestamp.IsZero() {
+		unix = s.timestamp.Unix()
+	}
+	return strconv.AppendInt(dst, unix, 10)
+}
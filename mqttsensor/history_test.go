@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/harveysanders/picoplayground/mqttsensor/mqtt"
+)
+
+func TestHistoryBackfill(t *testing.T) {
+	boot := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	var h history
+	// More untimed readings than fit, so the oldest are overwritten.
+	for i := 0; i < historyLen+10; i++ {
+		h.add(mqtt.SensorReading{SinceBootNS: time.Duration(i) * time.Second})
+	}
+	timed := boot.Add(time.Hour)
+	h.add(mqtt.SensorReading{SinceBootNS: time.Duration(historyLen+10) * time.Second, Timestamp: timed})
+	h.backfill(boot)
+
+	var got []historySample
+	h.each(func(s historySample) { got = append(got, s) })
+	if len(got) != historyLen {
+		t.Fatalf("%d samples, want %d", len(got), historyLen)
+	}
+	for i, s := range got[:len(got)-1] {
+		if want := boot.Add(s.sinceBoot); !s.timestamp.Equal(want) {
+			t.Errorf("sample %d at %v since boot: timestamp %v, want %v", i, s.sinceBoot, s.timestamp, want)
+		}
+	}
+	if last := got[len(got)-1]; !last.timestamp.Equal(timed) {
+		t.Errorf("timed sample changed to %v", last.timestamp)
+	}
+
+	// Samples already timestamped are not touched again.
+	h.backfill(boot.Add(time.Minute))
+	i := 0
+	h.each(func(s historySample) {
+		if !s.timestamp.Equal(got[i].timestamp) {
+			t.Errorf("sample %d timestamp changed from %v to %v", i, got[i].timestamp, s.timestamp)
+		}
+		i++
+	})
+}
+
+func TestHistorySampleCSV(t *testing.T) {
+	s := historySample{sinceBoot: 90 * time.Second, voltage: 1.5, temperature: 70.25, humidity: 40}
+	if got, want := string(s.appendCSV(nil)), "90,1.50,70.2,40.0,0"; got != want {
+		t.Errorf("untimed CSV %q, want %q", got, want)
+	}
+	s.timestamp = time.Unix(1792324800, 0)
+	if got, want := string(s.appendCSV(nil)), "90,1.50,70.2,40.0,1792324800"; got != want {
+		t.Errorf("timed CSV %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,193 @@
+package httpd
+
+import (
+	"io"
+	"strconv"
+)
+
+// HTTP status codes used by the server and its handlers.
+const (
+	StatusOK                  = 200
+	StatusNoContent           = 204
+	StatusFound               = 302
+	StatusSeeOther            = 303
+	StatusBadRequest          = 400
+	StatusUnauthorized        = 401
+	StatusForbidden           = 403
+	StatusNotFound            = 404
+	StatusMethodNotAllowed    = 405
+	StatusPayloadTooLarge     = 413
+	StatusHeaderTooLarge      = 431
+	StatusInternalServerError = 500
+	StatusServiceUnavailable  = 503
+)
+
+// StatusText returns the reason phrase of the status codes above.
+func StatusText(code int) string {
+	switch code {
+	case StatusOK:
+		return "OK"
+	case StatusNoContent:
+		return "No Content"
+	case StatusFound:
+		return "Found"
+	case StatusSeeOther:
+		return "See Other"
+	case StatusBadRequest:
+		return "Bad Request"
+	case StatusUnauthorized:
+		return "Unauthorized"
+	case StatusForbidden:
+		return "Forbidden"
+	case StatusNotFound:
+		return "Not Found"
+	case StatusMethodNotAllowed:
+		return "Method Not Allowed"
+	case StatusPayloadTooLarge:
+		return "Payload Too Large"
+	case StatusHeaderTooLarge:
+		return "Request Header Fields Too Large"
+	case StatusInternalServerError:
+		return "Internal Server Error"
+	case StatusServiceUnavailable:
+		return "Service Unavailable"
+	default:
+		return "Status " + strconv.Itoa(code)
+	}
+}
+
+// ResponseWriter buffers a response so it can be sent with a
+// Content-Length. Writes past the configured MaxResponse fail and the
+// client gets a 500 instead of a truncated page.
+type ResponseWriter struct {
+	status   int
+	header   []byte // Extra header lines, each ending in CRLF.
+	body     []byte
+	overflow bool
+	stream   bool // Set by Stream.
+	scratch  [64]byte
+}
+
+func (w *ResponseWriter) reset() {
+	w.status = 0
+	w.header = w.header[:0]
+	w.body = w.body[:0]
+	w.overflow = false
+	w.stream = false
+}
+
+// SetHeader adds a header field to the response. Content-Length and
+// Connection are set by the server.
+func (w *ResponseWriter) SetHeader(key, value string) {
+	// Room is kept for the CRLF ending the header.
+	if len(w.header)+len(key)+len(value)+6 > cap(w.header) {
+		w.overflow = true
+		return
+	}
+	w.header = append(w.header, key...)
+	w.header = append(w.header, ": "...)
+	w.header = append(w.header, value...)
+	w.header = append(w.header, "\r\n"...)
+}
+
+// WriteHeader sets the response status. It defaults to 200.
+func (w *ResponseWriter) WriteHeader(code int) {
+	w.status = code
+}
+
+// Write appends b to the response body.
+func (w *ResponseWriter) Write(b []byte) (int, error) {
+	if len(w.body)+len(b) > cap(w.body) {
+		w.overflow = true
+		return 0, errResponseFull
+	}
+	w.body = append(w.body, b...)
+	return len(b), nil
+}
+
+// WriteString appends s to the response body.
+func (w *ResponseWriter) WriteString(s string) (int, error) {
+	if len(w.body)+len(s) > cap(w.body) {
+		w.overflow = true
+		return 0, errResponseFull
+	}
+	w.body = append(w.body, s...)
+	return len(s), nil
+}
+
+// WriteEscaped appends s to the response body with HTML special
+// characters escaped, for text and attribute values.
+func (w *ResponseWriter) WriteEscaped(s string) {
+	start := 0
+	for i := 0; i < len(s); i++ {
+		var esc string
+		switch s[i] {
+		case '<':
+			esc = "&lt;"
+		case '>':
+			esc = "&gt;"
+		case '&':
+			esc = "&amp;"
+		case '"':
+			esc = "&#34;"
+		case '\'':
+			esc = "&#39;"
+		default:
+			continue
+		}
+		w.WriteString(s[start:i])
+		w.WriteString(esc)
+		start = i + 1
+	}
+	w.WriteString(s[start:])
+}
+
+// writeTo sends the status line, header and, unless omitBody is set, the body.
+func (w *ResponseWriter) writeTo(dst io.Writer, omitBody bool) error {
+	if w.status == 0 {
+		w.status = StatusOK
+	}
+	line := append(w.scratch[:0], "HTTP/1.1 "...)
+	line = strconv.AppendInt(line, int64(w.status), 10)
+	line = append(line, ' ')
+	_, err := dst.Write(line)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(dst, StatusText(w.status))
+	if err != nil {
+		return err
+	}
+	// Streams have no length; they end when the connection closes.
+	line = append(w.scratch[:0], "\r\n"...)
+	if !w.stream {
+		line = append(line, "Content-Length: "...)
+		line = strconv.AppendInt(line, int64(len(w.body)), 10)
+		line = append(line, "\r\n"...)
+	}
+	line = append(line, "Connection: close\r\n"...)
+	_, err = dst.Write(line)
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(append(w.header, "\r\n"...))
+	if err != nil || omitBody || len(w.body) == 0 {
+		return err
+	}
+	_, err = dst.Write(w.body)
+	return err
+}
+
+// Error responds with code and its reason phrase as a plain text body.
+func Error(w *ResponseWriter, code int) {
+	w.WriteHeader(code)
+	w.SetHeader("Content-Type", "text/plain; charset=utf-8")
+	w.WriteString(StatusText(code))
+	w.WriteString("\n")
+}
+
+// Redirect responds with a redirect to location.
+func Redirect(w *ResponseWriter, location string, code int) {
+	w.WriteHeader(code)
+	w.SetHeader("Location", location)
+}
@@ -0,0 +1,389 @@
+// Package httpd is a small HTTP/1.1 server on the lneto TCP stack.
+//
+// It is meant for configuration and status pages, not throughput: requests
+// are served one at a time on the goroutine calling [Server.Serve], each
+// connection carries a single request and is closed after the response,
+// and every buffer is allocated up front so memory use is bounded by the
+// [Config] regardless of what clients send. The exception to one request
+// per connection is Server-Sent Events streams, which stay open to receive
+// events pushed with [Server.SendEvent].
+package httpd
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log/slog"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/soypat/lneto/tcp"
+	"github.com/soypat/lneto/x/xnet"
+)
+
+var (
+	errHeaderTooLarge = errors.New("httpd: request header too large")
+	errBodyTooLarge   = errors.New("httpd: request body too large")
+	errMalformed      = errors.New("httpd: malformed request")
+	errResponseFull   = errors.New("httpd: response buffer full")
+)
+
+// Config configures a [Server].
+type Config struct {
+	// Port to listen on. Defaults to 80.
+	Port uint16
+	// MaxConns is the number of connections that can be open or waiting
+	// to be served at once. Defaults to 2. The listener takes one of the
+	// stack's TCP ports however many connections it accepts.
+	MaxConns int
+	// MaxRequest bounds the request line, header and body. Defaults to 1024.
+	MaxRequest int
+	// MaxResponse bounds the response body. Defaults to 4096.
+	MaxResponse int
+	// MaxStreams is the number of event streams that can be open at once.
+	// Each holds one of the MaxConns connections, so it must be less than
+	// MaxConns. Zero disables streaming.
+	MaxStreams int
+	// Timeout for reading a request and writing its response. Defaults to 5s.
+	Timeout time.Duration
+	// Logger for server operations.
+	Logger *slog.Logger
+}
+
+// Handler responds to a request by writing to w. It runs on the serving
+// goroutine, so it should not block for long.
+type Handler func(w *ResponseWriter, r *Request)
+
+// Server serves HTTP requests received on one port.
+type Server struct {
+	cfg      Config
+	handler  Handler
+	listener tcp.Listener
+	pool     *xnet.TCPPool
+	log      *slog.Logger
+
+	reqbuf []byte
+	req    Request
+	w      ResponseWriter
+
+	mu        sync.Mutex // Guards streams and pending, shared with SendEvent.
+	streams   []*tcp.Conn
+	pending   []byte // Events queued for the streams.
+	sendbuf   []byte // Events being written to the streams.
+	lastEvent time.Time
+}
+
+// New registers a listener on stack and returns a server ready to [Server.Serve] requests with h.
+func New(stack *xnet.StackAsync, h Handler, cfg Config) (*Server, error) {
+	if h == nil {
+		return nil, errors.New("httpd: nil handler")
+	}
+	if cfg.Port == 0 {
+		cfg.Port = 80
+	}
+	if cfg.MaxConns <= 0 {
+		cfg.MaxConns = 2
+	}
+	if cfg.MaxRequest <= 0 {
+		cfg.MaxRequest = 1024
+	}
+	if cfg.MaxResponse <= 0 {
+		cfg.MaxResponse = 4096
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	if cfg.MaxStreams < 0 || (cfg.MaxStreams > 0 && cfg.MaxStreams >= cfg.MaxConns) {
+		return nil, errors.New("httpd: MaxStreams must be less than MaxConns")
+	}
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.Level(127)}))
+	}
+	const tcpBufSize = 1024
+	pool, err := xnet.NewTCPPool(xnet.TCPPoolConfig{
+		PoolSize:           uint16(cfg.MaxConns),
+		QueueSize:          4,
+		TxBufSize:          tcpBufSize,
+		RxBufSize:          tcpBufSize,
+		EstablishedTimeout: cfg.Timeout,
+		ClosingTimeout:     cfg.Timeout,
+	})
+	if err != nil {
+		return nil, errors.New("httpd: tcp pool: " + err.Error())
+	}
+	sv := &Server{
+		cfg:     cfg,
+		handler: h,
+		pool:    pool,
+		log:     logger,
+		reqbuf:  make([]byte, cfg.MaxRequest),
+	}
+	sv.w.body = make([]byte, 0, cfg.MaxResponse)
+	sv.w.header = make([]byte, 0, 256)
+	if cfg.MaxStreams > 0 {
+		const pendingSize = 512
+		sv.streams = make([]*tcp.Conn, 0, cfg.MaxStreams)
+		sv.pending = make([]byte, 0, pendingSize)
+		sv.sendbuf = make([]byte, 0, pendingSize)
+	}
+	err = sv.listener.Reset(cfg.Port, pool)
+	if err != nil {
+		return nil, errors.New("httpd: listener: " + err.Error())
+	}
+	err = stack.RegisterListener(&sv.listener)
+	if err != nil {
+		return nil, errors.New("httpd: register listener: " + err.Error())
+	}
+	return sv, nil
+}
+
+// Serve accepts and serves connections forever.
+func (sv *Server) Serve() {
+	const idlePoll = 20 * time.Millisecond
+	for {
+		sv.pool.CheckTimeouts()
+		sv.serviceStreams()
+		if sv.listener.NumberOfReadyToAccept() == 0 {
+			time.Sleep(idlePoll)
+			continue
+		}
+		conn, _, err := sv.listener.TryAccept()
+		if err != nil {
+			continue
+		}
+		sv.serveConn(conn)
+	}
+}
+
+func (sv *Server) serveConn(conn *tcp.Conn) {
+	keepOpen := false
+	defer func() {
+		if !keepOpen {
+			conn.Close()
+		}
+	}()
+	conn.SetDeadline(time.Now().Add(sv.cfg.Timeout))
+	var remote netip.Addr
+	if raddr := conn.RemoteAddr(); len(raddr) == 4 {
+		remote = netip.AddrFrom4([4]byte(raddr))
+	}
+
+	w := &sv.w
+	w.reset()
+	err := sv.readRequest(conn)
+	switch err {
+	case nil:
+		sv.req.RemoteAddr = remote
+		sv.handler(w, &sv.req)
+	case errHeaderTooLarge:
+		Error(w, StatusHeaderTooLarge)
+	case errBodyTooLarge:
+		Error(w, StatusPayloadTooLarge)
+	case errMalformed:
+		Error(w, StatusBadRequest)
+	default:
+		sv.log.Debug("httpd:read", slog.String("remote", remote.String()), slog.String("err", err.Error()))
+		return
+	}
+	if w.overflow {
+		sv.log.Error("httpd:response-truncated", slog.String("path", sv.req.Path))
+		w.reset()
+		Error(w, StatusInternalServerError)
+	}
+	if w.stream && (sv.req.Method == "HEAD" || !sv.addStream(conn)) {
+		w.reset()
+		Error(w, StatusServiceUnavailable)
+	}
+	err = w.writeTo(conn, sv.req.Method == "HEAD")
+	if err == nil {
+		err = conn.Flush()
+	}
+	if err != nil {
+		sv.log.Debug("httpd:write", slog.String("remote", remote.String()), slog.String("err", err.Error()))
+	} else if w.stream {
+		// The stream is now serviced by the Serve loop.
+		conn.SetDeadline(time.Time{})
+		keepOpen = true
+	}
+	sv.log.Info("httpd:request", slog.String("method", sv.req.Method), slog.String("path", sv.req.Path), slog.Int("status", w.status))
+}
+
+// readRequest reads and parses a request into sv.req.
+func (sv *Server) readRequest(conn *tcp.Conn) error {
+	buf := sv.reqbuf
+	n := 0
+	hdrEnd := -1
+	for hdrEnd < 0 {
+		if n == len(buf) {
+			return errHeaderTooLarge
+		}
+		nn, err := conn.Read(buf[n:])
+		n += nn
+		if err != nil && nn == 0 {
+			return err
+		}
+		hdrEnd = bytes.Index(buf[:n], []byte("\r\n\r\n"))
+	}
+	req := &sv.req
+	*req = Request{}
+	reqLine, fields, _ := bytes.Cut(buf[:hdrEnd], []byte("\r\n"))
+	method, rest, ok1 := bytes.Cut(reqLine, []byte(" "))
+	target, proto, ok2 := bytes.Cut(rest, []byte(" "))
+	if !ok1 || !ok2 || !bytes.HasPrefix(proto, []byte("HTTP/1.")) || len(target) == 0 {
+		return errMalformed
+	}
+	req.Method = string(method)
+	path, query, _ := bytes.Cut(target, []byte("?"))
+	req.Path = string(path)
+	req.RawQuery = string(query)
+	req.header = fields
+
+	bodyLen := 0
+	if cl := headerValue(fields, "Content-Length"); len(cl) > 0 {
+		v, err := strconv.Atoi(string(cl))
+		if err != nil || v < 0 {
+			return errMalformed
+		}
+		bodyLen = v
+	}
+	bodyStart := hdrEnd + 4
+	if bodyStart+bodyLen > len(buf) {
+		return errBodyTooLarge
+	}
+	for n < bodyStart+bodyLen {
+		nn, err := conn.Read(buf[n : bodyStart+bodyLen])
+		n += nn
+		if err != nil && nn == 0 {
+			return err
+		}
+	}
+	req.Body = buf[bodyStart : bodyStart+bodyLen]
+	return nil
+}
+
+// Request is a parsed HTTP request. It and its fields are only valid
+// during the [Handler] call.
+type Request struct {
+	Method     string
+	Path       string
+	RawQuery   string
+	Body       []byte
+	RemoteAddr netip.Addr
+
+	header []byte // Raw header fields, without the request line.
+	form   url.Values
+}
+
+// Header returns the value of the first header field named key, or nil.
+func (r *Request) Header(key string) []byte {
+	return headerValue(r.header, key)
+}
+
+// FormValue returns the named value from the query string or, for
+// url-encoded POST bodies, from the body.
+func (r *Request) FormValue(key string) string {
+	if r.form == nil {
+		r.form, _ = url.ParseQuery(r.RawQuery)
+		ct := r.Header("Content-Type")
+		if r.Method == "POST" && bytes.HasPrefix(ct, []byte("application/x-www-form-urlencoded")) {
+			body, _ := url.ParseQuery(string(r.Body))
+			for k, v := range body {
+				r.form[k] = append(r.form[k], v...)
+			}
+		}
+	}
+	return r.form.Get(key)
+}
+
+// BasicAuth returns the credentials of a Basic Authorization header.
+func (r *Request) BasicAuth() (user, pass string, ok bool) {
+	const prefix = "Basic "
+	auth := r.Header("Authorization")
+	if len(auth) < len(prefix) || !bytes.EqualFold(auth[:len(prefix)], []byte(prefix)) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(string(auth[len(prefix):]))
+	if err != nil {
+		return "", "", false
+	}
+	user, pass, ok = strings.Cut(string(decoded), ":")
+	return user, pass, ok
+}
+
+// CheckBasicAuth reports whether r carries the given credentials. If not,
+// it responds with 401 Unauthorized asking the browser for credentials.
+func CheckBasicAuth(w *ResponseWriter, r *Request, realm, user, pass string) bool {
+	u, p, ok := r.BasicAuth()
+	// Compare both in constant time so timing doesn't reveal which was wrong.
+	userOK := subtle.ConstantTimeCompare([]byte(u), []byte(user))
+	passOK := subtle.ConstantTimeCompare([]byte(p), []byte(pass))
+	if ok && userOK&passOK == 1 {
+		return true
+	}
+	w.reset()
+	w.SetHeader("WWW-Authenticate", `Basic realm="`+realm+`", charset="UTF-8"`)
+	Error(w, StatusUnauthorized)
+	return false
+}
+
+// CheckSameOrigin reports whether r was sent by a page served from the
+// host it is addressed to, guarding state-changing requests against
+// cross-site request forgery: a browser that holds the basic auth
+// credentials sends them with forms posted from any site. If not, it
+// responds with 403 Forbidden.
+//
+// The Origin header is checked, or the Referer if there is none. Browsers
+// send Origin with every POST, so a request without either comes from a
+// client such as curl rather than a page, and is let through.
+func CheckSameOrigin(w *ResponseWriter, r *Request) bool {
+	if sameOrigin(r) {
+		return true
+	}
+	Error(w, StatusForbidden)
+	return false
+}
+
+func sameOrigin(r *Request) bool {
+	host := r.Header("Host")
+	if len(host) == 0 {
+		return false
+	}
+	origin := r.Header("Origin")
+	if origin == nil {
+		origin = r.Header("Referer")
+		if origin == nil {
+			return true
+		}
+	}
+	// Compare the authority, "host[:port]", of the URL. An opaque origin,
+	// "null", has none and fails.
+	_, authority, ok := bytes.Cut(origin, []byte("://"))
+	if !ok {
+		return false
+	}
+	if i := bytes.IndexAny(authority, "/?#"); i >= 0 {
+		authority = authority[:i]
+	}
+	return bytes.EqualFold(authority, host)
+}
+
+// headerValue returns the value of the first field named key in fields,
+// the CRLF-separated header lines.
+func headerValue(fields []byte, key string) []byte {
+	for len(fields) > 0 {
+		var line []byte
+		line, fields, _ = bytes.Cut(fields, []byte("\r\n"))
+		name, value, ok := bytes.Cut(line, []byte(":"))
+		if ok && bytes.EqualFold(bytes.TrimSpace(name), []byte(key)) {
+			return bytes.TrimSpace(value)
+		}
+	}
+	return nil
+}
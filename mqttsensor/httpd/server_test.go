@@ -0,0 +1,30 @@
+package httpd
+
+import "testing"
+
+func TestSameOrigin(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   bool
+	}{
+		{"same origin", "Host: 192.168.1.20\r\nOrigin: http://192.168.1.20", true},
+		{"same origin with port", "Host: sensor.local:8080\r\nOrigin: http://sensor.local:8080", true},
+		{"host case", "Host: Sensor.local\r\nOrigin: http://sensor.local", true},
+		{"referer only", "Host: 192.168.1.20\r\nReferer: http://192.168.1.20/config", true},
+		{"no origin or referer", "Host: 192.168.1.20", true},
+		{"other site", "Host: 192.168.1.20\r\nOrigin: http://evil.example", false},
+		{"other port", "Host: 192.168.1.20\r\nOrigin: http://192.168.1.20:8080", false},
+		{"host as prefix", "Host: 192.168.1.2\r\nOrigin: http://192.168.1.20", false},
+		{"other site referer", "Host: 192.168.1.20\r\nReferer: http://evil.example/?h=192.168.1.20", false},
+		{"origin wins over referer", "Host: 192.168.1.20\r\nOrigin: http://evil.example\r\nReferer: http://192.168.1.20/", false},
+		{"opaque origin", "Host: 192.168.1.20\r\nOrigin: null", false},
+		{"no host", "Origin: http://192.168.1.20", false},
+	}
+	for _, tt := range tests {
+		r := Request{Method: "POST", header: []byte(tt.header)}
+		if got := sameOrigin(&r); got != tt.want {
+			t.Errorf("%s: sameOrigin = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package httpd
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/soypat/lneto/tcp"
+)
+
+// Server-Sent Events. A handler turns its response into an event stream
+// with [ResponseWriter.Stream]; the connection then stays open and receives
+// every event passed to [Server.SendEvent] until the client goes away.
+// All stream I/O happens on the serving goroutine, so SendEvent never
+// blocks the caller on a slow client.
+
+// keepAliveInterval is how often idle streams get a comment so that
+// clients and middleboxes don't give up on them.
+const keepAliveInterval = 30 * time.Second
+
+// Stream makes the response a text/event-stream that stays open after the
+// body is sent. The body, if any, should hold events written with
+// [AppendEvent] to bring the client up to date. If MaxStreams streams are
+// already open the client gets 503 Service Unavailable instead.
+func (w *ResponseWriter) Stream() {
+	w.stream = true
+	w.SetHeader("Content-Type", "text/event-stream")
+	w.SetHeader("Cache-Control", "no-store")
+}
+
+// AppendEvent appends a Server-Sent Event with the given name and data to
+// dst. An empty event name sends a default "message" event. data must not
+// contain newlines.
+func AppendEvent(dst []byte, event string, data []byte) []byte {
+	if event != "" {
+		dst = append(dst, "event: "...)
+		dst = append(dst, event...)
+		dst = append(dst, '\n')
+	}
+	dst = append(dst, "data: "...)
+	dst = append(dst, data...)
+	return append(dst, "\n\n"...)
+}
+
+// SendEvent queues an event for every open stream. It is safe to call from
+// any goroutine. The event is dropped if the queue is full.
+func (sv *Server) SendEvent(event string, data []byte) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	if len(sv.streams) == 0 {
+		return
+	}
+	const framing = len("event: \ndata: \n\n")
+	if len(sv.pending)+len(event)+len(data)+framing > cap(sv.pending) {
+		sv.log.Debug("httpd:event-dropped", slog.String("event", event))
+		return
+	}
+	sv.pending = AppendEvent(sv.pending, event, data)
+}
+
+// addStream keeps conn open as an event stream. It reports false if the
+// server has no room for another stream.
+func (sv *Server) addStream(conn *tcp.Conn) bool {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	if len(sv.streams) >= sv.cfg.MaxStreams {
+		return false
+	}
+	sv.streams = append(sv.streams, conn)
+	return true
+}
+
+// serviceStreams sends queued events to the open streams and closes those
+// whose client is gone or too slow to keep up. Only the serving goroutine
+// changes the streams, so it writes to them without holding the lock.
+func (sv *Server) serviceStreams() {
+	sv.mu.Lock()
+	data := append(sv.sendbuf[:0], sv.pending...)
+	sv.pending = sv.pending[:0]
+	streams := sv.streams
+	sv.mu.Unlock()
+	if len(streams) == 0 {
+		return
+	}
+	if len(data) == 0 && time.Since(sv.lastEvent) >= keepAliveInterval {
+		data = append(data, ":\n\n"...) // A comment, ignored by clients.
+	}
+	open := streams[:0]
+	for _, conn := range streams {
+		if conn.State() != tcp.StateEstablished {
+			conn.Close()
+			continue
+		}
+		if len(data) > 0 {
+			conn.SetWriteDeadline(time.Now().Add(sv.cfg.Timeout))
+			_, err := conn.Write(data)
+			if err != nil {
+				sv.log.Info("httpd:stream-closed", slog.String("err", err.Error()))
+				conn.Abort()
+				continue
+			}
+		}
+		open = append(open, conn)
+	}
+	clear(streams[len(open):])
+	if len(data) > 0 {
+		sv.lastEvent = time.Now()
+	}
+	sv.mu.Lock()
+	sv.streams = open
+	sv.mu.Unlock()
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/harveysanders/picoplayground/mqttsensor/cyw43439"
+)
+
+// ipv6Enabled turns on IPv6 with a link-local address and SLAAC when set
+// to "true". It is experimental: IPv4 is still needed, and the web
+// interface stays on it; the MQTT connection uses IPv6 for brokers with
+// only an IPv6 address. Can be passed via linker flags.
+var ipv6Enabled string
+
+// setupIPv6 configures IPv6 if ipv6Enabled asks for it. Failures are
+// logged; the device works without IPv6.
+func setupIPv6(logger *slog.Logger, stack *cyw43439.Stack) {
+	if ipv6Enabled == "" {
+		return
+	}
+	enabled, err := strconv.ParseBool(ipv6Enabled)
+	if err != nil {
+		logger.Error("ipv6:disabled", slog.String("reason", "invalid setting "+strconv.Quote(ipv6Enabled)))
+		return
+	} else if !enabled {
+		return
+	}
+	logger.Warn("ipv6:experimental", slog.String("scope", "web interface stays on IPv4"))
+	err = stack.SetupIPv6(10 * time.Second)
+	if err != nil {
+		logger.Error("ipv6:setup", slog.String("reason", err.Error()))
+	}
+}
@@ -0,0 +1,247 @@
+package mdns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/harveysanders/picoplayground/mqttsensor/cyw43439"
+)
+
+// Browsing uses one-shot queries (RFC 6762 section 5.1): the query is sent
+// from an ephemeral port, so responders answer with unicast to that port.
+// This keeps browsing out of the responder's way on port 5353 and works
+// even when the chip's multicast filter can't be set, but responders that
+// multicast their answers regardless are missed.
+
+// maxBrowseEntries bounds the instances and hosts a browse collects.
+const maxBrowseEntries = 8
+
+// ServiceEntry is a service instance found by [Browse].
+type ServiceEntry struct {
+	// Instance is the full instance name, e.g. "broker._mqtt._tcp.local".
+	Instance string
+	// Host is the target host name, e.g. "pi.local".
+	Host string
+	// Addr is the host's IPv4 address. It is invalid if no responder
+	// gave one.
+	Addr     netip.Addr
+	Port     uint16
+	Priority uint16
+	Weight   uint16
+	TXT      []string
+}
+
+type browseEntry struct {
+	instance []byte
+	host     []byte
+	port     uint16
+	priority uint16
+	weight   uint16
+	txt      []string
+	hasSRV   bool
+}
+
+type hostAddr struct {
+	name []byte
+	addr netip.Addr
+}
+
+// browser collects answers to a browse query. The handler fills it on the
+// packet processing goroutine while Browse waits.
+type browser struct {
+	typ     []byte
+	mu      sync.Mutex
+	msg     message
+	entries []browseEntry
+	hosts   []hostAddr
+}
+
+// Browse queries for instances of serviceType, e.g. "_mqtt._tcp", and
+// returns the ones that answered within timeout, with their SRV, TXT and
+// address records. It blocks for the whole timeout.
+func Browse(stack *cyw43439.Stack, serviceType string, timeout time.Duration) ([]ServiceEntry, error) {
+	b := &browser{
+		entries: make([]browseEntry, 0, maxBrowseEntries),
+		hosts:   make([]hostAddr, 0, maxBrowseEntries),
+	}
+	var err error
+	b.typ, err = appendName(nil, serviceType+".local")
+	if err != nil {
+		return nil, errors.New("mdns: service type " + serviceType + ": " + err.Error())
+	}
+	port := uint16(49152 + stack.Prand32()%16384)
+	err = stack.HandleUDP(port, b.handle)
+	if err != nil {
+		return nil, errors.New("mdns: browse: " + err.Error())
+	}
+	defer stack.HandleUDP(port, nil)
+
+	query := make([]byte, 0, 2*maxNameLen)
+	id := uint16(stack.Prand32())
+	query = appendQueryHeader(query, id, 1)
+	query = appendQuestion(query, b.typ, typePTR)
+	// Send twice, since a lost multicast frame is common on WiFi.
+	for i := 0; i < 2; i++ {
+		err = stack.SendUDPTo(groupHW, port, group, query)
+		if err != nil {
+			return nil, errors.New("mdns: browse: " + err.Error())
+		}
+		time.Sleep(timeout / 2)
+	}
+
+	// Ask for the addresses responders left out.
+	b.mu.Lock()
+	query = appendQueryHeader(query[:0], id+1, 0)
+	nq := 0
+	for i := range b.entries {
+		e := &b.entries[i]
+		if e.hasSRV && !b.addr(e.host).IsValid() && len(query)+len(e.host)+4 <= cap(query) {
+			query = appendQuestion(query, e.host, typeA)
+			nq++
+		}
+	}
+	b.mu.Unlock()
+	if nq > 0 {
+		binary.BigEndian.PutUint16(query[4:], uint16(nq))
+		err = stack.SendUDPTo(groupHW, port, group, query)
+		if err == nil {
+			time.Sleep(timeout / 2)
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var found []ServiceEntry
+	for i := range b.entries {
+		e := &b.entries[i]
+		if !e.hasSRV {
+			continue
+		}
+		found = append(found, ServiceEntry{
+			Instance: string(appendDotted(nil, e.instance)),
+			Host:     string(appendDotted(nil, e.host)),
+			Addr:     b.addr(e.host),
+			Port:     e.port,
+			Priority: e.priority,
+			Weight:   e.weight,
+			TXT:      e.txt,
+		})
+	}
+	return found, nil
+}
+
+func (b *browser) handle(pkt *cyw43439.UDPPacket) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	m := &b.msg
+	if m.reset(pkt.Payload) != nil || m.flags&flagResponse == 0 {
+		return true
+	}
+	for {
+		e, ok, err := m.next()
+		if err != nil || !ok {
+			return true
+		}
+		if e.section == sectionQuestion || e.class&^classTopBit != classIN {
+			continue
+		}
+		switch e.typ {
+		case typePTR:
+			if !nameEqual(e.name, b.typ) {
+				continue
+			}
+			var target [maxNameLen]byte
+			t, _, err := readName(target[:0], m.msg, e.dataOff)
+			if err == nil {
+				b.entry(t)
+			}
+		case typeSRV:
+			if len(e.data) < 7 {
+				continue
+			}
+			be := b.entry(e.name)
+			if be == nil {
+				continue
+			}
+			host, _, err := readName(be.host[:0], m.msg, e.dataOff+6)
+			if err != nil {
+				continue
+			}
+			be.host = host
+			be.priority = binary.BigEndian.Uint16(e.data[0:])
+			be.weight = binary.BigEndian.Uint16(e.data[2:])
+			be.port = binary.BigEndian.Uint16(e.data[4:])
+			be.hasSRV = true
+		case typeTXT:
+			be := b.entry(e.name)
+			if be == nil {
+				continue
+			}
+			be.txt = be.txt[:0]
+			for d := e.data; len(d) > 0 && int(d[0]) < len(d); d = d[1+d[0]:] {
+				if d[0] > 0 {
+					be.txt = append(be.txt, string(d[1:1+d[0]]))
+				}
+			}
+		case typeA:
+			if len(e.data) == 4 {
+				b.setAddr(e.name, netip.AddrFrom4([4]byte(e.data)))
+			}
+		}
+	}
+}
+
+// entry returns the entry for the instance name, adding it if there is
+// room. Instances of other service types are ignored.
+func (b *browser) entry(instance []byte) *browseEntry {
+	if len(instance) <= len(b.typ) || !nameEqual(instance[len(instance)-len(b.typ):], b.typ) {
+		return nil
+	}
+	for i := range b.entries {
+		if nameEqual(b.entries[i].instance, instance) {
+			return &b.entries[i]
+		}
+	}
+	if len(b.entries) == cap(b.entries) {
+		return nil
+	}
+	b.entries = append(b.entries, browseEntry{instance: append([]byte(nil), instance...)})
+	return &b.entries[len(b.entries)-1]
+}
+
+func (b *browser) setAddr(name []byte, addr netip.Addr) {
+	for i := range b.hosts {
+		if nameEqual(b.hosts[i].name, name) {
+			b.hosts[i].addr = addr
+			return
+		}
+	}
+	if len(b.hosts) < cap(b.hosts) {
+		b.hosts = append(b.hosts, hostAddr{name: append([]byte(nil), name...), addr: addr})
+	}
+}
+
+func (b *browser) addr(name []byte) netip.Addr {
+	for i := range b.hosts {
+		if nameEqual(b.hosts[i].name, name) {
+			return b.hosts[i].addr
+		}
+	}
+	return netip.Addr{}
+}
+
+func appendQueryHeader(dst []byte, id uint16, nq uint16) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, id)
+	dst = binary.BigEndian.AppendUint16(dst, 0) // Standard query.
+	dst = binary.BigEndian.AppendUint16(dst, nq)
+	return append(dst, 0, 0, 0, 0, 0, 0)
+}
+
+func appendQuestion(dst, name []byte, qtype uint16) []byte {
+	dst = append(dst, name...)
+	dst = binary.BigEndian.AppendUint16(dst, qtype)
+	return binary.BigEndian.AppendUint16(dst, classIN)
+}
@@ -0,0 +1,247 @@
+package mdns
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// DNS wire format, just what mDNS needs. Incoming names may be compressed;
+// names are always written in full.
+
+const (
+	headerLen = 12
+
+	typeA   = 1
+	typePTR = 12
+	typeTXT = 16
+	typeSRV = 33
+	typeANY = 255
+
+	classIN  = 1
+	classANY = 255
+	// classTopBit is the unicast-response bit in questions and the
+	// cache-flush bit in records (RFC 6762 sections 5.4 and 10.2).
+	classTopBit = 0x8000
+
+	flagResponse = 0x8000
+	flagAA       = 0x0400
+	opcodeMask   = 0x7800
+
+	maxNameLen = 255
+)
+
+var (
+	errMalformed = errors.New("mdns: malformed message")
+	errBadName   = errors.New("mdns: invalid name")
+)
+
+// Message sections, in wire order.
+const (
+	sectionQuestion = iota
+	sectionAnswer
+	sectionAuthority
+	sectionAdditional
+)
+
+// entry is a question or resource record of a message. Questions have no
+// TTL or data.
+type entry struct {
+	section int
+	name    []byte // Uncompressed wire format, valid until the next call to message.next.
+	typ     uint16
+	class   uint16
+	ttl     uint32
+	data    []byte
+	dataOff int // Offset of data in the message, for reading compressed names in it.
+}
+
+// message walks the entries of a DNS message without allocating.
+type message struct {
+	msg     []byte
+	id      uint16
+	flags   uint16
+	counts  [4]int
+	section int
+	off     int
+	// questionsEnd is the offset just past the question section, once
+	// the questions have been read.
+	questionsEnd int
+	namebuf      [maxNameLen]byte
+}
+
+func (m *message) reset(msg []byte) error {
+	if len(msg) < headerLen {
+		return errMalformed
+	}
+	m.msg = msg
+	m.id = binary.BigEndian.Uint16(msg[0:])
+	m.flags = binary.BigEndian.Uint16(msg[2:])
+	for i := range m.counts {
+		m.counts[i] = int(binary.BigEndian.Uint16(msg[4+2*i:]))
+	}
+	m.section = sectionQuestion
+	m.off = headerLen
+	m.questionsEnd = headerLen
+	return nil
+}
+
+// next returns the next entry. ok is false once all entries are read.
+func (m *message) next() (e entry, ok bool, err error) {
+	for m.section < len(m.counts) && m.counts[m.section] == 0 {
+		m.section++
+		if m.section == sectionAnswer {
+			m.questionsEnd = m.off
+		}
+	}
+	if m.section == len(m.counts) {
+		return e, false, nil
+	}
+	m.counts[m.section]--
+	e.section = m.section
+	e.name, m.off, err = readName(m.namebuf[:0], m.msg, m.off)
+	if err != nil {
+		return e, false, err
+	}
+	fixed := 4
+	if e.section != sectionQuestion {
+		fixed = 10
+	}
+	if m.off+fixed > len(m.msg) {
+		return e, false, errMalformed
+	}
+	b := m.msg[m.off:]
+	e.typ = binary.BigEndian.Uint16(b[0:])
+	e.class = binary.BigEndian.Uint16(b[2:])
+	m.off += fixed
+	if e.section == sectionQuestion {
+		return e, true, nil
+	}
+	e.ttl = binary.BigEndian.Uint32(b[4:])
+	dlen := int(binary.BigEndian.Uint16(b[8:]))
+	if m.off+dlen > len(m.msg) {
+		return e, false, errMalformed
+	}
+	e.dataOff = m.off
+	e.data = m.msg[m.off : m.off+dlen]
+	m.off += dlen
+	return e, true, nil
+}
+
+// readName appends the possibly compressed name at msg[off:] to dst in
+// uncompressed wire format. It returns the offset just past the name.
+func readName(dst, msg []byte, off int) (name []byte, next int, err error) {
+	const maxPointers = 16
+	next = -1
+	for ptrs := 0; ; {
+		if off >= len(msg) {
+			return dst, 0, errMalformed
+		}
+		c := int(msg[off])
+		switch c & 0xc0 {
+		case 0x00:
+			if len(dst)+1+c > maxNameLen {
+				return dst, 0, errMalformed
+			}
+			if c == 0 {
+				dst = append(dst, 0)
+				if next < 0 {
+					next = off + 1
+				}
+				return dst, next, nil
+			}
+			if off+1+c > len(msg) {
+				return dst, 0, errMalformed
+			}
+			dst = append(dst, msg[off:off+1+c]...)
+			off += 1 + c
+		case 0xc0:
+			if off+2 > len(msg) || ptrs == maxPointers {
+				return dst, 0, errMalformed
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			ptrs++
+		default:
+			return dst, 0, errMalformed
+		}
+	}
+}
+
+// appendLabel appends a single label, which may contain dots.
+func appendLabel(dst []byte, label string) ([]byte, error) {
+	if len(label) == 0 || len(label) > 63 {
+		return dst, errBadName
+	}
+	dst = append(dst, byte(len(label)))
+	return append(dst, label...), nil
+}
+
+// appendName appends the dotted name in wire format.
+func appendName(dst []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	for name != "" {
+		label, rest, _ := strings.Cut(name, ".")
+		var err error
+		dst, err = appendLabel(dst, label)
+		if err != nil {
+			return dst, err
+		}
+		name = rest
+	}
+	return append(dst, 0), nil
+}
+
+// appendDotted appends the wire format name as dotted text, without the
+// trailing dot.
+func appendDotted(dst, name []byte) []byte {
+	for i := 0; len(name) > 0 && name[0] != 0; i++ {
+		n := int(name[0])
+		if i > 0 {
+			dst = append(dst, '.')
+		}
+		dst = append(dst, name[1:1+n]...)
+		name = name[1+n:]
+	}
+	return dst
+}
+
+// nameEqual reports whether two uncompressed wire format names are equal.
+// DNS names compare ASCII case-insensitively; length bytes are below 64 so
+// they never fold.
+func nameEqual(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if lower(a[i]) != lower(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func lower(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// appendRecordHeader appends a resource record header for name. The data
+// length is patched by endRecord.
+func appendRecordHeader(dst, name []byte, typ, class uint16, ttl uint32) ([]byte, int) {
+	dst = append(dst, name...)
+	dst = binary.BigEndian.AppendUint16(dst, typ)
+	dst = binary.BigEndian.AppendUint16(dst, class)
+	dst = binary.BigEndian.AppendUint32(dst, ttl)
+	dst = append(dst, 0, 0)
+	return dst, len(dst)
+}
+
+// endRecord sets the data length of the record whose data starts at dataStart.
+func endRecord(dst []byte, dataStart int) {
+	binary.BigEndian.PutUint16(dst[dataStart-2:], uint16(len(dst)-dataStart))
+}
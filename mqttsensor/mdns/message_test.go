@@ -0,0 +1,201 @@
+package mdns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testHeader returns a message header with the given section counts.
+func testHeader(counts ...uint16) []byte {
+	msg := make([]byte, headerLen)
+	for i, c := range counts {
+		binary.BigEndian.PutUint16(msg[4+2*i:], c)
+	}
+	return msg
+}
+
+// testName returns the wire format of a name whose labels have the given
+// lengths.
+func testName(labels ...int) []byte {
+	var name []byte
+	for _, l := range labels {
+		name = append(name, byte(l))
+		name = append(name, strings.Repeat("a", l)...)
+	}
+	return append(name, 0)
+}
+
+func TestReadName(t *testing.T) {
+	hdr := testHeader()
+	plain := slices.Concat(hdr, []byte("\x04host\x05local\x00"))
+	tests := []struct {
+		name     string
+		msg      []byte
+		off      int
+		want     string
+		wantNext int
+	}{
+		{"plain", plain, headerLen, "host.local", headerLen + 12},
+		{"root", append(hdr, 0), headerLen, "", headerLen + 1},
+		{"pointer", slices.Concat(plain, []byte("\x03www\xc0\x0c")), headerLen + 12, "www.host.local", headerLen + 18},
+		{"pointer only", slices.Concat(plain, []byte{0xc0, 0x0c}), headerLen + 12, "host.local", headerLen + 14},
+		{"pointer chain", slices.Concat(plain, []byte("\x01a\xc0\x0c\x01b\xc0\x18")), headerLen + 16, "b.a.host.local", headerLen + 20},
+		{"255 bytes", append(hdr, testName(63, 63, 63, 61)...), headerLen,
+			strings.Repeat(strings.Repeat("a", 63)+".", 3) + strings.Repeat("a", 61), headerLen + 255},
+	}
+	for _, tt := range tests {
+		name, next, err := readName(nil, tt.msg, tt.off)
+		if err != nil {
+			t.Errorf("%s: readName: %v", tt.name, err)
+			continue
+		}
+		if got := string(appendDotted(nil, name)); got != tt.want || next != tt.wantNext {
+			t.Errorf("%s: readName = %q, %d, want %q, %d", tt.name, got, next, tt.want, tt.wantNext)
+		}
+	}
+}
+
+func TestReadNameMalformed(t *testing.T) {
+	hdr := testHeader()
+	long := slices.Concat(hdr, testName(63, 63))
+	tests := []struct {
+		name string
+		msg  []byte
+		off  int // Of the name, headerLen if zero.
+	}{
+		{"empty", hdr, 0},
+		{"label past end", append(hdr, "\x05loc"...), 0},
+		{"no root", append(hdr, "\x04host"...), 0},
+		{"pointer cut short", append(hdr, 0xc0), 0},
+		{"pointer past end", append(hdr, 0xc0, 0xff), 0},
+		{"pointer to itself", append(hdr, 0xc0, 0x0c), 0},
+		{"pointer loop", append(hdr, "\x01a\xc0\x10\x01b\xc0\x0c"...), 0},
+		{"reserved label type", append(hdr, 0x40, 0), 0},
+		{"extended label type", append(hdr, 0x80, 0), 0},
+		{"256 bytes", append(hdr, testName(63, 63, 63, 62)...), 0},
+		// Each part fits, but the name they add up to doesn't.
+		{"256 bytes through pointer", slices.Concat(long, testName(63, 62)[:127], []byte{0xc0, 0x0c}), len(long)},
+	}
+	for _, tt := range tests {
+		if tt.off == 0 {
+			tt.off = headerLen
+		}
+		name, _, err := readName(nil, tt.msg, tt.off)
+		if err == nil {
+			t.Errorf("%s: readName = %q, want error", tt.name, appendDotted(nil, name))
+		}
+	}
+}
+
+func TestMessageNext(t *testing.T) {
+	msg := testHeader(1, 1)
+	msg = append(msg, "\x04host\x05local\x00"...)
+	msg = binary.BigEndian.AppendUint16(msg, typeA)
+	msg = binary.BigEndian.AppendUint16(msg, classIN|classTopBit)
+	msg, start := appendRecordHeader(msg, []byte{0xc0, 0x0c}, typeA, classIN, 120)
+	msg = append(msg, 192, 168, 1, 10)
+	endRecord(msg, start)
+
+	var m message
+	if err := m.reset(msg); err != nil {
+		t.Fatal(err)
+	}
+	q, ok, err := m.next()
+	if err != nil || !ok || q.section != sectionQuestion || q.typ != typeA || q.class != classIN|classTopBit {
+		t.Fatalf("question = %+v, %v, %v", q, ok, err)
+	}
+	a, ok, err := m.next()
+	if err != nil || !ok || a.section != sectionAnswer || a.ttl != 120 || !bytes.Equal(a.data, []byte{192, 168, 1, 10}) {
+		t.Fatalf("answer = %+v, %v, %v", a, ok, err)
+	}
+	if got := string(appendDotted(nil, a.name)); got != "host.local" {
+		t.Errorf("answer name = %q, want host.local", got)
+	}
+	if _, ok, err = m.next(); ok || err != nil {
+		t.Errorf("next after last entry = %v, %v, want false, nil", ok, err)
+	}
+}
+
+func TestMessageNextMalformed(t *testing.T) {
+	name := []byte("\x04host\x05local\x00")
+	record := func(counts ...uint16) []byte {
+		msg := append(testHeader(counts...), name...)
+		msg, start := appendRecordHeader(msg, nil, typeA, classIN, 120)
+		msg = append(msg, 192, 168, 1, 10)
+		endRecord(msg, start)
+		return msg
+	}
+	full := record(0, 1)
+	tests := []struct {
+		name string
+		msg  []byte
+	}{
+		{"missing question", testHeader(1)},
+		{"question cut short", slices.Concat(testHeader(1), name, []byte{0, typeA, 0})},
+		{"record name cut short", full[:headerLen+5]},
+		{"record cut mid-header", full[:headerLen+len(name)+5]},
+		{"record without data length", full[:headerLen+len(name)+8]},
+		{"data past end", full[:len(full)-1]},
+		{"more records than sent", record(0, 2)},
+		{"pointer loop", append(testHeader(0, 1), 0xc0, 0x0c, 0, typeA, 0, classIN, 0, 0, 0, 0, 0, 0)},
+		{"name over 255 bytes", append(testHeader(1), append(testName(63, 63, 63, 62), 0, typeA, 0, classIN)...)},
+	}
+	for _, tt := range tests {
+		var m message
+		if err := m.reset(tt.msg); err != nil {
+			t.Errorf("%s: reset: %v", tt.name, err)
+			continue
+		}
+		var err error
+		for ok := true; ok && err == nil; {
+			_, ok, err = m.next()
+		}
+		if err == nil {
+			t.Errorf("%s: read every entry, want error", tt.name)
+		}
+	}
+
+	var m message
+	if err := m.reset(full[:headerLen-1]); err == nil {
+		t.Error("reset of a short header succeeded, want error")
+	}
+}
+
+func FuzzMessage(f *testing.F) {
+	msg := append(testHeader(1, 1), "\x04host\x05local\x00\x00\x01\x80\x01"...)
+	msg, start := appendRecordHeader(msg, []byte{0xc0, 0x0c}, typePTR, classIN, 120)
+	msg = append(msg, "\x03www\xc0\x0c"...)
+	endRecord(msg, start)
+	f.Add(msg)
+	f.Add(append(testHeader(0, 1), 0xc0, 0x0c))
+	f.Add(append(testHeader(1), testName(63, 63, 63, 62)...))
+
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		var m message
+		if m.reset(msg) != nil {
+			return
+		}
+		// Each entry takes at least 5 bytes, so a message has fewer
+		// entries than bytes.
+		for range len(msg) {
+			e, ok, err := m.next()
+			if err != nil || !ok {
+				return
+			}
+			if len(e.name) > maxNameLen {
+				t.Fatalf("name of %d bytes", len(e.name))
+			}
+			appendDotted(nil, e.name)
+			if e.typ == typePTR {
+				name, _, err := readName(nil, msg, e.dataOff)
+				if err == nil && len(name) > maxNameLen {
+					t.Fatalf("PTR name of %d bytes", len(name))
+				}
+			}
+		}
+		t.Fatal("more entries than bytes")
+	})
+}
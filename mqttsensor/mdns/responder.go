@@ -0,0 +1,417 @@
+// Package mdns implements Multicast DNS (RFC 6762) and DNS-Based Service
+// Discovery (RFC 6763) on the cyw43439 stack, so the device can be reached
+// as <hostname>.local and its services browsed without a DNS server.
+//
+// The responder is experimental until verified on hardware: it relies on
+// the WiFi chip passing up frames sent to the mDNS group once it is in the
+// chip's multicast filter (see [cyw43439.Stack.JoinMulticast]).
+//
+// The responder answers for a single host name and a few services. It does
+// not probe for conflicting names before announcing them; a conflict is
+// logged, and renaming is left to whoever configures the device.
+// [Browse] finds services advertised by other hosts.
+package mdns
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/harveysanders/picoplayground/mqttsensor/cyw43439"
+)
+
+// Port is the mDNS UDP port.
+const Port = 5353
+
+var (
+	// GroupAddr is the IPv4 mDNS multicast group.
+	GroupAddr = netip.AddrFrom4([4]byte{224, 0, 0, 251})
+	groupHW   = [6]byte{0x01, 0x00, 0x5e, 0x00, 0x00, 0xfb}
+	group     = netip.AddrPortFrom(GroupAddr, Port)
+)
+
+const (
+	// maxServices bounds the services a responder advertises.
+	maxServices = 4
+	// legacyTTL caps TTLs in replies to one-shot queriers, which are
+	// ordinary DNS resolvers (RFC 6762 section 6.7).
+	legacyTTL = 10
+)
+
+// Service is a DNS-SD service instance.
+type Service struct {
+	// Instance is the user-visible instance name. Defaults to the host name.
+	Instance string
+	// Type is the service type and protocol, e.g. "_http._tcp".
+	Type string
+	Port uint16
+	// TXT holds "key=value" strings describing the instance.
+	TXT []string
+}
+
+// Config configures a [Responder].
+type Config struct {
+	// Hostname is answered for as Hostname.local.
+	Hostname string
+	// Services to advertise. At most 4.
+	Services []Service
+	// TTL of the records. Defaults to 120 seconds, as RFC 6762 recommends
+	// for records with host names.
+	TTL time.Duration
+	// Logger for responder operations.
+	Logger *slog.Logger
+}
+
+// service holds the wire format names and data of a Service.
+type service struct {
+	typ      []byte // <type>.local
+	instance []byte // <instance>.<type>.local
+	port     uint16
+	txt      []byte
+}
+
+// Records of a responder are numbered for the answer sets: the host's A
+// record, then serviceRecs per service.
+const (
+	recA = iota
+	recFirstService
+)
+
+const (
+	recPTR      = iota // <type>.local PTR <instance>.<type>.local
+	recSRV             // <instance>.<type>.local SRV 0 0 <port> <host>.local
+	recTXT             // <instance>.<type>.local TXT
+	recEnumPTR         // _services._dns-sd._udp.local PTR <type>.local
+	serviceRecs        // Number of records per service.
+)
+
+// recordSet is a set of record numbers.
+type recordSet uint32
+
+// Responder answers mDNS queries for a host name and its services.
+type Responder struct {
+	stack    *cyw43439.Stack
+	log      *slog.Logger
+	ttl      uint32
+	host     []byte // <hostname>.local
+	enum     []byte // _services._dns-sd._udp.local
+	services []service
+
+	mu  sync.Mutex // Guards the buffers, used by the handler and Announce.
+	msg message
+	out []byte
+}
+
+// NewResponder starts answering mDNS queries received by stack.
+func NewResponder(stack *cyw43439.Stack, cfg Config) (*Responder, error) {
+	if len(cfg.Services) > maxServices {
+		return nil, errors.New("mdns: too many services")
+	}
+	ttl := cfg.TTL
+	if ttl <= 0 {
+		ttl = 120 * time.Second
+	}
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.Level(127)}))
+	}
+	r := &Responder{
+		stack: stack,
+		log:   logger,
+		ttl:   uint32(ttl / time.Second),
+		out:   make([]byte, 0, cyw43439.MaxUDPPayload),
+	}
+	var err error
+	r.host, err = appendName(nil, cfg.Hostname+".local")
+	if err != nil {
+		return nil, errors.New("mdns: host name " + cfg.Hostname + ": " + err.Error())
+	}
+	r.enum, _ = appendName(nil, "_services._dns-sd._udp.local")
+	for _, svc := range cfg.Services {
+		var s service
+		s.typ, err = appendName(nil, svc.Type+".local")
+		if err == nil {
+			instance := svc.Instance
+			if instance == "" {
+				instance = cfg.Hostname
+			}
+			s.instance, err = appendLabel(nil, instance)
+			s.instance = append(s.instance, s.typ...)
+		}
+		if err != nil {
+			return nil, errors.New("mdns: service " + svc.Type + ": " + err.Error())
+		}
+		s.port = svc.Port
+		for _, kv := range svc.TXT {
+			if len(kv) > 255 {
+				return nil, errors.New("mdns: TXT entry too long")
+			}
+			s.txt = append(s.txt, byte(len(kv)))
+			s.txt = append(s.txt, kv...)
+		}
+		if len(s.txt) == 0 {
+			s.txt = []byte{0} // An empty TXT record holds one empty string.
+		}
+		r.services = append(r.services, s)
+	}
+
+	err = stack.JoinMulticast(GroupAddr)
+	if err != nil {
+		// Announcements still go out; queries are only heard if the
+		// firmware passes the group's frames anyway.
+		logger.Warn("mdns:join-group", slog.String("err", err.Error()))
+	}
+	err = stack.HandleUDP(Port, r.handle)
+	if err != nil {
+		return nil, errors.New("mdns: " + err.Error())
+	}
+	return r, nil
+}
+
+// Announce multicasts all records so caches on the network pick up the
+// current address. Call it once the address is known and whenever it
+// changes. As RFC 6762 section 8.3 asks it sends the announcement twice,
+// a second apart, blocking in between.
+func (r *Responder) Announce() error {
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			time.Sleep(time.Second)
+		}
+		r.mu.Lock()
+		all := recordSet(1<<(recFirstService+serviceRecs*len(r.services)) - 1)
+		resp := r.appendResponse(r.out[:0], 0, nil, all, r.stack.Addr(), false)
+		err := r.stack.SendUDPTo(groupHW, Port, group, resp)
+		r.mu.Unlock()
+		if err != nil {
+			return errors.New("mdns: announce: " + err.Error())
+		}
+	}
+	r.log.Info("mdns:announced", slog.String("host", string(appendDotted(nil, r.host))))
+	return nil
+}
+
+// handle answers queries and watches responses for conflicts. It runs on
+// the packet processing goroutine.
+func (r *Responder) handle(pkt *cyw43439.UDPPacket) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m := &r.msg
+	if m.reset(pkt.Payload) != nil || m.flags&opcodeMask != 0 {
+		return true
+	}
+	if m.flags&flagResponse != 0 {
+		r.checkConflict(m)
+		return true
+	}
+
+	var answer recordSet
+	unicast := false
+	for {
+		e, ok, err := m.next()
+		if err != nil || !ok {
+			break
+		}
+		switch e.section {
+		case sectionQuestion:
+			if class := e.class &^ classTopBit; class != classIN && class != classANY {
+				continue
+			}
+			matched := r.match(e.name, e.typ)
+			if matched != 0 && e.class&classTopBit != 0 {
+				unicast = true
+			}
+			answer |= matched
+		case sectionAnswer:
+			// Known-answer suppression (RFC 6762 section 7.1): skip
+			// shared records the querier already has with at least half
+			// their TTL left.
+			if e.typ == typePTR && e.ttl >= r.ttl/2 {
+				answer &^= r.knownPTR(m, e)
+			}
+		}
+	}
+	if answer == 0 {
+		return true
+	}
+
+	legacy := pkt.Src.Port() != Port
+	var id uint16
+	var query []byte
+	if legacy {
+		// One-shot queriers expect an ordinary DNS reply: their ID and
+		// questions echoed back, sent to their port.
+		id = m.id
+		query = pkt.Payload[:m.questionsEnd]
+	}
+	resp := r.appendResponse(r.out[:0], id, query, answer, r.stack.Addr(), legacy)
+
+	var err error
+	if legacy || unicast {
+		err = r.stack.SendUDPTo(pkt.SrcHW, Port, pkt.Src, resp)
+	} else {
+		err = r.stack.SendUDPTo(groupHW, Port, group, resp)
+	}
+	if err != nil {
+		r.log.Error("mdns:reply", slog.String("err", err.Error()))
+	}
+	return true
+}
+
+// match returns the records answering a question for name and qtype.
+func (r *Responder) match(name []byte, qtype uint16) recordSet {
+	wants := func(typ uint16) bool { return qtype == typ || qtype == typeANY }
+	var set recordSet
+	if wants(typeA) && nameEqual(name, r.host) {
+		set |= 1 << recA
+	}
+	for i, s := range r.services {
+		base := recFirstService + serviceRecs*i
+		switch {
+		case nameEqual(name, s.typ) && wants(typePTR):
+			set |= 1 << (base + recPTR)
+		case nameEqual(name, r.enum) && wants(typePTR):
+			set |= 1 << (base + recEnumPTR)
+		case nameEqual(name, s.instance):
+			if wants(typeSRV) {
+				set |= 1 << (base + recSRV)
+			}
+			if wants(typeTXT) {
+				set |= 1 << (base + recTXT)
+			}
+		}
+	}
+	return set
+}
+
+// knownPTR returns our PTR records matching the known answer e.
+func (r *Responder) knownPTR(m *message, e entry) recordSet {
+	var target [maxNameLen]byte
+	t, _, err := readName(target[:0], m.msg, e.dataOff)
+	if err != nil {
+		return 0
+	}
+	var set recordSet
+	for i, s := range r.services {
+		base := recFirstService + serviceRecs*i
+		if nameEqual(e.name, s.typ) && nameEqual(t, s.instance) {
+			set |= 1 << (base + recPTR)
+		} else if nameEqual(e.name, r.enum) && nameEqual(t, s.typ) {
+			set |= 1 << (base + recEnumPTR)
+		}
+	}
+	return set
+}
+
+// checkConflict logs responses claiming our host name for another address.
+func (r *Responder) checkConflict(m *message) {
+	addr := r.stack.Addr()
+	for {
+		e, ok, err := m.next()
+		if err != nil || !ok {
+			return
+		}
+		if e.section == sectionQuestion || e.typ != typeA || len(e.data) != 4 || !nameEqual(e.name, r.host) {
+			continue
+		}
+		if other := netip.AddrFrom4([4]byte(e.data)); other != addr {
+			r.log.Warn("mdns:name-conflict", slog.String("host", string(appendDotted(nil, r.host))), slog.String("other", other.String()))
+		}
+	}
+}
+
+// appendResponse appends a response holding the answer records, with the
+// records they reference as additionals. query, if set, is the header and
+// questions of the query being answered; its questions are copied.
+func (r *Responder) appendResponse(dst []byte, id uint16, query []byte, answer recordSet, addr netip.Addr, legacy bool) []byte {
+	var additional recordSet
+	for i := range r.services {
+		base := recFirstService + serviceRecs*i
+		if answer&(1<<(base+recPTR)) != 0 {
+			additional |= 1<<(base+recSRV) | 1<<(base+recTXT)
+		}
+		if answer&(1<<(base+recPTR)|1<<(base+recSRV)) != 0 {
+			additional |= 1 << recA
+		}
+	}
+	if !addr.Is4() {
+		answer &^= 1 << recA // No address to announce yet.
+		additional &^= 1 << recA
+	}
+	additional &^= answer
+
+	start := len(dst)
+	dst = binary.BigEndian.AppendUint16(dst, id)
+	dst = binary.BigEndian.AppendUint16(dst, flagResponse|flagAA)
+	var nq uint16
+	if len(query) > headerLen {
+		nq = binary.BigEndian.Uint16(query[4:])
+	}
+	dst = binary.BigEndian.AppendUint16(dst, nq)
+	dst = binary.BigEndian.AppendUint16(dst, 0) // Answers, set below.
+	dst = binary.BigEndian.AppendUint16(dst, 0)
+	dst = binary.BigEndian.AppendUint16(dst, 0) // Additionals, set below.
+	if nq > 0 {
+		// Compression pointers in the questions stay valid since they
+		// sit at the same offsets.
+		dst = append(dst, query[headerLen:]...)
+	}
+	var counts [2]uint16
+	for sec, set := range [2]recordSet{answer, additional} {
+		for rec := 0; set>>rec != 0; rec++ {
+			if set&(1<<rec) != 0 {
+				dst = r.appendRecord(dst, rec, addr, legacy)
+				counts[sec]++
+			}
+		}
+	}
+	binary.BigEndian.PutUint16(dst[start+6:], counts[0])
+	binary.BigEndian.PutUint16(dst[start+10:], counts[1])
+	return dst
+}
+
+// appendRecord appends record number rec.
+func (r *Responder) appendRecord(dst []byte, rec int, addr netip.Addr, legacy bool) []byte {
+	ttl := r.ttl
+	if legacy {
+		ttl = min(ttl, legacyTTL)
+	}
+	// Records only we answer for are unique and tell caches to flush
+	// older copies, except in legacy replies (RFC 6762 section 10.2).
+	unique := uint16(classIN | classTopBit)
+	if legacy {
+		unique = classIN
+	}
+	if rec == recA {
+		dst, start := appendRecordHeader(dst, r.host, typeA, unique, ttl)
+		a4 := addr.As4()
+		dst = append(dst, a4[:]...)
+		endRecord(dst, start)
+		return dst
+	}
+
+	s := &r.services[(rec-recFirstService)/serviceRecs]
+	var start int
+	switch (rec - recFirstService) % serviceRecs {
+	case recPTR:
+		dst, start = appendRecordHeader(dst, s.typ, typePTR, classIN, ttl)
+		dst = append(dst, s.instance...)
+	case recSRV:
+		dst, start = appendRecordHeader(dst, s.instance, typeSRV, unique, ttl)
+		dst = binary.BigEndian.AppendUint16(dst, 0) // Priority.
+		dst = binary.BigEndian.AppendUint16(dst, 0) // Weight.
+		dst = binary.BigEndian.AppendUint16(dst, s.port)
+		dst = append(dst, r.host...)
+	case recTXT:
+		dst, start = appendRecordHeader(dst, s.instance, typeTXT, unique, ttl)
+		dst = append(dst, s.txt...)
+	case recEnumPTR:
+		dst, start = appendRecordHeader(dst, r.enum, typePTR, classIN, ttl)
+		dst = append(dst, s.typ...)
+	}
+	endRecord(dst, start)
+	return dst
+}
@@ -7,6 +7,7 @@ import (
 	"log/slog"
 	"net/netip"
 	"runtime"
+	"sync/atomic"
 	"time"
 
 	"github.com/harveysanders/picoplayground/mqttsensor/cyw43439"
@@ -15,10 +16,14 @@ import (
 	mqtt "github.com/soypat/natiu-mqtt"
 )
 
+// sensorTopic is the topic readings are published to, below the broker
+// URL's topic prefix.
+const sensorTopic = "tests/43"
+
 var (
 	pubFlags, _ = mqtt.NewPublishFlags(mqtt.QoS0, false, false)
 	pubVar      = mqtt.VariablesPublish{
-		TopicName:        []byte("tests/43"),
+		TopicName:        []byte(sensorTopic),
 		PacketIdentifier: 0xc0fe,
 	}
 )
@@ -29,7 +34,11 @@ type SensorReading struct {
 	Temperature float32       // Temperature from DHT11
 	Humidity    float32       // Relative humidity percentage from DHT11
 	SinceBootNS time.Duration // Nanoseconds since boot.
-	Timestamp   time.Time     // Wall-clock time. Zero if NTP sync failed.
+	Timestamp   time.Time     // Wall-clock time. Zero if the clock was never set.
+	// TimestampDerived is set if the reading was taken before the clock
+	// was set, and Timestamp was reconstructed from SinceBootNS once it
+	// was, by the Client's Backfill.
+	TimestampDerived bool `json:",omitempty"`
 }
 
 type Client struct {
@@ -41,28 +50,86 @@ type Client struct {
 	TimeSyncedAt      time.Time // When NTP sync occurred. Zero if never synced.
 	Username          string    // MQTT broker username (optional)
 	Password          string    // MQTT broker password (optional, requires Username)
+	// LinkEvents optionally receives WiFi link transitions from a
+	// cyw43439.Supervisor. While the link is down the client drops its
+	// connection and waits for the link to come back before redialing.
+	// A change of address, e.g. after a DHCP NAK, also drops the
+	// connection since it is bound to the old address.
+	LinkEvents <-chan cyw43439.LinkEvent
+	// Backfill, if set, is called with each reading before it is
+	// published, to timestamp readings buffered since before the clock
+	// was set.
+	Backfill func(*SensorReading)
+
+	connected atomic.Bool
+	pingRTT   atomic.Int64
+	timeTopic TimeTopic
+}
+
+// Connected reports whether the client currently has an MQTT session with
+// the broker. It is safe to call from other goroutines.
+func (c *Client) Connected() bool {
+	return c.connected.Load()
+}
+
+// TimeTopic returns the time published by the backend, a fallback time
+// source. It is safe to use from other goroutines.
+func (c *Client) TimeTopic() *TimeTopic {
+	return &c.timeTopic
+}
+
+// PingRTT returns the round-trip time of the last keepalive ping to the
+// broker, or zero before the first. It is safe to call from other
+// goroutines.
+func (c *Client) PingRTT() time.Duration {
+	return time.Duration(c.pingRTT.Load())
+}
+
+// notifyConn wakes the stack's packet loop after each write, so data goes
+// out without waiting for the next poll.
+type notifyConn struct {
+	io.ReadWriteCloser
+	stack *cyw43439.Stack
+}
+
+func (nc notifyConn) Write(b []byte) (int, error) {
+	n, err := nc.ReadWriteCloser.Write(b)
+	nc.stack.Notify()
+	return n, err
 }
 
 // ConnectAndPublish connects to the MQTT broker and publishes sensor readings.
 // The stack is provided from main.go where WiFi/DHCP/NTP are set up.
+// brokerURL is parsed with [ParseBrokerURL]; credentials in the URL take
+// precedence over the Client's Username and Password. If brokerURL is empty
+// a broker advertised over mDNS is used, see [DiscoverBroker].
 func (c *Client) ConnectAndPublish(
 	stack *cyw43439.Stack,
-	addr string,
+	brokerURL string,
 	readings <-chan SensorReading,
 	lcdMessages chan<- lcd.Message,
 ) error {
 	const pollTime = 5 * time.Millisecond
 
-	c.Logger.Info("MQTT address: " + addr)
-
-	// Parse hostname and port from addr (e.g., "hostname:8883")
-	mqttHost, portStr, err := splitHostPort(addr)
+	if brokerURL == "" {
+		brokerURL = c.discoverBroker(stack, lcdMessages)
+	}
+	broker, err := ParseBrokerURL(brokerURL)
 	if err != nil {
-		return errors.New("parsing host:port from " + addr + ": " + err.Error())
+		return err
+	}
+	if broker.Transport != TransportTCP && broker.Transport != TransportWS {
+		// The network stack has no TLS.
+		return errors.New(broker.Transport.String() + " transport not supported, use tcp:// or ws://")
 	}
+	addr := broker.HostPort()
+	mqttHost := broker.Host
+	c.Logger.Info("MQTT address: "+addr, slog.String("transport", broker.Transport.String()))
+
+	pubVar.TopicName = []byte(broker.Topic(sensorTopic))
 
 	lnetoStack := stack.LnetoStack()
-	rstack := lnetoStack.StackRetrying(pollTime)
+	rstack := lnetoStack.StackRetrying(func(uint) time.Duration { return pollTime })
 
 	// Try to parse as IP first, otherwise DNS lookup
 	var mqttAddr netip.Addr
@@ -71,34 +138,43 @@ func (c *Client) ConnectAndPublish(
 	} else {
 		// DNS lookup for MQTT server
 		c.Logger.Info("dns:resolving " + mqttHost)
-		addrs, err := rstack.DoLookupIP(mqttHost, 5*time.Second, 3)
+		addrs, err := stack.LookupIP(mqttHost, 5*time.Second, 3)
 		if err != nil {
-			return errors.New("dns lookup for " + mqttHost + ": " + err.Error())
+			// Brokers with only AAAA records are dialed over IPv6.
+			addrs6, err6 := stack.LookupIP6(mqttHost, 5*time.Second, 1)
+			if err6 != nil {
+				return errors.New("dns lookup for " + mqttHost + ": " + err.Error())
+			}
+			addrs = addrs6
 		}
 		if len(addrs) == 0 {
 			return errors.New("dns lookup for " + mqttHost + ": no addresses returned")
 		}
 		mqttAddr = addrs[0]
 	}
-
+	mqttAddr = mqttAddr.Unmap().WithZone("") // The stack has one interface.
 	c.Logger.Info("resolved IP: " + mqttAddr.String())
-	port := parsePort(portStr)
 
+	timeTopicName := broker.Topic(timeTopic)
 	cfg := mqtt.ClientConfig{
 		Decoder: mqtt.DecoderNoAlloc{UserBuffer: make([]byte, 4096)},
-		OnPub: func(pubHead mqtt.Header, varPub mqtt.VariablesPublish, r io.Reader) error {
-			c.Logger.Info("received message", slog.String("topic", string(varPub.TopicName)))
-			return nil
-		},
+		OnPub:   c.onPublish(timeTopicName),
+	}
+	subVar := mqtt.VariablesSubscribe{
+		TopicFilters: []mqtt.SubscribeRequest{{TopicFilter: []byte(timeTopicName), QoS: mqtt.QoS0}},
 	}
 	var varconn mqtt.VariablesConnect
 	varconn.SetDefaultMQTT([]byte(c.ID))
 
 	// Set authentication credentials if provided
-	if c.Username != "" {
-		varconn.Username = []byte(c.Username)
-		if c.Password != "" {
-			varconn.Password = []byte(c.Password)
+	username, password := c.Username, c.Password
+	if broker.Username != "" {
+		username, password = broker.Username, broker.Password
+	}
+	if username != "" {
+		varconn.Username = []byte(username)
+		if password != "" {
+			varconn.Password = []byte(password)
 		}
 	}
 
@@ -125,18 +201,46 @@ func (c *Client) ConnectAndPublish(
 		conn.Abort()
 	}
 
-	serverAddr := netip.AddrPortFrom(mqttAddr, port)
+	serverAddr := netip.AddrPortFrom(mqttAddr, broker.Port)
+
+	// transport is what the MQTT client reads and writes: the TCP
+	// connection itself, or a WebSocket framing layer on top of it. Both
+	// are reused for every dial; the WebSocket handshake starts afresh.
+	var transport io.ReadWriteCloser = notifyConn{&conn, stack}
+	var ws *wsConn
+	if broker.Transport == TransportWS {
+		ws, err = newWSConn(transport, lnetoStack.Prand32, make([]byte, c.TCPBufSize))
+		if err != nil {
+			return err
+		}
+		transport = ws
+	}
 
 	// Connection loop for TCP+MQTT.
+	linkUp := true
 	for {
+		linkUp = c.pollLinkState(linkUp)
+		if !linkUp {
+			lcd.Send(lcdMessages, "MQTT paused", "WiFi link down")
+			c.waitLinkUp()
+			linkUp = true
+		}
+
 		// Use stack's PRNG for random port
 		localPort := uint16(lnetoStack.Prand32()>>17) + 1024
 		c.Logger.Info("socket:dialing", slog.Uint64("localPort", uint64(localPort)))
 		lcd.Send(lcdMessages, "addr", addr)
 
 		// Dial TCP using the retrying stack (handles handshake with retries)
+		// or, since lneto only carries IPv4, the stack's own IPv6 path.
 		lcd.Send(lcdMessages, "Connecting...", "TCP handshake")
-		err = rstack.DoDialTCP(&conn, localPort, serverAddr, 10*time.Second, 3)
+		if mqttAddr.Is6() {
+			err = stack.DialTCP6(&conn, localPort, serverAddr, 10*time.Second, 3)
+		} else {
+			done := stack.PollFast()
+			err = rstack.DoDialTCP(&conn, localPort, serverAddr, 10*time.Second, 3)
+			done()
+		}
 		if err != nil {
 			c.Logger.Error("socket:dial-failed", slog.String("err", err.Error()))
 			closeConn("dial failed: " + err.Error())
@@ -146,11 +250,25 @@ func (c *Client) ConnectAndPublish(
 
 		c.Logger.Info("tcp:connected", slog.String("state", conn.State().String()))
 
+		if ws != nil {
+			lcd.Send(lcdMessages, "Connecting...", "WebSocket")
+			conn.SetDeadline(time.Now().Add(c.Timeout))
+			err = ws.Handshake(addr, broker.Path)
+			if err != nil {
+				c.Logger.Error("ws:handshake-failed", slog.String("reason", err.Error()))
+				lcd.Send(lcdMessages, "Connect Failed", "WS handshake")
+				closeConn("websocket handshake failed")
+				time.Sleep(2 * time.Second)
+				continue
+			}
+			c.Logger.Info("ws:connected", slog.String("path", broker.Path))
+		}
+
 		// We start MQTT connect with a deadline on the socket.
 		c.Logger.Info("mqtt:start-connecting")
 		lcd.Send(lcdMessages, "MQTT Connect", "Authenticating")
 		conn.SetDeadline(time.Now().Add(c.Timeout))
-		err = mqttClient.StartConnect(&conn, &varconn)
+		err = mqttClient.StartConnect(transport, &varconn)
 		if err != nil {
 			c.Logger.Error("mqtt:start-connect-failed", slog.String("reason", err.Error()))
 			lcd.Send(lcdMessages, "Connect Failed", err.Error()[:min(len(err.Error()), 16)])
@@ -174,12 +292,43 @@ func (c *Client) ConnectAndPublish(
 		}
 
 		lcd.Send(lcdMessages, "MQTT Connected", "Publishing...")
+		c.connected.Store(true)
+
+		conn.SetDeadline(time.Now().Add(c.Timeout))
+		subVar.PacketIdentifier = uint16(lnetoStack.Prand32())
+		err = mqttClient.StartSubscribe(subVar)
+		for err == nil && mqttClient.AwaitingSuback() {
+			err = mqttClient.HandleNext()
+		}
+		if err != nil {
+			// Publishing still works; only the time is lost.
+			c.Logger.Error("mqtt:subscribe-failed", slog.String("err", err.Error()))
+		}
 
+		// Stopped below rather than deferred, which would keep one pair
+		// of tickers running for every reconnect.
 		heartbeat := time.NewTicker(c.HeartbeatInterval)
-		defer heartbeat.Stop()
-		for mqttClient.IsConnected() {
+		// Incoming messages are otherwise only read when publishing or
+		// pinging, so check for the time regularly.
+		inbox := time.NewTicker(inboxDelay)
+		addrChanged := false
+		// Block until there is something to do, which leaves the CPU idle
+		// rather than spinning.
+		for linkUp && !addrChanged && mqttClient.IsConnected() {
 			select {
+			case ev := <-c.LinkEvents:
+				switch ev.State {
+				case cyw43439.LinkDown:
+					c.Logger.Error("mqtt:link-down")
+					linkUp = false
+				case cyw43439.LinkAddrChanged:
+					c.Logger.Error("mqtt:addr-changed", slog.String("ip", ev.Addr.String()))
+					addrChanged = true
+				}
 			case reading := <-readings:
+				if c.Backfill != nil {
+					c.Backfill(&reading)
+				}
 				payload, err := json.Marshal(reading)
 				if err != nil {
 					c.Logger.Error("mqtt:marshal-failed", slog.Any("reason", err))
@@ -200,68 +349,76 @@ func (c *Client) ConnectAndPublish(
 					c.Logger.Error("mqtt:handle-next-failed", slog.String("err", err.Error()))
 					continue
 				}
-			case <-heartbeat.C:
-				// If we haven't read any sensor readings from the channel since the last heartbeat interval,
-				// ping the MQTT broken to keep the connnection alive.
+			case <-inbox.C:
+				if conn.BufferedInput() == 0 {
+					continue
+				}
+				conn.SetDeadline(time.Now().Add(c.Timeout))
 				err = mqttClient.HandleNext()
 				if err != nil {
 					c.Logger.Error("mqtt:handle-next-failed", slog.String("err", err.Error()))
+				}
+			case <-heartbeat.C:
+				// Ping the broker to keep the connection alive, and time
+				// the round trip.
+				conn.SetDeadline(time.Now().Add(c.Timeout))
+				if ws != nil {
+					// Keep proxies from reaping the idle upgraded connection.
+					err = ws.Ping()
+					if err != nil {
+						c.Logger.Error("ws:ping-failed", slog.String("err", err.Error()))
+					}
+				}
+				start := time.Now()
+				err = mqttClient.StartPing()
+				for err == nil && mqttClient.AwaitingPingresp() {
+					err = mqttClient.HandleNext()
+				}
+				if err != nil {
+					c.Logger.Error("mqtt:ping-failed", slog.String("err", err.Error()))
 					continue
 				}
-			default:
-				// If we've got nothing to do, release the thread so other go routines can run.
-				// We only need to do this because TinyGo runs on a single core
-				// https://tinygo.org/docs/guides/tips-n-tricks/
-				runtime.Gosched()
+				rtt := time.Since(start)
+				c.pingRTT.Store(int64(rtt))
+				c.Logger.Info("mqtt:ping", slog.Duration("rtt", rtt))
 			}
-
 		}
+		heartbeat.Stop()
+		inbox.Stop()
 
+		c.connected.Store(false)
 		c.Logger.Error("mqtt:disconnected", slog.Any("reason", mqttClient.Err()))
 		lcd.Send(lcdMessages, "Disconnected", "Reconnecting...")
-		closeConn("disconnected")
+		if !linkUp || addrChanged {
+			// Connection state is stale; no point in a graceful close.
+			mqttClient.Disconnect(errors.New("link down or address changed"))
+			conn.Abort()
+		} else {
+			closeConn("disconnected")
+		}
 		runtime.Gosched()
 	}
 }
 
-// splitHostPort splits a host:port string into separate host and port components.
-// Returns an error if the format is invalid.
-func splitHostPort(addr string) (host, port string, err error) {
-	// Find the last colon to support IPv6 addresses
-	colonIdx := -1
-	for i := len(addr) - 1; i >= 0; i-- {
-		if addr[i] == ':' {
-			colonIdx = i
-			break
+// pollLinkState drains pending link events without blocking and returns
+// whether the link is up according to the latest one.
+func (c *Client) pollLinkState(up bool) bool {
+	for {
+		select {
+		case ev := <-c.LinkEvents:
+			up = ev.State != cyw43439.LinkDown
+		default:
+			return up
 		}
 	}
-
-	if colonIdx == -1 {
-		return "", "", errors.New("missing port in address")
-	}
-
-	host = addr[:colonIdx]
-	port = addr[colonIdx+1:]
-
-	if host == "" {
-		return "", "", errors.New("empty host")
-	}
-	if port == "" {
-		return "", "", errors.New("empty port")
-	}
-
-	return host, port, nil
 }
 
-// parsePort converts a port string to uint16.
-// Returns 0 if parsing fails (caller should validate).
-func parsePort(portStr string) uint16 {
-	var port uint16
-	for i := 0; i < len(portStr); i++ {
-		if portStr[i] < '0' || portStr[i] > '9' {
-			return 0
+// waitLinkUp blocks until a LinkUp event is received on c.LinkEvents.
+func (c *Client) waitLinkUp() {
+	for ev := range c.LinkEvents {
+		if ev.State == cyw43439.LinkUp {
+			c.Logger.Info("mqtt:link-up", slog.String("ip", ev.Addr.String()))
+			return
 		}
-		port = port*10 + uint16(portStr[i]-'0')
 	}
-	return port
 }
@@ -0,0 +1,112 @@
+package mqtt
+
+import (
+	"errors"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/harveysanders/picoplayground/mqttsensor/cyw43439"
+	"github.com/harveysanders/picoplayground/mqttsensor/lcd"
+	"github.com/harveysanders/picoplayground/mqttsensor/mdns"
+)
+
+// Service types brokers are advertised under with DNS-SD.
+const (
+	serviceMQTT       = "_mqtt._tcp"
+	serviceSecureMQTT = "_secure-mqtt._tcp"
+)
+
+var errNoBroker = errors.New("no broker advertised over mDNS")
+
+// DiscoverBroker looks for brokers advertised over mDNS and returns the URL
+// of the one to use. Plain brokers (_mqtt._tcp) are preferred over TLS ones
+// (_secure-mqtt._tcp); among either the choice follows the SRV priority and
+// weight rules of RFC 2782. The URL holds the broker's address rather than
+// its .local name, which the DNS resolver can't look up.
+func DiscoverBroker(stack *cyw43439.Stack, timeout time.Duration, logger *slog.Logger) (string, error) {
+	for _, st := range [...]struct {
+		service string
+		scheme  string
+	}{
+		{serviceMQTT, "mqtt"},
+		{serviceSecureMQTT, "mqtts"},
+	} {
+		found, err := mdns.Browse(stack, st.service, timeout)
+		if err != nil {
+			return "", err
+		}
+		// Only brokers with an address can be dialed.
+		usable := found[:0]
+		for _, e := range found {
+			logger.Info("mqtt:discovered", slog.String("instance", e.Instance),
+				slog.String("host", e.Host), slog.String("addr", e.Addr.String()), slog.Int("port", int(e.Port)))
+			if e.Addr.IsValid() && e.Port != 0 {
+				usable = append(usable, e)
+			}
+		}
+		if len(usable) == 0 {
+			continue
+		}
+		e := pickSRV(usable, stack.Prand32())
+		return st.scheme + "://" + e.Addr.String() + ":" + strconv.Itoa(int(e.Port)), nil
+	}
+	return "", errNoBroker
+}
+
+// pickSRV selects an entry as RFC 2782 describes: the lowest priority wins,
+// and among equals the choice is random, weighted by weight.
+func pickSRV(entries []mdns.ServiceEntry, rand uint32) mdns.ServiceEntry {
+	best := entries[0].Priority
+	for _, e := range entries[1:] {
+		best = min(best, e.Priority)
+	}
+	// Zero weights get a small chance, as the RFC asks, by counting them as 1
+	// against the others scaled by 100.
+	var total uint32
+	for _, e := range entries {
+		if e.Priority == best {
+			total += srvWeight(e)
+		}
+	}
+	n := rand % total
+	for _, e := range entries {
+		if e.Priority != best {
+			continue
+		}
+		w := srvWeight(e)
+		if n < w {
+			return e
+		}
+		n -= w
+	}
+	return entries[0] // Unreachable.
+}
+
+func srvWeight(e mdns.ServiceEntry) uint32 {
+	if e.Weight == 0 {
+		return 1
+	}
+	return 100 * uint32(e.Weight)
+}
+
+// discoverBroker browses for a broker until one is found and returns its URL.
+// Discovery is experimental; see [mdns.Browse].
+func (c *Client) discoverBroker(stack *cyw43439.Stack, lcdMessages chan<- lcd.Message) string {
+	const (
+		browseTimeout = 2 * time.Second
+		retryInterval = 10 * time.Second
+	)
+	c.Logger.Warn("mqtt:discover", slog.String("note", "mDNS broker discovery is experimental; set MQTT_ADDR to skip it"))
+	for {
+		lcd.Send(lcdMessages, "Finding broker", "via mDNS...")
+		url, err := DiscoverBroker(stack, browseTimeout, c.Logger)
+		if err == nil {
+			c.Logger.Info("mqtt:broker-discovered", slog.String("url", url))
+			return url
+		}
+		c.Logger.Error("mqtt:discover-failed", slog.String("reason", err.Error()))
+		lcd.Send(lcdMessages, "No broker found", "Retrying...")
+		time.Sleep(retryInterval)
+	}
+}
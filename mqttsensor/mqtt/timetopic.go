@@ -0,0 +1,123 @@
+package mqtt
+
+import (
+	"cmp"
+	"errors"
+	"io"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	mqtt "github.com/soypat/natiu-mqtt"
+)
+
+const (
+	// timeTopic is where the backend publishes the time, retained, for all
+	// devices under the broker's topic prefix.
+	timeTopic = "time"
+	// timePublishPeriod is how often the backend is expected to publish
+	// the time. A retained message may be up to this old when it arrives.
+	timePublishPeriod = time.Minute
+	// inboxDelay is how long a message may wait to be read, the period of
+	// the publish loop's inbox ticker.
+	inboxDelay = time.Second
+	// maxTimeMessage is the longest time payload accepted.
+	maxTimeMessage = 40
+	// maxClockDrift bounds how fast the local clock may have gained or
+	// lost time since a message was received, for extrapolating from it.
+	maxClockDrift = 100e-6
+)
+
+var errNoTime = errors.New("mqtt: no time received on " + timeTopic)
+
+// TimeTopic is the time the backend publishes to the "time" topic, as an
+// RFC 3339 timestamp, retained so that it is delivered on subscribing. It
+// is a time source for networks that block NTP and HTTP; the ntp package's
+// TimeSource interface is satisfied by it.
+//
+// The delivery delay is unknown, so the accuracy is estimated: a retained
+// message may be up to a publish period old, and a live one was delayed by
+// about a broker round trip plus the wait to be read.
+type TimeTopic struct {
+	mu       sync.Mutex
+	time     time.Time // From the last message.
+	recv     time.Time // Local time it was read, with monotonic reading.
+	retained bool
+	rtt      time.Duration // Broker round trip when it was read, if known.
+}
+
+// Name returns "mqtt".
+func (tt *TimeTopic) Name() string { return "mqtt" }
+
+// Offset returns the last published time, carried forward to now, minus
+// the system time.
+func (tt *TimeTopic) Offset() (offset, accuracy time.Duration, err error) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	if tt.recv.IsZero() {
+		return 0, 0, errNoTime
+	}
+	// On average a message waits half of each delay.
+	var delay time.Duration
+	if tt.retained {
+		delay = timePublishPeriod + inboxDelay
+	} else {
+		delay = cmp.Or(tt.rtt, time.Second) + inboxDelay
+	}
+	// Since is monotonic, so unaffected by corrections to the clock.
+	age := time.Since(tt.recv)
+	now := tt.time.Add(age + delay/2)
+	accuracy = delay/2 + time.Duration(maxClockDrift*float64(age))
+	return now.Sub(time.Now()), accuracy, nil
+}
+
+// onPublish returns an OnPub callback that passes messages on timeTopic to
+// the client's TimeTopic.
+func (c *Client) onPublish(timeTopic string) func(mqtt.Header, mqtt.VariablesPublish, io.Reader) error {
+	return func(hdr mqtt.Header, varPub mqtt.VariablesPublish, r io.Reader) error {
+		if string(varPub.TopicName) != timeTopic {
+			c.Logger.Info("received message", slog.String("topic", string(varPub.TopicName)))
+			// The client requires the payload to be read in full.
+			_, err := io.Copy(io.Discard, r)
+			return err
+		}
+		payload, err := readTime(r)
+		if err == nil {
+			err = c.timeTopic.set(payload, hdr.Flags().Retain(), c.PingRTT())
+		}
+		if err != nil {
+			c.Logger.Error("mqtt:time", slog.String("reason", err.Error()))
+		}
+		return nil
+	}
+}
+
+// set records the time published in payload, read from a message whose
+// retain flag is retained.
+func (tt *TimeTopic) set(payload []byte, retained bool, rtt time.Duration) error {
+	recv := time.Now()
+	t, err := time.Parse(time.RFC3339, string(payload))
+	if err != nil {
+		return errors.New("mqtt: bad time " + strconv.Quote(string(payload)))
+	}
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	tt.time, tt.recv, tt.retained, tt.rtt = t, recv, retained, rtt
+	return nil
+}
+
+// readTime reads a time message's payload from r.
+func readTime(r io.Reader) ([]byte, error) {
+	var buf [maxTimeMessage + 1]byte
+	n, _ := io.ReadFull(r, buf[:])
+	// The client requires the payload to be read in full.
+	_, err := io.Copy(io.Discard, r)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxTimeMessage {
+		return nil, errors.New("mqtt: time message too long")
+	}
+	return buf[:n], nil
+}
@@ -0,0 +1,317 @@
+package mqtt
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/soypat/lneto/http/httpraw"
+)
+
+// WebSocket opcodes. See RFC 6455 section 5.2.
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+const (
+	// wsAcceptGUID is appended to Sec-WebSocket-Key to compute Sec-WebSocket-Accept.
+	wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// wsMaxControlPayload is the largest payload a control frame may carry.
+	wsMaxControlPayload = 125
+	// wsMaxHandshake bounds the size of the server's upgrade response.
+	wsMaxHandshake = 1024
+	// wsMaxFrameHeader is the longest client frame header: two bytes, a
+	// 64-bit extended length and the masking key.
+	wsMaxFrameHeader = 2 + 8 + 4
+	// wsMinTxBuf is the smallest transmit buffer, which holds any control
+	// frame whole so that answering a ping does not allocate.
+	wsMinTxBuf = wsMaxFrameHeader + wsMaxControlPayload
+)
+
+var (
+	errWSClosed        = errors.New("websocket: closed by peer")
+	errWSMaskedFrame   = errors.New("websocket: server sent masked frame")
+	errWSFragmentedCtl = errors.New("websocket: fragmented or oversized control frame")
+	errWSTextFrame     = errors.New("websocket: unexpected text frame")
+)
+
+// wsConn carries MQTT over WebSocket binary frames (RFC 6455) on top of an
+// established TCP connection. It implements io.ReadWriteCloser so it can be
+// handed to the MQTT client in place of the raw TCP connection.
+//
+// Pings from the server are answered transparently during Read.
+type wsConn struct {
+	rwc   io.ReadWriteCloser
+	prand func() uint32 // Masking key source.
+
+	// Receive state.
+	rxPending   []byte // Bytes read past the handshake response.
+	rxRemaining uint64 // Unread payload bytes of the current data frame.
+	ctlbuf      [wsMaxControlPayload]byte
+
+	// Transmit state. Guarded by txmu since pongs are written from Read.
+	txmu  sync.Mutex
+	txbuf []byte
+}
+
+// newWSConn returns a WebSocket client over rwc. txbuf is used to assemble
+// outgoing frames; writes larger than txbuf are split across frames. It
+// must be at least wsMinTxBuf bytes.
+func newWSConn(rwc io.ReadWriteCloser, prand func() uint32, txbuf []byte) (*wsConn, error) {
+	if len(txbuf) < wsMinTxBuf {
+		return nil, errors.New("websocket: transmit buffer smaller than " + strconv.Itoa(wsMinTxBuf) + " bytes")
+	}
+	return &wsConn{
+		rwc:   rwc,
+		prand: prand,
+		txbuf: txbuf,
+	}, nil
+}
+
+// Handshake performs the HTTP/1.1 upgrade to the WebSocket protocol,
+// requesting the "mqtt" subprotocol at path on host. It starts a new
+// connection over rwc: receive state left by the previous one, such as a
+// frame cut short when it dropped, is discarded.
+func (ws *wsConn) Handshake(host, path string) error {
+	ws.rxPending = ws.rxPending[:0]
+	ws.rxRemaining = 0
+
+	var key [16]byte
+	for i := 0; i < len(key); i += 4 {
+		binary.LittleEndian.PutUint32(key[i:], ws.prand())
+	}
+	keyB64 := base64.StdEncoding.EncodeToString(key[:])
+
+	var hdr httpraw.Header
+	hdr.SetMethod("GET")
+	hdr.SetRequestURI(path)
+	hdr.SetProtocol("HTTP/1.1")
+	hdr.Add("Host", host)
+	hdr.Add("Upgrade", "websocket")
+	hdr.Add("Connection", "Upgrade")
+	hdr.Add("Sec-WebSocket-Key", keyB64)
+	hdr.Add("Sec-WebSocket-Version", "13")
+	hdr.Add("Sec-WebSocket-Protocol", "mqtt")
+	req, err := hdr.AppendRequest(ws.txbuf[:0])
+	if err != nil {
+		return errors.New("websocket: build upgrade request: " + err.Error())
+	}
+	_, err = ws.rwc.Write(req)
+	if err != nil {
+		return err
+	}
+
+	// Accumulate the response up to the blank line ending the header.
+	// Any bytes past it are already WebSocket frames.
+	resp := make([]byte, 0, wsMaxHandshake)
+	hdrEnd := -1
+	for hdrEnd < 0 {
+		if len(resp) == cap(resp) {
+			return errors.New("websocket: upgrade response too large")
+		}
+		n, err := ws.rwc.Read(resp[len(resp):cap(resp)])
+		resp = resp[:len(resp)+n]
+		if err != nil && n == 0 {
+			return errors.New("websocket: read upgrade response: " + err.Error())
+		}
+		hdrEnd = bytes.Index(resp, []byte("\r\n\r\n"))
+	}
+	ws.rxPending = append(ws.rxPending, resp[hdrEnd+4:]...)
+
+	statusLine, fields, _ := bytes.Cut(resp[:hdrEnd], []byte("\r\n"))
+	_, status, _ := bytes.Cut(statusLine, []byte(" "))
+	if !bytes.HasPrefix(status, []byte("101")) {
+		return errors.New("websocket: upgrade rejected: " + string(status))
+	}
+	if !bytes.EqualFold(wsHeader(fields, "Upgrade"), []byte("websocket")) {
+		return errors.New("websocket: missing Upgrade header in response")
+	}
+	sum := sha1.Sum([]byte(keyB64 + wsAcceptGUID))
+	if string(wsHeader(fields, "Sec-WebSocket-Accept")) != base64.StdEncoding.EncodeToString(sum[:]) {
+		return errors.New("websocket: bad Sec-WebSocket-Accept")
+	}
+	if proto := wsHeader(fields, "Sec-WebSocket-Protocol"); len(proto) > 0 && string(proto) != "mqtt" {
+		return errors.New("websocket: server selected subprotocol " + string(proto))
+	}
+	return nil
+}
+
+// Read reads MQTT bytes from the payload of incoming binary frames. Control
+// frames are handled in-line: pings are answered with pongs, pongs are
+// discarded and a close frame is acknowledged and reported as io.EOF.
+func (ws *wsConn) Read(b []byte) (int, error) {
+	for ws.rxRemaining == 0 {
+		opcode, length, err := ws.readFrameHeader()
+		if err != nil {
+			return 0, err
+		}
+		switch opcode {
+		case wsOpBinary, wsOpContinuation:
+			ws.rxRemaining = length
+		case wsOpPing, wsOpPong, wsOpClose:
+			payload := ws.ctlbuf[:length]
+			_, err = ws.readFull(payload)
+			if err != nil {
+				return 0, err
+			}
+			if opcode == wsOpPing {
+				err = ws.writeFrame(wsOpPong, payload)
+			} else if opcode == wsOpClose {
+				ws.writeFrame(wsOpClose, payload) // Echo status code back.
+				return 0, io.EOF
+			}
+			if err != nil {
+				return 0, err
+			}
+		default:
+			return 0, errWSTextFrame
+		}
+	}
+	if uint64(len(b)) > ws.rxRemaining {
+		b = b[:ws.rxRemaining]
+	}
+	n, err := ws.read(b)
+	ws.rxRemaining -= uint64(n)
+	return n, err
+}
+
+// Write sends b as one or more masked binary frames.
+func (ws *wsConn) Write(b []byte) (int, error) {
+	maxPayload := len(ws.txbuf) - wsMaxFrameHeader
+	n := 0
+	for len(b) > 0 {
+		chunk := b[:min(len(b), maxPayload)]
+		err := ws.writeFrame(wsOpBinary, chunk)
+		if err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+// Ping sends a WebSocket ping. Proxies commonly drop idle upgraded
+// connections, so this is sent alongside MQTT keepalives.
+func (ws *wsConn) Ping() error {
+	return ws.writeFrame(wsOpPing, nil)
+}
+
+// Close sends a normal-closure close frame and closes the underlying connection.
+func (ws *wsConn) Close() error {
+	var status [2]byte
+	binary.BigEndian.PutUint16(status[:], 1000) // Normal closure.
+	ws.writeFrame(wsOpClose, status[:])
+	return ws.rwc.Close()
+}
+
+// readFrameHeader reads the next frame header and returns the payload
+// length. Servers must not mask frames.
+func (ws *wsConn) readFrameHeader() (opcode uint8, length uint64, err error) {
+	var hdr [8]byte
+	_, err = ws.readFull(hdr[:2])
+	if err != nil {
+		return 0, 0, err
+	}
+	fin := hdr[0]&0x80 != 0
+	opcode = hdr[0] & 0x0f
+	if hdr[1]&0x80 != 0 {
+		return 0, 0, errWSMaskedFrame
+	}
+	length = uint64(hdr[1] & 0x7f)
+	switch length {
+	case 126:
+		_, err = ws.readFull(hdr[:2])
+		length = uint64(binary.BigEndian.Uint16(hdr[:2]))
+	case 127:
+		_, err = ws.readFull(hdr[:8])
+		length = binary.BigEndian.Uint64(hdr[:8])
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if opcode >= wsOpClose && (!fin || length > wsMaxControlPayload) {
+		return 0, 0, errWSFragmentedCtl
+	}
+	return opcode, length, nil
+}
+
+// writeFrame writes a single final frame with a fresh masking key.
+func (ws *wsConn) writeFrame(opcode uint8, payload []byte) error {
+	ws.txmu.Lock()
+	defer ws.txmu.Unlock()
+	buf := ws.txbuf[:0]
+	buf = append(buf, 0x80|opcode) // FIN set.
+	const maskBit = 0x80
+	switch plen := len(payload); {
+	case plen < 126:
+		buf = append(buf, maskBit|byte(plen))
+	case plen <= 0xffff:
+		buf = append(buf, maskBit|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(plen))
+	default:
+		buf = append(buf, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(plen))
+	}
+	var mask [4]byte
+	binary.LittleEndian.PutUint32(mask[:], ws.prand())
+	buf = append(buf, mask[:]...)
+	off := len(buf)
+	buf = append(buf, payload...)
+	for i := range buf[off:] {
+		buf[off+i] ^= mask[i&3]
+	}
+	_, err := ws.rwc.Write(buf)
+	return err
+}
+
+// read reads from bytes left over from the handshake before reading from
+// the underlying connection.
+func (ws *wsConn) read(b []byte) (int, error) {
+	if len(ws.rxPending) > 0 {
+		n := copy(b, ws.rxPending)
+		ws.rxPending = ws.rxPending[n:]
+		return n, nil
+	}
+	n, err := ws.rwc.Read(b)
+	if err == io.EOF && n == 0 {
+		err = errWSClosed
+	}
+	return n, err
+}
+
+// wsHeader returns the trimmed value of the first header field named key
+// in CRLF-separated header lines, or nil if absent.
+func wsHeader(fields []byte, key string) []byte {
+	for len(fields) > 0 {
+		var line []byte
+		line, fields, _ = bytes.Cut(fields, []byte("\r\n"))
+		name, value, ok := bytes.Cut(line, []byte(":"))
+		if ok && bytes.EqualFold(bytes.TrimSpace(name), []byte(key)) {
+			return bytes.TrimSpace(value)
+		}
+	}
+	return nil
+}
+
+func (ws *wsConn) readFull(b []byte) (int, error) {
+	n := 0
+	for n < len(b) {
+		ngot, err := ws.read(b[n:])
+		n += ngot
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,161 @@
+package mqtt
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+type nopCloser struct{ bytes.Buffer }
+
+func (*nopCloser) Close() error { return nil }
+
+func TestNewWSConnBufferSize(t *testing.T) {
+	prand := func() uint32 { return 0 }
+	for _, size := range []int{0, wsMaxFrameHeader, wsMinTxBuf - 1} {
+		_, err := newWSConn(&nopCloser{}, prand, make([]byte, size))
+		if err == nil {
+			t.Errorf("newWSConn with %d byte buffer succeeded, want error", size)
+		}
+	}
+	_, err := newWSConn(&nopCloser{}, prand, make([]byte, wsMinTxBuf))
+	if err != nil {
+		t.Errorf("newWSConn with %d byte buffer: %v", wsMinTxBuf, err)
+	}
+}
+
+func TestWSConnWriteSplitsFrames(t *testing.T) {
+	var out nopCloser
+	// A zero masking key leaves the payload as is.
+	ws, err := newWSConn(&out, func() uint32 { return 0 }, make([]byte, wsMinTxBuf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := bytes.Repeat([]byte{0xa5}, 3*wsMinTxBuf)
+	n, err := ws.Write(payload)
+	if err != nil || n != len(payload) {
+		t.Fatalf("Write = %d, %v, want %d, nil", n, err, len(payload))
+	}
+	var got []byte
+	for out.Len() > 0 {
+		var hdr [2]byte
+		io.ReadFull(&out, hdr[:])
+		if hdr[0] != 0x80|wsOpBinary || hdr[1]&0x80 == 0 {
+			t.Fatalf("frame header % x, want final masked binary frame", hdr)
+		}
+		plen := int(hdr[1] & 0x7f)
+		if plen >= 126 {
+			t.Fatalf("frame of %d bytes needs an extended length", plen)
+		}
+		var mask [4]byte
+		io.ReadFull(&out, mask[:])
+		frame := make([]byte, plen)
+		io.ReadFull(&out, frame)
+		got = append(got, frame...)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("frames carry %d bytes, want the %d written", len(got), len(payload))
+	}
+}
+
+// wsPeer is the server end of a connection. Each Read returns the next
+// segment the server sent, then io.EOF as if the connection dropped.
+type wsPeer struct {
+	in  [][]byte
+	out bytes.Buffer
+}
+
+func (p *wsPeer) Read(b []byte) (int, error) {
+	if len(p.in) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, p.in[0])
+	p.in[0] = p.in[0][n:]
+	if len(p.in[0]) == 0 {
+		p.in = p.in[1:]
+	}
+	return n, nil
+}
+
+func (p *wsPeer) Write(b []byte) (int, error) { return p.out.Write(b) }
+func (p *wsPeer) Close() error                { return nil }
+
+// accept queues the upgrade response to a handshake keyed by prand, with
+// early arriving in the same segment, and then later segments.
+func (p *wsPeer) accept(prand func() uint32, early []byte, later ...[]byte) {
+	var key [16]byte
+	for i := 0; i < len(key); i += 4 {
+		binary.LittleEndian.PutUint32(key[i:], prand())
+	}
+	sum := sha1.Sum([]byte(base64.StdEncoding.EncodeToString(key[:]) + wsAcceptGUID))
+	resp := []byte("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n" +
+		"Sec-WebSocket-Protocol: mqtt\r\n\r\n")
+	p.in = append(p.in, append(resp, early...))
+	p.in = append(p.in, later...)
+}
+
+func TestWSConnReconnectAfterPartialFrame(t *testing.T) {
+	tests := []struct {
+		name string
+		// early is what the first connection carries with the upgrade
+		// response before it drops; read is how much the client reads.
+		early []byte
+		read  int
+	}{
+		{
+			name:  "frame cut short",
+			early: []byte{0x80 | wsOpBinary, 10, 'b', 'a', 'd', '!'},
+			read:  4,
+		},
+		{
+			name:  "frame never read",
+			early: []byte{0x80 | wsOpBinary, 3, 'b', 'a', 'd'},
+			read:  0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prand := func() uint32 { return 0x01020304 }
+			var peer wsPeer
+			ws, err := newWSConn(&peer, prand, make([]byte, wsMinTxBuf))
+			if err != nil {
+				t.Fatal(err)
+			}
+			peer.accept(prand, tt.early)
+			err = ws.Handshake("broker", "/mqtt")
+			if err != nil {
+				t.Fatalf("first Handshake: %v", err)
+			}
+			buf := make([]byte, 16)
+			if tt.read > 0 {
+				n, err := ws.Read(buf)
+				if err != nil || n != tt.read {
+					t.Fatalf("first Read = %d, %v, want %d, nil", n, err, tt.read)
+				}
+				_, err = ws.Read(buf)
+				if err != errWSClosed {
+					t.Fatalf("Read after drop: %v, want %v", err, errWSClosed)
+				}
+			}
+
+			// Redial over the same transport. The first frame arrives after
+			// the upgrade response.
+			peer.in = nil
+			peer.accept(prand, nil, []byte{0x80 | wsOpBinary, 2, 'o', 'k'})
+			err = ws.Handshake("broker", "/mqtt")
+			if err != nil {
+				t.Fatalf("second Handshake: %v", err)
+			}
+			n, err := ws.Read(buf)
+			if err != nil || string(buf[:n]) != "ok" {
+				t.Errorf("Read after reconnect = %q, %v, want \"ok\", nil", buf[:n], err)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package ntp
+
+import (
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"github.com/harveysanders/picoplayground/mqttsensor/cyw43439"
+	"github.com/harveysanders/picoplayground/mqttsensor/ntp/ntpcore"
+)
+
+// PoolHost is the public NTP pool, the last resort for servers.
+const PoolHost = "pool.ntp.org"
+
+// query measures the offset of the system clock over stack, as described
+// for [ntpcore.Query].
+func query(stack *cyw43439.Stack, servers []netip.Addr, logger *slog.Logger) (ntpcore.Sample, error) {
+	// Poll quickly so replies are timestamped soon after they arrive; the
+	// time they wait to be polled counts as round trip.
+	defer stack.PollFast()()
+	return ntpcore.Query(stackTransport{stack}, servers, ntpcore.QueryConfig{}, logger)
+}
+
+// stackTransport carries NTP over the WiFi stack's UDP handlers.
+type stackTransport struct {
+	stack *cyw43439.Stack
+}
+
+func (t stackTransport) Listen(port uint16, fn func(src netip.AddrPort, payload []byte)) error {
+	if fn == nil {
+		return t.stack.HandleUDP(port, nil)
+	}
+	return t.stack.HandleUDP(port, func(pkt *cyw43439.UDPPacket) bool {
+		fn(pkt.Src, pkt.Payload)
+		return true
+	})
+}
+
+func (t stackTransport) Send(port uint16, dst netip.AddrPort, payload []byte) error {
+	return t.stack.SendUDP(port, dst, payload)
+}
+
+func (t stackTransport) Rand32() uint32 { return t.stack.Prand32() }
+
+// resolve returns the addresses of hosts, which may be host names or IP
+// addresses, in order. Host names that fail to resolve are logged and
+// skipped.
+func resolve(stack *cyw43439.Stack, hosts []string, logger *slog.Logger) []netip.Addr {
+	var addrs []netip.Addr
+	for _, host := range hosts {
+		if addr, err := netip.ParseAddr(host); err == nil {
+			addrs = append(addrs, addr)
+			continue
+		}
+		logger.Info("ntp:resolving " + host)
+		resolved, err := stack.LookupIP(host, 5*time.Second, 3)
+		if err != nil {
+			logger.Error("ntp:resolve-failed", slog.String("host", host), slog.String("err", err.Error()))
+			continue
+		}
+		addrs = append(addrs, resolved...)
+	}
+	return addrs
+}
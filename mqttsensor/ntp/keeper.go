@@ -0,0 +1,557 @@
+package ntp
+
+import (
+	"cmp"
+	"errors"
+	"log/slog"
+	"net/netip"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/harveysanders/picoplayground/mqttsensor/cyw43439"
+	"github.com/harveysanders/picoplayground/mqttsensor/ntp/ntpcore"
+)
+
+const (
+	defaultInterval      = time.Hour
+	defaultStepThreshold = 128 * time.Millisecond
+	// defaultPanicThreshold is the largest offset accepted once the clock
+	// is set, as in ntpd.
+	defaultPanicThreshold = 1000 * time.Second
+	// defaultMaxSlew is the fastest a correction is slewed in, as a
+	// fraction of elapsed time, the same 500 ppm limit as adjtime(3).
+	defaultMaxSlew = 500e-6
+	// maxDrift bounds the frequency correction. The RP2040 crystal is
+	// specified to ±30 ppm; a larger estimate means bad measurements.
+	maxDrift = 100e-6
+	// driftGain is the weight of a new frequency error in the drift
+	// estimate, so that one poor measurement moves it only partway.
+	driftGain = 0.5
+	// minDriftInterval is the shortest sync interval a drift measurement
+	// is taken from. Over shorter ones the offset's jitter dominates.
+	minDriftInterval = 5 * time.Minute
+	// slewTick is how often slewing and drift corrections are applied.
+	slewTick = time.Second
+	// linkWait is how often a due sync checks whether the link is up.
+	linkWait = 5 * time.Second
+	// retryInterval is how soon a failed sync is retried, if sooner than
+	// the interval.
+	retryInterval = 5 * time.Minute
+	// historyLen is the number of syncs kept for Status.
+	historyLen = 8
+)
+
+// KeeperConfig configures a [Keeper].
+type KeeperConfig struct {
+	// Interval between syncs after the first. Defaults to 1 hour.
+	Interval time.Duration
+	// StepThreshold is the largest offset corrected by slewing; larger
+	// ones step the clock. Defaults to 128ms, as in ntpd.
+	StepThreshold time.Duration
+	// PanicThreshold is the largest offset accepted once the clock has
+	// been synced; syncs finding a larger one fail, since a clock that
+	// was set can't have drifted that far. A larger offset at the first
+	// sync must be confirmed by the RTC or a fallback source, if there is
+	// one. Defaults to 1000 seconds, as in ntpd.
+	PanicThreshold time.Duration
+	// MaxSlew is the fastest rate a correction is slewed in, as a fraction
+	// of elapsed time. Defaults to 500 ppm, so a 100ms offset is slewed in
+	// over 200 seconds.
+	MaxSlew float64
+	// Hosts are the preferred servers, as host names or IP addresses.
+	// Host names are resolved for every sync.
+	Hosts []string
+	// Servers returns the servers the network provides, from DHCP option
+	// 42 or the static configuration, tried if none of Hosts answer. It
+	// is called for every sync so that they stay current.
+	Servers func() []netip.Addr
+	// Fallbacks are tried in order when no NTP server answers, e.g. on
+	// networks that block NTP.
+	Fallbacks []TimeSource
+	// RTC, if set, is set after every successful sync, and its drift
+	// measured between them.
+	RTC RTC
+	// RTCLoaded is set if the clock was set from RTC at boot by
+	// [LoadRTC], so that it holds wall time before the first sync.
+	RTCLoaded bool
+	// Logger for sync results.
+	Logger *slog.Logger
+}
+
+// RTC is a battery backed clock that keeps time while the device is off.
+type RTC interface {
+	// Offset returns the RTC's time minus the system time.
+	Offset() (time.Duration, error)
+	// Set sets the RTC to the system time.
+	Set() error
+}
+
+// Sample records the outcome of a sync.
+type Sample struct {
+	Time   time.Time     // Local time after the correction was scheduled.
+	Server netip.Addr    // Invalid if the sync failed before a request.
+	Offset time.Duration // Server time minus local time.
+	Delay  time.Duration // Round trip to the server.
+	// Accuracy is how far the true offset may be from Offset.
+	Accuracy time.Duration
+	// Source is where the server came from: "configured", "network" or
+	// "pool", or the name of the fallback used.
+	Source string
+	// Stepped is set if the offset was corrected at once rather than
+	// slewed.
+	Stepped bool
+	Err     error
+}
+
+// Status reports the health of time keeping.
+type Status struct {
+	// Synced is set once a sync has succeeded.
+	Synced bool
+	// Stale is set if no sync has succeeded for three intervals, or since
+	// boot.
+	Stale      bool
+	LastSync   time.Time     // Zero before the first successful sync.
+	LastOffset time.Duration // Offset measured by the last successful sync.
+	// LastSource and LastAccuracy are the source that set the clock at
+	// the last successful sync, and how far out it may have been.
+	LastSource   string
+	LastAccuracy time.Duration
+	LastErr      error         // Error of the last sync, if it failed.
+	Syncs        uint32        // Successful syncs.
+	Failures     uint32        // Failed syncs.
+	Steps        uint32        // Syncs that stepped the clock.
+	SlewPending  time.Duration // Correction still being slewed in.
+	// DriftPPM is the estimated frequency error of the local clock in
+	// parts per million, positive if it runs fast, and corrected for.
+	DriftPPM float64
+	// RTC is set if there is an RTC, and RTCLoaded if the clock was set
+	// from it at boot.
+	RTC       bool
+	RTCLoaded bool
+	// RTCOffset is the RTC's time minus NTP time, measured by the last
+	// successful sync before the RTC was set again.
+	RTCOffset time.Duration
+	// RTCDriftPPM is the RTC's frequency error in parts per million,
+	// positive if it runs fast, from the offset it gained between the last
+	// two syncs. Zero until measured.
+	RTCDriftPPM float64
+	RTCErr      error // Error reading or setting the RTC at the last sync.
+	// History holds the most recent syncs, oldest first.
+	History []Sample
+}
+
+// Keeper keeps the system clock synchronised with NTP. After the first sync
+// it resyncs every interval. Small offsets are slewed in gradually so that
+// timestamps never jump, and the local clock's frequency error is estimated
+// from the offsets between syncs and corrected for continuously.
+type Keeper struct {
+	stack     *cyw43439.Stack
+	interval  time.Duration
+	step      time.Duration
+	panic     time.Duration
+	maxSlew   float64
+	hosts     []string
+	servers   func() []netip.Addr
+	fallbacks []TimeSource
+	rtc       RTC
+	logger    *slog.Logger
+
+	mu     sync.Mutex
+	synced bool
+	// ntpSynced is set if the last successful sync was with NTP.
+	ntpSynced    bool
+	lastSync     time.Time
+	lastOffset   time.Duration
+	lastSource   string
+	lastAccuracy time.Duration
+	lastErr      error
+	syncs        uint32
+	failures     uint32
+	steps        uint32
+	// syncMono is the monotonic time of the last successful sync, the
+	// start of the interval the next drift measurement covers.
+	syncMono time.Time
+	// pending is the part of the last offset not yet slewed in.
+	pending time.Duration
+	// drift is the estimated frequency error, in seconds per second.
+	drift float64
+	// driftAcc carries the fractions of a nanosecond of drift correction
+	// not yet applied.
+	driftAcc float64
+	history  [historyLen]Sample
+	nhistory int
+
+	rtcLoaded bool
+	// rtcSetMono is the monotonic time the RTC was last set, zero if not
+	// since boot.
+	rtcSetMono time.Time
+	rtcOffset  time.Duration
+	rtcDrift   float64
+	rtcErr     error
+}
+
+// NewKeeper returns a Keeper for stack. Call Sync for the first sync, then
+// Run in a separate goroutine.
+func NewKeeper(stack *cyw43439.Stack, cfg KeeperConfig) *Keeper {
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultInterval
+	}
+	if cfg.StepThreshold <= 0 {
+		cfg.StepThreshold = defaultStepThreshold
+	}
+	if cfg.PanicThreshold <= 0 {
+		cfg.PanicThreshold = defaultPanicThreshold
+	}
+	if cfg.MaxSlew <= 0 {
+		cfg.MaxSlew = defaultMaxSlew
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	return &Keeper{
+		stack:     stack,
+		interval:  cfg.Interval,
+		step:      cfg.StepThreshold,
+		panic:     cfg.PanicThreshold,
+		maxSlew:   cfg.MaxSlew,
+		hosts:     cfg.Hosts,
+		servers:   cfg.Servers,
+		fallbacks: cfg.Fallbacks,
+		rtc:       cfg.RTC,
+		logger:    cfg.Logger,
+		rtcLoaded: cfg.RTCLoaded,
+	}
+}
+
+// LoadRTC sets the system clock from rtc, for use at boot before the
+// network is up. It fails if the RTC lost its time or holds one before
+// 2025.
+func LoadRTC(rtc RTC) (time.Duration, error) {
+	offset, err := rtc.Offset()
+	if err != nil {
+		return 0, err
+	}
+	if time.Now().Add(offset).Before(ntpcore.MinValidTime) {
+		return 0, errors.New("ntp: rtc time before " + ntpcore.MinValidTime.Format(time.DateOnly))
+	}
+	runtime.AdjustTimeOffset(int64(offset))
+	return offset, nil
+}
+
+// Synced reports whether a sync has succeeded. It is safe to call from
+// other goroutines.
+func (k *Keeper) Synced() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.synced
+}
+
+// ClockSet reports whether the clock holds wall time, from a sync or from
+// the RTC at boot. It is safe to call from other goroutines.
+func (k *Keeper) ClockSet() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.synced || k.rtcLoaded
+}
+
+// Sync queries servers and corrects the clock by the measured offset,
+// stepping it if the offset exceeds the step threshold or this is the first
+// sync, and slewing otherwise. The configured hosts are queried first, then
+// the network's servers and then pool.ntp.org, moving on while a source
+// has no servers or none of them answer. If no NTP server answers, the
+// fallback sources are tried in order; their offsets are only corrected
+// once the clock is set if they exceed the source's accuracy. A first
+// offset over the panic threshold must be confirmed by another source; see
+// confirmStep. After a successful sync the RTC, if any, is set.
+func (k *Keeper) Sync() error {
+	err := k.sync()
+	if err == nil && k.rtc != nil {
+		k.syncRTC()
+	}
+	return err
+}
+
+func (k *Keeper) sync() error {
+	var m ntpcore.Sample
+	var source string
+	err := ntpcore.ErrNoServers
+	for _, source = range [...]string{"configured", "network", "pool"} {
+		servers := k.sourceServers(source)
+		if len(servers) == 0 {
+			continue
+		}
+		m, err = query(k.stack, servers, k.logger)
+		if err == nil {
+			break
+		}
+		k.logger.Error("ntp:source-failed", slog.String("source", source), slog.String("err", err.Error()))
+	}
+	if err == ntpcore.ErrNoServers {
+		source = "" // Not even the pool resolved.
+	}
+	offset, accuracy := m.Offset, m.HalfWidth()
+	isNTP := err == nil
+	if err != nil {
+		ntpErr := err
+		for _, fb := range k.fallbacks {
+			source = fb.Name()
+			offset, accuracy, err = fb.Offset()
+			if err == nil {
+				break
+			}
+			k.logger.Error("ntp:source-failed", slog.String("source", source), slog.String("err", err.Error()))
+		}
+		if err != nil {
+			// The NTP error is the one worth fixing.
+			err = ntpErr
+		}
+	}
+	if err == nil && (offset > k.panic || offset < -k.panic) {
+		if k.Synced() {
+			err = errors.New("ntp: offset " + offset.String() + " exceeds " + k.panic.String())
+		} else {
+			err = k.confirmStep(source, offset)
+		}
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	sample := Sample{Source: source, Offset: offset, Accuracy: accuracy, Err: err}
+	if isNTP {
+		sample.Server, sample.Delay = m.Server, m.Delay
+	}
+	k.lastErr = err
+	if err != nil {
+		k.failures++
+		sample.Time = time.Now()
+		k.record(sample)
+		return err
+	}
+
+	now := time.Now()
+	if k.synced && k.ntpSynced && isNTP {
+		// Had the clock kept time, the offset would be what is left to
+		// slew; the rest accumulated from frequency error. Only NTP is
+		// accurate enough to tell.
+		elapsed := now.Sub(k.syncMono)
+		if elapsed >= minDriftInterval {
+			freqErr := -float64(offset-k.pending) / float64(elapsed)
+			k.drift += driftGain * freqErr
+			k.drift = max(-maxDrift, min(k.drift, maxDrift))
+		}
+	}
+	switch {
+	case k.synced && !isNTP && offset <= accuracy && offset >= -accuracy:
+		// The clock agrees with the source as far as it can tell, and is
+		// likely the more accurate of the two.
+	case !k.synced || offset > k.step || offset < -k.step:
+		runtime.AdjustTimeOffset(int64(offset))
+		k.pending = 0
+		k.steps++
+		sample.Stepped = true
+	default:
+		k.pending = offset
+	}
+	k.synced = true
+	k.ntpSynced = isNTP
+	k.syncs++
+	k.syncMono = now
+	k.lastSync = time.Now()
+	k.lastOffset = offset
+	k.lastSource = source
+	k.lastAccuracy = accuracy
+	sample.Time = k.lastSync
+	k.record(sample)
+	server := ""
+	if isNTP {
+		server = m.Server.String()
+	}
+	k.logger.Info("ntp:sync",
+		slog.String("server", server),
+		slog.String("source", source),
+		slog.Duration("offset", offset),
+		slog.Duration("accuracy", accuracy),
+		slog.Bool("stepped", sample.Stepped),
+		slog.Float64("drift_ppm", k.drift*1e6),
+	)
+	return nil
+}
+
+// confirmStep checks the offset of the first sync, if it is over the panic
+// threshold, against the sources it didn't come from: the RTC and the
+// fallbacks. A clock set from the RTC at boot stands for the RTC, so the
+// RTC always disagrees then. Without any other source to ask, the offset
+// is applied as found, since the clock holds no wall time to protect.
+func (k *Keeper) confirmStep(source string, offset time.Duration) error {
+	var witnesses []ntpcore.Witness
+	if k.rtcLoaded {
+		witnesses = append(witnesses, ntpcore.Witness{Name: "rtc"})
+	} else if k.rtc != nil {
+		rtcOffset, err := k.rtc.Offset()
+		if err == nil && !time.Now().Add(rtcOffset).Before(ntpcore.MinValidTime) {
+			witnesses = append(witnesses, ntpcore.Witness{Name: "rtc", Offset: rtcOffset})
+		}
+	}
+	for _, fb := range k.fallbacks {
+		if fb.Name() == source {
+			continue
+		}
+		fbOffset, accuracy, err := fb.Offset()
+		if err != nil {
+			k.logger.Warn("ntp:witness-failed", slog.String("source", fb.Name()), slog.String("err", err.Error()))
+			continue
+		}
+		witnesses = append(witnesses, ntpcore.Witness{Name: fb.Name(), Offset: fbOffset, Accuracy: accuracy})
+	}
+	w, err := ntpcore.ConfirmStep(offset, k.panic, witnesses)
+	if err != nil {
+		return errors.New("ntp: offset " + offset.String() + " exceeds " + k.panic.String() + " and no other source agrees")
+	}
+	if len(witnesses) == 0 {
+		k.logger.Warn("ntp:step-unconfirmed", slog.String("source", source), slog.Duration("offset", offset))
+	} else {
+		k.logger.Info("ntp:step-confirmed", slog.String("source", source), slog.String("by", w.Name))
+	}
+	return nil
+}
+
+// syncRTC measures how far the RTC is from the freshly synced clock, and
+// from that its drift since it was last set if the clock was synced with
+// NTP, then sets it. A failure is logged and reported by Status, but does
+// not fail the sync.
+func (k *Keeper) syncRTC() {
+	k.mu.Lock()
+	pending, since, measureDrift := k.pending, k.rtcSetMono, k.ntpSynced
+	k.mu.Unlock()
+	// The clock is behind NTP time by what is left to slew.
+	offset, offsetErr := k.rtc.Offset()
+	offset -= pending
+	if offsetErr != nil {
+		// Set it all the same; it may only have lost its time.
+		k.logger.Warn("ntp:rtc-read-failed", slog.String("err", offsetErr.Error()))
+	}
+	err := k.rtc.Set()
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.rtcErr = cmp.Or(err, offsetErr)
+	if err != nil {
+		k.logger.Error("ntp:rtc-set-failed", slog.String("err", err.Error()))
+		return
+	}
+	if offsetErr == nil {
+		k.rtcOffset = offset
+		if elapsed := time.Since(since); measureDrift && !since.IsZero() && elapsed >= minDriftInterval {
+			k.rtcDrift = float64(offset) / float64(elapsed)
+		}
+	}
+	k.rtcSetMono = time.Now()
+	k.logger.Info("ntp:rtc-set",
+		slog.Duration("rtc_offset", offset),
+		slog.Float64("rtc_drift_ppm", k.rtcDrift*1e6),
+	)
+}
+
+// sourceServers returns the servers of source.
+func (k *Keeper) sourceServers(source string) []netip.Addr {
+	switch {
+	case source == "configured" && len(k.hosts) > 0:
+		return resolve(k.stack, k.hosts, k.logger)
+	case source == "network" && k.servers != nil:
+		return k.servers()
+	case source == "pool":
+		return resolve(k.stack, []string{PoolHost}, k.logger)
+	}
+	return nil
+}
+
+// record adds s to the history. k.mu must be held.
+func (k *Keeper) record(s Sample) {
+	if k.nhistory == len(k.history) {
+		copy(k.history[:], k.history[1:])
+		k.nhistory--
+	}
+	k.history[k.nhistory] = s
+	k.nhistory++
+}
+
+// Run slews in corrections, corrects for drift and resyncs every interval.
+// It never returns. Failed syncs are retried after 5 minutes, and while the
+// WiFi link is down a due sync waits for it.
+func (k *Keeper) Run() {
+	ticker := time.NewTicker(slewTick)
+	defer ticker.Stop()
+	last := time.Now()
+	next := time.Now().Add(k.interval)
+	if !k.Synced() {
+		next = time.Now().Add(min(k.interval, retryInterval))
+	}
+	for {
+		<-ticker.C
+		now := time.Now()
+		k.slew(now.Sub(last))
+		last = now
+		if now.Before(next) {
+			continue
+		}
+		if !k.stack.IsLinkUp() {
+			next = now.Add(linkWait)
+			continue
+		}
+		err := k.Sync()
+		if err != nil {
+			k.logger.Error("ntp:sync-failed", slog.String("err", err.Error()))
+			next = time.Now().Add(min(k.interval, retryInterval))
+			continue
+		}
+		next = time.Now().Add(k.interval)
+	}
+}
+
+// slew applies the drift correction for elapsed, and as much of the pending
+// offset as the slew rate allows.
+func (k *Keeper) slew(elapsed time.Duration) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.driftAcc -= k.drift * float64(elapsed)
+	adj := time.Duration(k.driftAcc)
+	k.driftAcc -= float64(adj)
+
+	limit := time.Duration(k.maxSlew * float64(elapsed))
+	s := max(-limit, min(k.pending, limit))
+	k.pending -= s
+	adj += s
+	if adj != 0 {
+		runtime.AdjustTimeOffset(int64(adj))
+	}
+}
+
+// Status returns the health of time keeping. It is safe to call from other
+// goroutines.
+func (k *Keeper) Status() Status {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	st := Status{
+		Synced:       k.synced,
+		Stale:        !k.synced || time.Since(k.syncMono) > 3*k.interval,
+		LastSync:     k.lastSync,
+		LastOffset:   k.lastOffset,
+		LastSource:   k.lastSource,
+		LastAccuracy: k.lastAccuracy,
+		LastErr:      k.lastErr,
+		Syncs:        k.syncs,
+		Failures:     k.failures,
+		Steps:        k.steps,
+		SlewPending:  k.pending,
+		DriftPPM:     k.drift * 1e6,
+		RTC:          k.rtc != nil,
+		RTCLoaded:    k.rtcLoaded,
+		RTCOffset:    k.rtcOffset,
+		RTCDriftPPM:  k.rtcDrift * 1e6,
+		RTCErr:       k.rtcErr,
+		History:      make([]Sample, k.nhistory),
+	}
+	copy(st.History, k.history[:k.nhistory])
+	return st
+}
@@ -1,43 +1,33 @@
+// Package ntp sets the system clock from NTP servers, once with [SyncTime]
+// or continuously with a [Keeper], which falls back to other time sources
+// such as [HTTPDate] where NTP is blocked.
 package ntp
 
 import (
-	"errors"
 	"log/slog"
+	"net/netip"
 	"runtime"
-	"time"
 
-	"github.com/soypat/lneto/x/xnet"
+	"github.com/harveysanders/picoplayground/mqttsensor/cyw43439"
 )
 
 // SyncTime synchronizes the system time using NTP.
-// It resolves an NTP server via DNS, performs an NTP time sync,
-// and adjusts the system clock accordingly.
+// Up to 4 of servers are queried; if none are given the addresses of
+// pool.ntp.org are resolved via DNS. It steps the system clock by the offset
+// the servers agree on.
 //
 // Returns nil on success, error if sync fails.
-func SyncTime(stack *xnet.StackAsync, logger *slog.Logger) error {
-	const pollTime = 5 * time.Millisecond
-	rstack := stack.StackRetrying(pollTime)
-
-	// DNS lookup for NTP server (built-in, no custom Resolver needed)
-	logger.Info("ntp:resolving pool.ntp.org")
-	addrs, err := rstack.DoLookupIP("pool.ntp.org", 5*time.Second, 3)
-	if err != nil {
-		return errors.New("ntp dns lookup:" + err.Error())
+func SyncTime(stack *cyw43439.Stack, servers []netip.Addr, logger *slog.Logger) error {
+	if len(servers) == 0 {
+		servers = resolve(stack, []string{PoolHost}, logger)
 	}
-	if len(addrs) == 0 {
-		return errors.New("ntp dns lookup: no addresses returned")
-	}
-	logger.Info("ntp:resolved", slog.String("addr", addrs[0].String()))
-
-	// Perform NTP request (built-in, no manual polling)
-	logger.Info("ntp:requesting time")
-	offset, err := rstack.DoNTP(addrs[0], 5*time.Second, 3)
+	s, err := query(stack, servers, logger)
 	if err != nil {
-		return errors.New("ntp request:" + err.Error())
+		return err
 	}
 
 	// Apply time offset
-	runtime.AdjustTimeOffset(int64(offset))
-	logger.Info("ntp:complete", slog.Duration("offset", offset))
+	runtime.AdjustTimeOffset(int64(s.Offset))
+	logger.Info("ntp:complete", slog.String("server", s.Server.String()), slog.Duration("offset", s.Offset))
 	return nil
 }
@@ -0,0 +1,122 @@
+package ntpcore
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Port is the NTP server UDP port.
+const Port = 123
+
+const (
+	packetLen  = 48
+	version    = 4
+	modeClient = 3
+	modeServer = 4
+	// leapUnsynced is the leap indicator of a server without time.
+	leapUnsynced = 3
+	maxStratum   = 15
+	// unixEpoch is 1970-01-01 in seconds since the NTP epoch, 1900-01-01.
+	unixEpoch = 2208988800
+	// eraSeconds is the span of the 32-bit NTP seconds field, about 136
+	// years. Era 0 ends in February 2036.
+	eraSeconds = 1 << 32
+)
+
+// MinValidTime is the earliest time a server may report. Earlier times are
+// from broken servers, and the NTP era is resolved relative to it while the
+// local clock is unset.
+var MinValidTime = time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+var (
+	errShortReply   = errors.New("ntp: short reply")
+	errNotServer    = errors.New("ntp: reply not from a server")
+	errBogusOrigin  = errors.New("ntp: reply does not match request")
+	errUnsynced     = errors.New("ntp: server not synchronised")
+	errKissOfDeath  = errors.New("ntp: kiss-o'-death from server")
+	errInvalidTime  = errors.New("ntp: server time before " + MinValidTime.Format(time.DateOnly))
+	errNoTransmitTS = errors.New("ntp: reply has no transmit timestamp")
+)
+
+// reply holds the fields of a server reply used for a sample.
+type reply struct {
+	stratum uint8
+	// rootDist is the server's own distance from its reference clock,
+	// half its root delay plus its root dispersion.
+	rootDist time.Duration
+	recv     time.Time // T2, when the server received the request.
+	xmit     time.Time // T3, when the server sent the reply.
+}
+
+// appendRequest appends a client request carrying xmt as its transmit
+// timestamp. The server returns it as the origin timestamp, which is how
+// replies are matched to requests. The local time is not sent.
+func appendRequest(dst []byte, xmt uint64) []byte {
+	var p [packetLen]byte
+	p[0] = version<<3 | modeClient
+	binary.BigEndian.PutUint64(p[40:], xmt)
+	return append(dst, p[:]...)
+}
+
+// parseReply checks the server reply b to the request with transmit
+// timestamp xmt and returns its timestamps, resolving their era against
+// pivot.
+func parseReply(b []byte, xmt uint64, pivot time.Time) (reply, error) {
+	if len(b) < packetLen {
+		return reply{}, errShortReply
+	}
+	leap, mode := b[0]>>6, b[0]&7
+	if mode != modeServer {
+		return reply{}, errNotServer
+	}
+	if binary.BigEndian.Uint64(b[24:]) != xmt {
+		return reply{}, errBogusOrigin
+	}
+	r := reply{stratum: b[1]}
+	if r.stratum == 0 {
+		return reply{}, errKissOfDeath
+	}
+	if leap == leapUnsynced || r.stratum > maxStratum {
+		return reply{}, errUnsynced
+	}
+	rx, tx := binary.BigEndian.Uint64(b[32:]), binary.BigEndian.Uint64(b[40:])
+	if tx == 0 {
+		return reply{}, errNoTransmitTS
+	}
+	rootDelay := shortDuration(binary.BigEndian.Uint32(b[4:]))
+	rootDisp := shortDuration(binary.BigEndian.Uint32(b[8:]))
+	r.rootDist = rootDelay/2 + rootDisp
+	r.recv = fromTimestamp(rx, pivot)
+	r.xmit = fromTimestamp(tx, pivot)
+	if r.xmit.Before(MinValidTime) {
+		return reply{}, errInvalidTime
+	}
+	return r, nil
+}
+
+// eraPivot returns the time NTP eras are resolved against: the local clock
+// if it has been set, and MinValidTime otherwise.
+func eraPivot(now time.Time) time.Time {
+	if now.Before(MinValidTime) {
+		return MinValidTime
+	}
+	return now
+}
+
+// fromTimestamp returns the time of the NTP timestamp ts in the era that
+// puts it closest to pivot, so that timestamps from after 2036, when the
+// seconds wrap, are read correctly for 68 years either side of pivot.
+func fromTimestamp(ts uint64, pivot time.Time) time.Time {
+	secs := int64(ts>>32) - unixEpoch // In era 0.
+	// Non-negative for any pivot after 1900.
+	era := (pivot.Unix() - secs + eraSeconds/2) / eraSeconds
+	nsec := int64((ts & 0xffffffff) * 1e9 >> 32)
+	return time.Unix(secs+era*eraSeconds, nsec).UTC()
+}
+
+// shortDuration converts an NTP short format value, 16.16 fixed point
+// seconds.
+func shortDuration(v uint32) time.Duration {
+	return time.Duration(uint64(v) * uint64(time.Second) >> 16)
+}
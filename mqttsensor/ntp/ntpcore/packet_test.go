@@ -0,0 +1,129 @@
+package ntpcore
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// toTimestamp returns the NTP timestamp of t, in whichever era it falls.
+func toTimestamp(t time.Time) uint64 {
+	secs := uint64(t.Unix()+unixEpoch) & 0xffffffff
+	frac := uint64(t.Nanosecond()) << 32 / 1e9
+	return secs<<32 | frac
+}
+
+// replyPacket returns a server reply to the request with transmit
+// timestamp xmt, received at recv and sent at xmit.
+func replyPacket(xmt uint64, recv, xmit time.Time) []byte {
+	b := make([]byte, packetLen)
+	b[0] = version<<3 | modeServer
+	b[1] = 2                                      // Stratum.
+	binary.BigEndian.PutUint32(b[4:], 1<<16/100)  // Root delay, 10ms.
+	binary.BigEndian.PutUint32(b[8:], 1<<16/1000) // Root dispersion, 1ms.
+	binary.BigEndian.PutUint64(b[24:], xmt)       // Origin.
+	binary.BigEndian.PutUint64(b[32:], toTimestamp(recv))
+	binary.BigEndian.PutUint64(b[40:], toTimestamp(xmit))
+	return b
+}
+
+func TestFromTimestamp(t *testing.T) {
+	date := func(y int, m time.Month, d, h, min, s int) time.Time {
+		return time.Date(y, m, d, h, min, s, 0, time.UTC)
+	}
+	// The last second of era 0 and the first of era 1.
+	eraEnd := date(2036, time.February, 7, 6, 28, 15)
+	eraStart := eraEnd.Add(time.Second)
+	tests := []struct {
+		name  string
+		ts    uint64
+		pivot time.Time
+		want  time.Time
+	}{
+		{"era 0", toTimestamp(date(2026, time.October, 18, 12, 0, 0)), MinValidTime, date(2026, time.October, 18, 12, 0, 0)},
+		{"fraction", toTimestamp(date(2026, time.October, 18, 12, 0, 0)) | 1<<31, MinValidTime, date(2026, time.October, 18, 12, 0, 0).Add(time.Second / 2)},
+		{"end of era 0", 0xffffffff << 32, date(2036, time.January, 1, 0, 0, 0), eraEnd},
+		{"start of era 1", 0, date(2036, time.January, 1, 0, 0, 0), eraStart},
+		{"era 1 from unset clock", toTimestamp(date(2040, time.May, 1, 0, 0, 0)), MinValidTime, date(2040, time.May, 1, 0, 0, 0)},
+		{"era 1 after rollover", toTimestamp(date(2036, time.March, 1, 0, 0, 0)), date(2036, time.February, 28, 0, 0, 0), date(2036, time.March, 1, 0, 0, 0)},
+		{"era 0 seen from era 1", 0xffffffff << 32, date(2036, time.March, 1, 0, 0, 0), eraEnd},
+		{"1900 is not chosen", 0, MinValidTime, eraStart},
+	}
+	for _, tt := range tests {
+		if got := fromTimestamp(tt.ts, tt.pivot); !got.Equal(tt.want) {
+			t.Errorf("%s: fromTimestamp(%#x, %v) = %v, want %v", tt.name, tt.ts, tt.pivot, got, tt.want)
+		}
+	}
+}
+
+func TestEraPivot(t *testing.T) {
+	if got := eraPivot(time.Unix(0, 0)); !got.Equal(MinValidTime) {
+		t.Errorf("unset clock: pivot %v, want %v", got, MinValidTime)
+	}
+	now := time.Date(2037, time.June, 1, 0, 0, 0, 0, time.UTC)
+	if got := eraPivot(now); !got.Equal(now) {
+		t.Errorf("set clock: pivot %v, want %v", got, now)
+	}
+}
+
+func TestParseReply(t *testing.T) {
+	const xmt = 0x0123456789abcdef
+	recv := time.Date(2026, time.October, 18, 12, 0, 0, 0, time.UTC)
+	xmit := recv.Add(time.Millisecond)
+	tests := []struct {
+		name    string
+		edit    func(b []byte) []byte
+		wantErr error
+	}{
+		{"ok", func(b []byte) []byte { return b }, nil},
+		{"short", func(b []byte) []byte { return b[:packetLen-1] }, errShortReply},
+		{"client mode", func(b []byte) []byte { b[0] = version<<3 | modeClient; return b }, errNotServer},
+		{"other request", func(b []byte) []byte { b[31]++; return b }, errBogusOrigin},
+		{"kiss-o'-death", func(b []byte) []byte { b[1] = 0; copy(b[12:], "RATE"); return b }, errKissOfDeath},
+		{"unsynchronised", func(b []byte) []byte { b[0] |= leapUnsynced << 6; return b }, errUnsynced},
+		{"stratum 16", func(b []byte) []byte { b[1] = 16; return b }, errUnsynced},
+		{"no transmit time", func(b []byte) []byte { clear(b[40:48]); return b }, errNoTransmitTS},
+		{"before 2025", func(b []byte) []byte {
+			binary.BigEndian.PutUint64(b[40:], toTimestamp(MinValidTime.Add(-time.Hour)))
+			return b
+		}, errInvalidTime},
+	}
+	for _, tt := range tests {
+		b := tt.edit(replyPacket(xmt, recv, xmit))
+		r, err := parseReply(b, xmt, MinValidTime)
+		if err != tt.wantErr {
+			t.Errorf("%s: err %v, want %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		// Fractions are truncated to whole nanoseconds both ways.
+		if r.stratum != 2 || r.recv.Sub(recv).Abs() > time.Microsecond || r.xmit.Sub(xmit).Abs() > time.Microsecond {
+			t.Errorf("%s: got %+v", tt.name, r)
+		}
+		// Half the 10ms root delay plus the 1ms dispersion, to within the
+		// 16.16 format's resolution.
+		if d := r.rootDist - 6*time.Millisecond; d < -100*time.Microsecond || d > 100*time.Microsecond {
+			t.Errorf("%s: root distance %v, want 6ms", tt.name, r.rootDist)
+		}
+	}
+}
+
+func TestAppendRequest(t *testing.T) {
+	b := appendRequest(nil, 0x0123456789abcdef)
+	if len(b) != packetLen {
+		t.Fatalf("request of %d bytes, want %d", len(b), packetLen)
+	}
+	if b[0] != version<<3|modeClient {
+		t.Errorf("first byte %#x, want version 4 client", b[0])
+	}
+	if got := binary.BigEndian.Uint64(b[40:]); got != 0x0123456789abcdef {
+		t.Errorf("transmit timestamp %#x", got)
+	}
+	for i, c := range b[1:40] {
+		if c != 0 {
+			t.Errorf("byte %d is %#x, want 0: the local time must not be sent", i+1, c)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// Package ntpcore is the part of the NTP client that does not depend on the
+// network stack: request and reply packets, NTP eras, and choosing an offset
+// from the replies of several servers. [Query] runs an exchange over any
+// [Transport]; package ntp runs it over the WiFi stack.
+package ntpcore
+
+import (
+	"cmp"
+	"errors"
+	"log/slog"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Transport carries the UDP datagrams of a query.
+type Transport interface {
+	// Listen calls fn with each datagram received on port, from the time
+	// it arrives, until Listen is called again with a nil fn.
+	Listen(port uint16, fn func(src netip.AddrPort, payload []byte)) error
+	// Send sends payload from port to dst.
+	Send(port uint16, dst netip.AddrPort, payload []byte) error
+	// Rand32 returns random bits for the port and transmit timestamps.
+	Rand32() uint32
+}
+
+// QueryConfig tunes [Query]. The zero value uses the defaults below.
+type QueryConfig struct {
+	// MaxServers bounds the servers queried. Defaults to 4.
+	MaxServers int
+	// Rounds is the number of requests sent to each server. Defaults to 4.
+	Rounds int
+	// RoundTimeout is how long a round waits for replies. Defaults to 2s.
+	RoundTimeout time.Duration
+	// RoundInterval spaces the rounds, as ntpd's iburst does, so servers
+	// don't rate limit them. Defaults to 2s.
+	RoundInterval time.Duration
+	// MaxDelay is the longest round trip a sample is used from. Defaults
+	// to 1s.
+	MaxDelay time.Duration
+}
+
+// ErrNoServers is returned by [Query] when given no servers.
+var ErrNoServers = errors.New("ntp: no servers")
+
+// request is a request awaiting its reply.
+type request struct {
+	server netip.Addr
+	xmt    uint64
+	sent   time.Time
+}
+
+// exchange collects the replies to a query's requests. The handler fills
+// it on the transport's goroutine while Query waits.
+type exchange struct {
+	mu      sync.Mutex
+	pivot   time.Time
+	pending []request
+	samples []Sample
+	errs    []error // Replies rejected by parseReply, for the log.
+	done    chan struct{}
+}
+
+// Query measures the offset of the system clock. Several requests are sent
+// to each of up to MaxServers of servers; the shortest round trip of each
+// server is kept, and the servers that agree choose the offset: the largest
+// set of servers whose error bounds overlap must be a majority of those that
+// replied, and the median of them is returned. If several servers were
+// queried, one reply alone is not enough.
+func Query(tr Transport, servers []netip.Addr, cfg QueryConfig, logger *slog.Logger) (Sample, error) {
+	cfg.MaxServers = cmp.Or(cfg.MaxServers, 4)
+	cfg.Rounds = cmp.Or(cfg.Rounds, 4)
+	cfg.RoundTimeout = cmp.Or(cfg.RoundTimeout, 2*time.Second)
+	cfg.RoundInterval = cmp.Or(cfg.RoundInterval, 2*time.Second)
+	cfg.MaxDelay = cmp.Or(cfg.MaxDelay, time.Second)
+	if len(servers) == 0 {
+		return Sample{}, ErrNoServers
+	}
+	servers = servers[:min(len(servers), cfg.MaxServers)]
+
+	ex := &exchange{
+		pivot: eraPivot(time.Now()),
+		done:  make(chan struct{}, 1),
+	}
+	port := uint16(49152 + tr.Rand32()%16384)
+	err := tr.Listen(port, ex.handle)
+	if err != nil {
+		return Sample{}, err
+	}
+	defer tr.Listen(port, nil)
+
+	buf := make([]byte, 0, packetLen)
+	for round := 0; round < cfg.Rounds; round++ {
+		if round > 0 {
+			time.Sleep(cfg.RoundInterval)
+		}
+		for _, server := range servers {
+			// A random transmit timestamp keeps the local time private
+			// and makes replies hard to forge (RFC 9109).
+			req := request{server: server, xmt: uint64(tr.Rand32())<<32 | uint64(tr.Rand32())}
+			buf = appendRequest(buf[:0], req.xmt)
+			req.sent = time.Now()
+			ex.mu.Lock()
+			ex.pending = append(ex.pending, req)
+			ex.mu.Unlock()
+			err = tr.Send(port, netip.AddrPortFrom(server, Port), buf)
+			if err != nil {
+				logger.Error("ntp:send-failed", slog.String("server", server.String()), slog.String("err", err.Error()))
+			}
+		}
+		ex.wait(cfg.RoundTimeout)
+	}
+
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	for _, err := range ex.errs {
+		logger.Warn("ntp:reply-rejected", slog.String("reason", err.Error()))
+	}
+	best := bestSamples(ex.samples, cfg.MaxDelay)
+	for _, s := range best {
+		logger.Info("ntp:server",
+			slog.String("server", s.Server.String()),
+			slog.Duration("offset", s.Offset),
+			slog.Duration("delay", s.Delay),
+		)
+	}
+	chosen, err := selectOffset(best, len(servers))
+	if err == errNoSamples && len(ex.samples) > 0 {
+		err = errors.New("ntp: all round trips over " + cfg.MaxDelay.String())
+	}
+	return chosen, err
+}
+
+// wait returns once every pending request has a reply, or after timeout.
+// Requests left unanswered are dropped.
+func (ex *exchange) wait(timeout time.Duration) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		ex.mu.Lock()
+		n := len(ex.pending)
+		ex.mu.Unlock()
+		if n == 0 {
+			return
+		}
+		select {
+		case <-ex.done:
+		case <-deadline.C:
+			ex.mu.Lock()
+			ex.pending = ex.pending[:0]
+			ex.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (ex *exchange) handle(src netip.AddrPort, payload []byte) {
+	t4 := time.Now()
+	if src.Port() != Port {
+		return
+	}
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	for i, req := range ex.pending {
+		if req.server != src.Addr() {
+			continue
+		}
+		r, err := parseReply(payload, req.xmt, ex.pivot)
+		if err == errBogusOrigin {
+			continue // Maybe the reply to another request to this server.
+		}
+		ex.pending = append(ex.pending[:i], ex.pending[i+1:]...)
+		if err != nil {
+			ex.errs = append(ex.errs, errors.New(req.server.String()+": "+err.Error()))
+		} else {
+			ex.samples = append(ex.samples, newSample(req.server, req.sent, t4, r))
+		}
+		select {
+		case ex.done <- struct{}{}:
+		default:
+		}
+		return
+	}
+}
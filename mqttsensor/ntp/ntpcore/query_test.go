@@ -0,0 +1,181 @@
+package ntpcore
+
+import (
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer is how a server on fakeNet answers.
+type fakeServer struct {
+	offset time.Duration // Its clock minus the local clock.
+	oneWay time.Duration // Network delay each way.
+	kod    bool          // Answers with a kiss-o'-death.
+	silent bool          // Never answers.
+}
+
+// fakeNet is an in-memory network of NTP servers.
+type fakeNet struct {
+	servers map[netip.Addr]fakeServer
+
+	mu     sync.Mutex
+	fn     func(src netip.AddrPort, payload []byte)
+	port   uint16
+	rand   uint32
+	sent   int
+	wg     sync.WaitGroup
+	closed bool
+}
+
+func (n *fakeNet) Listen(port uint16, fn func(src netip.AddrPort, payload []byte)) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.fn, n.port = fn, port
+	n.closed = fn == nil
+	return nil
+}
+
+func (n *fakeNet) Rand32() uint32 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.rand = n.rand*1664525 + 1013904223
+	return n.rand
+}
+
+func (n *fakeNet) Send(port uint16, dst netip.AddrPort, payload []byte) error {
+	n.mu.Lock()
+	n.sent++
+	n.mu.Unlock()
+	srv := n.servers[dst.Addr()]
+	if srv.silent || dst.Port() != Port || len(payload) != packetLen {
+		return nil
+	}
+	xmt := binary.BigEndian.Uint64(payload[40:])
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		time.Sleep(srv.oneWay)
+		recv := time.Now().Add(srv.offset)
+		reply := replyPacket(xmt, recv, recv.Add(100*time.Microsecond))
+		if srv.kod {
+			reply[1] = 0
+		}
+		time.Sleep(srv.oneWay)
+		n.deliver(netip.AddrPortFrom(dst.Addr(), 5000), reply) // Wrong port, ignored.
+		stray := replyPacket(xmt^1, recv, recv)
+		n.deliver(dst, stray) // Not a reply to this request, ignored.
+		n.deliver(dst, reply)
+	}()
+	return nil
+}
+
+func (n *fakeNet) deliver(src netip.AddrPort, payload []byte) {
+	n.mu.Lock()
+	fn := n.fn
+	n.mu.Unlock()
+	if fn != nil {
+		fn(src, payload)
+	}
+}
+
+func quietLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+var testQueryConfig = QueryConfig{
+	MaxServers:    6,
+	Rounds:        3,
+	RoundTimeout:  200 * time.Millisecond,
+	RoundInterval: time.Millisecond,
+}
+
+func TestQuery(t *testing.T) {
+	ms := time.Millisecond
+	n := &fakeNet{servers: map[netip.Addr]fakeServer{
+		serverA: {offset: 5 * time.Second, oneWay: 2 * ms},
+		serverB: {offset: 5*time.Second + 2*ms, oneWay: 3 * ms},
+		serverC: {offset: 5*time.Second - 2*ms, oneWay: 1 * ms},
+		serverD: {offset: time.Hour, oneWay: 1 * ms}, // Falseticker.
+		serverE: {kod: true, oneWay: 1 * ms},
+	}}
+	silent := netip.MustParseAddr("192.0.2.6")
+	n.servers[silent] = fakeServer{silent: true}
+
+	servers := []netip.Addr{serverA, serverB, serverC, serverD, serverE, silent}
+	got, err := Query(n, servers, testQueryConfig, quietLogger())
+	n.wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Server != serverA && got.Server != serverB && got.Server != serverC {
+		t.Errorf("chose %v, want one of the agreeing servers", got.Server)
+	}
+	if d := got.Offset - 5*time.Second; d.Abs() > 5*ms {
+		t.Errorf("offset %v, want 5s within 5ms", got.Offset)
+	}
+	if n.sent != testQueryConfig.Rounds*len(servers) {
+		t.Errorf("sent %d requests, want %d", n.sent, testQueryConfig.Rounds*len(servers))
+	}
+	if !n.closed {
+		t.Error("handler still registered after Query")
+	}
+	if n.port < 49152 {
+		t.Errorf("listened on port %d, want an ephemeral port", n.port)
+	}
+}
+
+func TestQueryMaxServers(t *testing.T) {
+	n := &fakeNet{servers: map[netip.Addr]fakeServer{}}
+	servers := []netip.Addr{serverA, serverB, serverC, serverD, serverE}
+	cfg := testQueryConfig
+	cfg.MaxServers, cfg.Rounds = 2, 1
+	Query(n, servers, cfg, quietLogger())
+	n.wg.Wait()
+	if n.sent != 2 {
+		t.Errorf("sent %d requests, want 2", n.sent)
+	}
+}
+
+func TestQueryErrors(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name    string
+		servers map[netip.Addr]fakeServer
+		cfg     QueryConfig
+		wantErr string
+	}{
+		{"no servers", nil, testQueryConfig, ErrNoServers.Error()},
+		{"no replies", map[netip.Addr]fakeServer{serverA: {silent: true}}, testQueryConfig, errNoSamples.Error()},
+		{"only kiss-o'-death", map[netip.Addr]fakeServer{serverA: {kod: true}}, testQueryConfig, errNoSamples.Error()},
+		{"round trips too long", map[netip.Addr]fakeServer{
+			serverA: {oneWay: 10 * ms},
+		}, QueryConfig{Rounds: 1, RoundTimeout: 200 * ms, MaxDelay: 5 * ms}, "all round trips over 5ms"},
+		{"no majority", map[netip.Addr]fakeServer{
+			serverA: {offset: 0},
+			serverB: {offset: time.Minute},
+		}, testQueryConfig, errNoAgreement.Error()},
+		{"one of two replied", map[netip.Addr]fakeServer{
+			serverA: {offset: time.Hour},
+			serverB: {silent: true},
+		}, testQueryConfig, errOneReply.Error()},
+	}
+	for _, tt := range tests {
+		n := &fakeNet{servers: tt.servers}
+		var servers []netip.Addr
+		for _, s := range []netip.Addr{serverA, serverB} {
+			if _, ok := tt.servers[s]; ok {
+				servers = append(servers, s)
+			}
+		}
+		_, err := Query(n, servers, tt.cfg, quietLogger())
+		n.wg.Wait()
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: err %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package ntpcore
+
+import (
+	"cmp"
+	"errors"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// Sample is the outcome of one request to a server.
+type Sample struct {
+	Server netip.Addr
+	Offset time.Duration // Server time minus local time.
+	Delay  time.Duration // Round trip, less the server's processing.
+	// RootDist is the server's distance from its reference clock.
+	RootDist time.Duration
+}
+
+// newSample computes a sample from the local send and receive times t1 and
+// t4 and the server's receive and transmit times t2 and t3.
+func newSample(server netip.Addr, t1, t4 time.Time, r reply) Sample {
+	s := Sample{
+		Server:   server,
+		Offset:   (r.recv.Sub(t1) + r.xmit.Sub(t4)) / 2,
+		Delay:    t4.Sub(t1) - r.xmit.Sub(r.recv),
+		RootDist: r.rootDist,
+	}
+	// A negative delay means the server's clock stepped or ran fast during
+	// the request; the offset is no worse than one with no delay.
+	s.Delay = max(s.Delay, 0)
+	return s
+}
+
+// HalfWidth is how far the true offset may be from s.Offset: half the
+// round trip, since the request and reply may have taken any share of it,
+// plus the server's own error bound.
+func (s Sample) HalfWidth() time.Duration {
+	return s.Delay/2 + s.RootDist
+}
+
+var (
+	errNoSamples   = errors.New("ntp: no usable replies")
+	errNoAgreement = errors.New("ntp: servers disagree")
+	errOneReply    = errors.New("ntp: only one of several servers replied")
+	// ErrUnconfirmed is returned by [ConfirmStep] when every other source
+	// disagrees with the offset.
+	ErrUnconfirmed = errors.New("ntp: offset not confirmed by another source")
+)
+
+// bestSamples keeps the sample with the shortest round trip from each
+// server, dropping those whose round trip exceeds maxDelay, since queueing
+// delays make an offset less accurate the longer the round trip. The
+// result is in the order servers were first seen.
+func bestSamples(samples []Sample, maxDelay time.Duration) []Sample {
+	var best []Sample
+	for _, s := range samples {
+		if s.Delay > maxDelay {
+			continue
+		}
+		i := slices.IndexFunc(best, func(b Sample) bool { return b.Server == s.Server })
+		if i < 0 {
+			best = append(best, s)
+		} else if s.Delay < best[i].Delay {
+			best[i] = s
+		}
+	}
+	return best
+}
+
+// selectOffset picks the offset to apply from the best sample of each of
+// the queried servers that replied. Each sample bounds the true offset to
+// an interval; the largest set of samples whose intervals overlap are the
+// truechimers, as in Marzullo's algorithm and RFC 5905 section 11.2.1.
+// They must be a majority of the servers that replied, and the result is
+// their median sample. A lone reply is only a majority if a single server
+// was queried, since nothing can be checked against it. The samples are
+// reordered.
+func selectOffset(best []Sample, queried int) (Sample, error) {
+	if len(best) == 0 {
+		return Sample{}, errNoSamples
+	}
+	if len(best) == 1 && queried > 1 {
+		return Sample{}, errOneReply
+	}
+	// Sweep the interval endpoints in order, counting how many intervals
+	// are open, to find where the most overlap.
+	type edge struct {
+		at   time.Duration
+		open int // 1 at the start of an interval, -1 at the end.
+	}
+	edges := make([]edge, 0, 2*len(best))
+	for _, s := range best {
+		edges = append(edges, edge{s.Offset - s.HalfWidth(), 1}, edge{s.Offset + s.HalfWidth(), -1})
+	}
+	slices.SortFunc(edges, func(a, b edge) int {
+		if c := cmp.Compare(a.at, b.at); c != 0 {
+			return c
+		}
+		return b.open - a.open // Starts first, so touching intervals overlap.
+	})
+	var open, most int
+	var lo, hi time.Duration
+	for i, e := range edges {
+		open += e.open
+		if open > most {
+			most = open
+			lo, hi = e.at, edges[i+1].at
+		}
+	}
+	if 2*most <= len(best) && len(best) > 1 {
+		return Sample{}, errNoAgreement
+	}
+
+	// The truechimers are the samples whose intervals contain [lo, hi].
+	chimers := best[:0]
+	for _, s := range best {
+		if s.Offset-s.HalfWidth() <= lo && s.Offset+s.HalfWidth() >= hi {
+			chimers = append(chimers, s)
+		}
+	}
+	slices.SortFunc(chimers, func(a, b Sample) int { return cmp.Compare(a.Offset, b.Offset) })
+	return chimers[len(chimers)/2], nil
+}
+
+// Witness is another source's measurement of the offset a sync found.
+type Witness struct {
+	Name     string
+	Offset   time.Duration
+	Accuracy time.Duration // How far the true offset may be from Offset.
+}
+
+// ConfirmStep checks an offset larger than bound, found before the clock
+// was synced, against the other sources that could measure it, such as an
+// RTC or an HTTP Date header. It succeeds if one of witnesses agrees to
+// within bound plus its accuracy, and returns the first to agree. With no
+// witnesses there is nothing to check against and it succeeds with none.
+func ConfirmStep(offset, bound time.Duration, witnesses []Witness) (Witness, error) {
+	for _, w := range witnesses {
+		diff := w.Offset - offset
+		if diff <= bound+w.Accuracy && diff >= -bound-w.Accuracy {
+			return w, nil
+		}
+	}
+	if len(witnesses) > 0 {
+		return Witness{}, ErrUnconfirmed
+	}
+	return Witness{}, nil
+}
@@ -0,0 +1,168 @@
+package ntpcore
+
+import (
+	"cmp"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+var (
+	serverA = netip.MustParseAddr("192.0.2.1")
+	serverB = netip.MustParseAddr("192.0.2.2")
+	serverC = netip.MustParseAddr("192.0.2.3")
+	serverD = netip.MustParseAddr("192.0.2.4")
+	serverE = netip.MustParseAddr("192.0.2.5")
+)
+
+func TestNewSample(t *testing.T) {
+	t1 := time.Date(2026, time.October, 18, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		t2, t3    time.Duration // After t1, on the server's clock.
+		t4        time.Duration // After t1.
+		offset    time.Duration
+		delay     time.Duration
+		halfWidth time.Duration
+	}{
+		// The server is 5s ahead; 20ms each way and 1ms processing.
+		{"symmetric", 5*time.Second + 20*time.Millisecond, 5*time.Second + 21*time.Millisecond, 41 * time.Millisecond, 5 * time.Second, 40 * time.Millisecond, 20*time.Millisecond + 3*time.Millisecond},
+		// 10ms out, 30ms back: the offset is out by half the difference.
+		{"asymmetric", -2*time.Second + 10*time.Millisecond, -2*time.Second + 10*time.Millisecond, 40 * time.Millisecond, -2*time.Second - 10*time.Millisecond, 40 * time.Millisecond, 23 * time.Millisecond},
+		// The server's clock stepped back during the request.
+		{"negative delay", 100 * time.Millisecond, 150 * time.Millisecond, 10 * time.Millisecond, 120 * time.Millisecond, 0, 3 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		r := reply{rootDist: 3 * time.Millisecond, recv: t1.Add(tt.t2), xmit: t1.Add(tt.t3)}
+		s := newSample(serverA, t1, t1.Add(tt.t4), r)
+		if s.Offset != tt.offset || s.Delay != tt.delay || s.HalfWidth() != tt.halfWidth || s.Server != serverA {
+			t.Errorf("%s: got offset %v, delay %v, half width %v; want %v, %v, %v",
+				tt.name, s.Offset, s.Delay, s.HalfWidth(), tt.offset, tt.delay, tt.halfWidth)
+		}
+	}
+}
+
+func TestBestSamples(t *testing.T) {
+	ms := time.Millisecond
+	samples := []Sample{
+		{Server: serverA, Offset: 10 * ms, Delay: 50 * ms},
+		{Server: serverB, Offset: 20 * ms, Delay: 1500 * ms}, // Over maxDelay.
+		{Server: serverA, Offset: 12 * ms, Delay: 30 * ms},   // Shorter, replaces the first.
+		{Server: serverC, Offset: 15 * ms, Delay: 40 * ms},
+		{Server: serverA, Offset: 11 * ms, Delay: 35 * ms},
+		{Server: serverC, Offset: 16 * ms, Delay: 40 * ms},    // Ties keep the first.
+		{Server: serverD, Offset: 9 * ms, Delay: time.Second}, // At maxDelay, kept.
+	}
+	got := bestSamples(samples, time.Second)
+	want := []Sample{samples[2], samples[3], samples[6]}
+	if len(got) != len(want) {
+		t.Fatalf("got %d samples %+v, want %d", len(got), got, len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("sample %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	if got := bestSamples(samples[1:2], time.Second); len(got) != 0 {
+		t.Errorf("all over maxDelay: got %+v", got)
+	}
+}
+
+func TestSelectOffset(t *testing.T) {
+	ms := time.Millisecond
+	// sample returns a sample whose interval is offset ± halfWidth.
+	sample := func(server netip.Addr, offset, halfWidth time.Duration) Sample {
+		return Sample{Server: server, Offset: offset, Delay: 2 * halfWidth}
+	}
+	tests := []struct {
+		name    string
+		best    []Sample
+		queried int // Servers queried, len(best) if zero.
+		want    netip.Addr
+		wantErr error
+	}{
+		{"none", nil, 0, netip.Addr{}, errNoSamples},
+		{"single server", []Sample{sample(serverA, 3*time.Second, 20*ms)}, 0, serverA, nil},
+		// Nothing confirms a lone reply when others went unanswered.
+		{"one of several replied", []Sample{sample(serverA, 3*time.Second, 20*ms)}, 3, netip.Addr{}, errOneReply},
+		{"two of four replied", []Sample{
+			sample(serverA, 1000*ms, 20*ms),
+			sample(serverB, 1010*ms, 20*ms),
+		}, 4, serverB, nil},
+		{"median of agreeing", []Sample{
+			sample(serverA, 1000*ms, 20*ms),
+			sample(serverB, 1010*ms, 20*ms),
+			sample(serverC, 1005*ms, 20*ms),
+		}, 0, serverC, nil},
+		{"outlier rejected", []Sample{
+			sample(serverA, 1000*ms, 20*ms),
+			sample(serverB, 61*time.Second, 20*ms), // Falseticker.
+			sample(serverC, 1010*ms, 20*ms),
+			sample(serverD, 1020*ms, 20*ms),
+		}, 0, serverC, nil},
+		{"two outliers of five", []Sample{
+			sample(serverA, -30*time.Second, 20*ms),
+			sample(serverB, 1000*ms, 20*ms),
+			sample(serverC, 1010*ms, 20*ms),
+			sample(serverD, 1020*ms, 20*ms),
+			sample(serverE, 30*time.Second, 20*ms),
+		}, 0, serverC, nil},
+		{"touching intervals agree", []Sample{
+			sample(serverA, 0, 10*ms),
+			sample(serverB, 20*ms, 10*ms),
+		}, 0, serverB, nil},
+		{"two disagreeing", []Sample{
+			sample(serverA, 0, 10*ms),
+			sample(serverB, time.Second, 10*ms),
+		}, 0, netip.Addr{}, errNoAgreement},
+		{"no majority", []Sample{
+			sample(serverA, 0, 10*ms),
+			sample(serverB, 5*ms, 10*ms),
+			sample(serverC, time.Second, 10*ms),
+			sample(serverD, 1005*ms, 10*ms),
+		}, 0, netip.Addr{}, errNoAgreement},
+		{"all disagree", []Sample{
+			sample(serverA, 0, 10*ms),
+			sample(serverB, time.Second, 10*ms),
+			sample(serverC, 2*time.Second, 10*ms),
+		}, 0, netip.Addr{}, errNoAgreement},
+	}
+	for _, tt := range tests {
+		got, err := selectOffset(tt.best, cmp.Or(tt.queried, len(tt.best)))
+		if err != tt.wantErr {
+			t.Errorf("%s: err %v, want %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if got.Server != tt.want {
+			t.Errorf("%s: chose %v (offset %v), want %v", tt.name, got.Server, got.Offset, tt.want)
+		}
+	}
+}
+
+func TestConfirmStep(t *testing.T) {
+	bound := 1000 * time.Second
+	// The clock is unset and NTP finds it 56 years out.
+	offset := 56 * 365 * 24 * time.Hour
+	rtc := Witness{Name: "rtc", Offset: offset + 2*time.Second}
+	http := Witness{Name: "http", Offset: offset - 1500*time.Second, Accuracy: time.Second}
+	stale := Witness{Name: "rtc", Offset: 0} // The clock was set from a wrong RTC.
+	tests := []struct {
+		name      string
+		witnesses []Witness
+		want      string
+		wantErr   error
+	}{
+		{"no witnesses", nil, "", nil},
+		{"rtc agrees", []Witness{rtc, http}, "rtc", nil},
+		{"rtc disagrees, http agrees", []Witness{stale, {Name: "http", Offset: offset + 900*time.Second, Accuracy: time.Second}}, "http", nil},
+		// The witness's accuracy widens the bound.
+		{"within accuracy", []Witness{{Name: "http", Offset: offset + bound + time.Second, Accuracy: time.Second}}, "http", nil},
+		{"all disagree", []Witness{stale, http}, "", ErrUnconfirmed},
+	}
+	for _, tt := range tests {
+		got, err := ConfirmStep(offset, bound, tt.witnesses)
+		if err != tt.wantErr || got.Name != tt.want {
+			t.Errorf("%s: ConfirmStep = %q, %v, want %q, %v", tt.name, got.Name, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package ntp
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/harveysanders/picoplayground/mqttsensor/cyw43439"
+	"github.com/harveysanders/picoplayground/mqttsensor/ntp/ntpcore"
+	"github.com/soypat/lneto/tcp"
+)
+
+// TimeSource is a source of wall time other than NTP, used when no NTP
+// server answers.
+type TimeSource interface {
+	// Name identifies the source in Status and the log.
+	Name() string
+	// Offset measures the source's time minus the system time, and the
+	// most the measurement may be out by.
+	Offset() (offset, accuracy time.Duration, err error)
+}
+
+const (
+	// httpTimeout bounds an HTTPDate request, from dialing to the end of
+	// the response header.
+	httpTimeout = 10 * time.Second
+	// httpBufSize holds the start of the response header. The Date field
+	// is usually near the top; servers with a longer header are read in
+	// pieces.
+	httpBufSize = 512
+)
+
+var errNoDate = errors.New("http: response has no Date header")
+
+// HTTPDate reads the time from the Date header of an HTTP server's
+// response, which nearly every server sends and which gets through
+// networks that only allow web traffic. The header has whole seconds, so
+// the time is only known to within half a second plus half the round
+// trip. Only plain HTTP is supported.
+type HTTPDate struct {
+	stack  *cyw43439.Stack
+	host   string
+	port   uint16
+	logger *slog.Logger
+}
+
+// NewHTTPDate returns a source asking server, a host name or address with
+// an optional port, which defaults to 80.
+func NewHTTPDate(stack *cyw43439.Stack, server string, logger *slog.Logger) (*HTTPDate, error) {
+	h := &HTTPDate{stack: stack, host: server, port: 80, logger: logger}
+	if host, port, err := net.SplitHostPort(server); err == nil {
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil || p == 0 {
+			return nil, errors.New("http: invalid port in " + strconv.Quote(server))
+		}
+		h.host, h.port = host, uint16(p)
+	}
+	if h.host == "" {
+		return nil, errors.New("http: no host in " + strconv.Quote(server))
+	}
+	return h, nil
+}
+
+// Name returns "http".
+func (h *HTTPDate) Name() string { return "http" }
+
+// Offset sends a HEAD request and compares the response's Date with the
+// middle of the round trip.
+func (h *HTTPDate) Offset() (offset, accuracy time.Duration, err error) {
+	addrs := resolve(h.stack, []string{h.host}, h.logger)
+	if len(addrs) == 0 {
+		return 0, 0, errors.New("http: cannot resolve " + h.host)
+	}
+	var conn tcp.Conn
+	err = conn.Configure(tcp.ConnConfig{
+		RxBuf:             make([]byte, httpBufSize),
+		TxBuf:             make([]byte, 128),
+		TxPacketQueueSize: 2,
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	defer stopConn(&conn)
+	defer h.stack.PollFast()()
+
+	rstack := h.stack.LnetoStack().StackRetrying(func(uint) time.Duration { return 5 * time.Millisecond })
+	port := uint16(49152 + h.stack.Prand32()%16384)
+	err = rstack.DoDialTCP(&conn, port, netip.AddrPortFrom(addrs[0], h.port), httpTimeout/2, 2)
+	if err != nil {
+		return 0, 0, err
+	}
+	conn.SetDeadline(time.Now().Add(httpTimeout))
+
+	req := "HEAD / HTTP/1.1\r\nHost: " + h.host + "\r\nConnection: close\r\n\r\n"
+	t1 := time.Now()
+	_, err = conn.Write([]byte(req))
+	if err != nil {
+		return 0, 0, err
+	}
+	h.stack.Notify()
+	date, t4, err := readDate(&conn)
+	if err != nil {
+		return 0, 0, err
+	}
+	return httpOffset(date, t1, t4)
+}
+
+// readDate reads the response header up to its Date field and returns it,
+// with the time the first bytes of the response arrived.
+func readDate(conn *tcp.Conn) ([]byte, time.Time, error) {
+	var buf [httpBufSize]byte
+	var t4 time.Time
+	n := 0
+	for {
+		got, err := conn.Read(buf[n:])
+		if t4.IsZero() && got > 0 {
+			t4 = time.Now()
+		}
+		n += got
+		// Look for the field in the complete lines read so far.
+		start := 0
+		for {
+			i := bytes.Index(buf[start:n], []byte("\r\n"))
+			if i < 0 {
+				break
+			}
+			line := buf[start : start+i]
+			start += i + 2
+			if len(line) == 0 {
+				return nil, t4, errNoDate // End of header.
+			}
+			name, value, ok := bytes.Cut(line, []byte(":"))
+			if ok && bytes.EqualFold(name, []byte("Date")) {
+				return bytes.TrimSpace(value), t4, nil
+			}
+		}
+		// Drop the lines checked; a partial line stays.
+		n = copy(buf[:], buf[start:n])
+		if err != nil {
+			return nil, t4, err
+		}
+		if n == len(buf) {
+			return nil, t4, errors.New("http: header line too long")
+		}
+	}
+}
+
+// httpOffset returns the offset and accuracy given by the Date field date
+// of a response to a request sent at t1 and answered at t4. The server
+// wrote the Date at some time in the round trip, and truncated it to the
+// second.
+func httpOffset(date []byte, t1, t4 time.Time) (offset, accuracy time.Duration, err error) {
+	t, err := time.Parse(time.RFC1123, string(date))
+	if err != nil {
+		return 0, 0, errors.New("http: bad Date " + strconv.Quote(string(date)))
+	}
+	if t.Before(ntpcore.MinValidTime) {
+		return 0, 0, errors.New("http: Date before " + ntpcore.MinValidTime.Format(time.DateOnly))
+	}
+	rtt := t4.Sub(t1)
+	mid := t1.Add(rtt / 2)
+	return t.Add(time.Second / 2).Sub(mid), rtt/2 + time.Second/2, nil
+}
+
+// stopConn closes conn, giving the server a moment to acknowledge, then
+// releases its port.
+func stopConn(conn *tcp.Conn) {
+	conn.Close()
+	for i := 0; i < 10 && !conn.State().IsClosed(); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	conn.Abort()
+}
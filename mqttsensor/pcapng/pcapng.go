@@ -0,0 +1,181 @@
+// Package pcapng encodes the pcapng capture format (draft-ietf-opsawg-pcapng),
+// just the blocks needed to stream Ethernet frames, and the line framing
+// used to carry them over a serial console that is shared with log output.
+//
+// All blocks are little-endian and timestamps have the default resolution
+// of microseconds.
+package pcapng
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"time"
+)
+
+// LinkTypeEthernet is the LINKTYPE_ETHERNET interface link type.
+const LinkTypeEthernet = 1
+
+// Block types.
+const (
+	BlockSectionHeader        = 0x0a0d0d0a
+	BlockInterfaceDescription = 0x00000001
+	BlockInterfaceStatistics  = 0x00000005
+	BlockEnhancedPacket       = 0x00000006
+)
+
+const byteOrderMagic = 0x1a2b3c4d
+
+// Option codes.
+const (
+	optEndOfOpt = 0
+	optEPBFlags = 2
+	optISBRecv  = 4 // isb_ifrecv
+	optISBDrop  = 5 // isb_ifdrop
+)
+
+// Direction is the packet direction recorded in an enhanced packet block's
+// flags.
+type Direction uint32
+
+const (
+	DirUnknown  Direction = 0
+	DirInbound  Direction = 1
+	DirOutbound Direction = 2
+)
+
+// AppendSectionHeader appends a section header block of unspecified length.
+// A new section starts a new capture: readers forget earlier interfaces.
+func AppendSectionHeader(dst []byte) []byte {
+	dst, start := beginBlock(dst, BlockSectionHeader)
+	dst = binary.LittleEndian.AppendUint32(dst, byteOrderMagic)
+	dst = binary.LittleEndian.AppendUint16(dst, 1) // Major version.
+	dst = binary.LittleEndian.AppendUint16(dst, 0) // Minor version.
+	dst = binary.LittleEndian.AppendUint64(dst, ^uint64(0))
+	return endBlock(dst, start)
+}
+
+// AppendInterfaceDescription appends an interface description block. The
+// interfaces of a section are numbered from zero in the order described.
+// A snapLen of zero means frames are not truncated.
+func AppendInterfaceDescription(dst []byte, linkType uint16, snapLen uint32) []byte {
+	dst, start := beginBlock(dst, BlockInterfaceDescription)
+	dst = binary.LittleEndian.AppendUint16(dst, linkType)
+	dst = binary.LittleEndian.AppendUint16(dst, 0) // Reserved.
+	dst = binary.LittleEndian.AppendUint32(dst, snapLen)
+	return endBlock(dst, start)
+}
+
+// AppendEnhancedPacket appends an enhanced packet block for interface 0.
+// data is the captured part of a frame of origLen bytes.
+func AppendEnhancedPacket(dst []byte, ts time.Time, data []byte, origLen int, dir Direction) []byte {
+	dst, start := beginBlock(dst, BlockEnhancedPacket)
+	dst = binary.LittleEndian.AppendUint32(dst, 0) // Interface ID.
+	dst = appendTimestamp(dst, ts)
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(data)))
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(origLen))
+	dst = append(dst, data...)
+	dst = pad(dst)
+	if dir != DirUnknown {
+		dst = appendOptionHeader(dst, optEPBFlags, 4)
+		dst = binary.LittleEndian.AppendUint32(dst, uint32(dir))
+		dst = appendOptionHeader(dst, optEndOfOpt, 0)
+	}
+	return endBlock(dst, start)
+}
+
+// AppendInterfaceStatistics appends an interface statistics block for
+// interface 0 with the number of frames seen and dropped.
+func AppendInterfaceStatistics(dst []byte, ts time.Time, received, dropped uint64) []byte {
+	dst, start := beginBlock(dst, BlockInterfaceStatistics)
+	dst = binary.LittleEndian.AppendUint32(dst, 0) // Interface ID.
+	dst = appendTimestamp(dst, ts)
+	dst = appendOptionHeader(dst, optISBRecv, 8)
+	dst = binary.LittleEndian.AppendUint64(dst, received)
+	dst = appendOptionHeader(dst, optISBDrop, 8)
+	dst = binary.LittleEndian.AppendUint64(dst, dropped)
+	dst = appendOptionHeader(dst, optEndOfOpt, 0)
+	return endBlock(dst, start)
+}
+
+// BlockType returns the type of the block at the start of b, or 0 if b is
+// too short to hold one.
+func BlockType(b []byte) uint32 {
+	if len(b) < 12 {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+// beginBlock appends a block header whose length is patched by endBlock.
+func beginBlock(dst []byte, typ uint32) ([]byte, int) {
+	start := len(dst)
+	dst = binary.LittleEndian.AppendUint32(dst, typ)
+	dst = binary.LittleEndian.AppendUint32(dst, 0)
+	return dst, start
+}
+
+// endBlock appends the trailing length of the block starting at start and
+// sets its leading length.
+func endBlock(dst []byte, start int) []byte {
+	n := uint32(len(dst) - start + 4)
+	binary.LittleEndian.PutUint32(dst[start+4:], n)
+	return binary.LittleEndian.AppendUint32(dst, n)
+}
+
+func appendTimestamp(dst []byte, ts time.Time) []byte {
+	us := uint64(ts.UnixMicro())
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(us>>32))
+	return binary.LittleEndian.AppendUint32(dst, uint32(us))
+}
+
+func appendOptionHeader(dst []byte, code, length uint16) []byte {
+	dst = binary.LittleEndian.AppendUint16(dst, code)
+	return binary.LittleEndian.AppendUint16(dst, length)
+}
+
+// pad pads dst to a multiple of 4 bytes, which every block and option
+// boundary falls on.
+func pad(dst []byte) []byte {
+	for len(dst)%4 != 0 {
+		dst = append(dst, 0)
+	}
+	return dst
+}
+
+// Serial framing. Each block is sent as one line of text: LinePrefix, the
+// block in standard base64, and a newline. Log lines never start with the
+// prefix, so a reader can pick the blocks out of a console stream.
+
+// LinePrefix starts every line that carries a block.
+const LinePrefix = "#pcapng:"
+
+// AppendLine appends block framed as a line.
+func AppendLine(dst, block []byte) []byte {
+	dst = append(dst, LinePrefix...)
+	dst = base64.StdEncoding.AppendEncode(dst, block)
+	return append(dst, '\n')
+}
+
+// DecodeLine appends the block carried by line to dst. ok is false if the
+// line doesn't carry a block or is corrupt. line may end with "\n" or
+// "\r\n".
+func DecodeLine(dst, line []byte) (block []byte, ok bool) {
+	if len(line) < len(LinePrefix) || string(line[:len(LinePrefix)]) != LinePrefix {
+		return dst, false
+	}
+	line = line[len(LinePrefix):]
+	for len(line) > 0 && (line[len(line)-1] == '\n' || line[len(line)-1] == '\r') {
+		line = line[:len(line)-1]
+	}
+	start := len(dst)
+	dst, err := base64.StdEncoding.AppendDecode(dst, line)
+	if err != nil {
+		return dst[:start], false
+	}
+	b := dst[start:]
+	if len(b) < 12 || len(b)%4 != 0 || binary.LittleEndian.Uint32(b[4:]) != uint32(len(b)) ||
+		binary.LittleEndian.Uint32(b[len(b)-4:]) != uint32(len(b)) {
+		return dst[:start], false
+	}
+	return dst, true
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/harveysanders/picoplayground/mqttsensor/cyw43439"
+	"github.com/harveysanders/picoplayground/mqttsensor/mqtt"
+)
+
+// dutyCycleMinutes, if set, turns the radio off between flushes: readings
+// are sampled and buffered locally, and WiFi and MQTT are brought up every
+// this many minutes to publish them. Can be passed via linker flags.
+var dutyCycleMinutes string
+
+const (
+	// maxBufferedReadings bounds the readings held between duty cycle
+	// flushes, about 28 KiB. Later readings are dropped until the flush.
+	maxBufferedReadings = 512
+	// flushTimeout is how long a flush may take before the radio is turned
+	// off anyway.
+	flushTimeout = time.Minute
+)
+
+// dutyCycle returns the interval between duty cycle flushes, or 0 if the
+// radio stays on.
+func dutyCycle(logger *slog.Logger) time.Duration {
+	if dutyCycleMinutes == "" {
+		return 0
+	}
+	n, err := strconv.ParseUint(dutyCycleMinutes, 10, 16)
+	if err != nil || n == 0 {
+		logger.Error("power:duty-cycle-disabled", slog.String("reason", "invalid minutes "+strconv.Quote(dutyCycleMinutes)))
+		return 0
+	}
+	return time.Duration(n) * time.Minute
+}
+
+// readingsBuffer returns the capacity of the readings channel: enough for
+// a duty cycle's readings, or a few while the radio stays on.
+func readingsBuffer(flushInterval, sampleInterval time.Duration) int {
+	if flushInterval == 0 {
+		return 10
+	}
+	return min(int(flushInterval/sampleInterval)+10, maxBufferedReadings)
+}
+
+// runDutyCycle waits for the buffered readings to be published, turns the
+// radio off for interval, and brings it back up to publish the readings
+// taken meanwhile. It never returns.
+func runDutyCycle(logger *slog.Logger, sv *cyw43439.Supervisor, mqttC *mqtt.Client, readings chan mqtt.SensorReading, interval time.Duration) {
+	for {
+		deadline := time.Now().Add(flushTimeout)
+		for !(mqttC.Connected() && len(readings) == 0) && time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if len(readings) > 0 {
+			logger.Error("power:flush-incomplete", slog.Int("buffered", len(readings)))
+		}
+		// Let the last reading taken off the channel be published.
+		time.Sleep(time.Second)
+
+		sv.Suspend()
+		for {
+			time.Sleep(interval)
+			addr, err := sv.Resume()
+			if err == nil {
+				logger.Info("power:radio-on", slog.String("ip", addr.String()), slog.Int("buffered", len(readings)))
+				break
+			}
+			logger.Error("power:resume-failed", slog.String("reason", err.Error()))
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"log/slog"
+	"machine"
+
+	"github.com/harveysanders/picoplayground/mqttsensor/config"
+	"github.com/harveysanders/picoplayground/mqttsensor/cyw43439"
+	"github.com/harveysanders/picoplayground/mqttsensor/httpd"
+	"github.com/harveysanders/picoplayground/mqttsensor/lcd"
+)
+
+// apPassword is the WPA2 passphrase of the setup access point, 8 to 63
+// characters. If empty the access point is open.
+// Can be passed via linker flags.
+var apPassword string
+
+const (
+	// setupSSID is the access point started in setup mode. It fits the
+	// 16 character LCD line.
+	setupSSID = "mqttsensor-setup"
+	setupURL  = "http://192.168.4.1/"
+)
+
+// provisioner serves the setup page and stores the submitted settings.
+type provisioner struct {
+	logger  *slog.Logger
+	current config.Config // Prefills the form.
+	lcdMsgs chan lcd.Message
+}
+
+// runProvisioning starts an access point with a captive configuration page
+// for WiFi, broker and device settings. Once settings are saved to flash
+// the device reboots to use them in station mode. It never returns.
+func runProvisioning(logger *slog.Logger, lcdMessages chan lcd.Message, current config.Config) {
+	lcd.Send(lcdMessages, "Setup mode", "Starting AP...")
+	stack, err := cyw43439.NewConfiguredPicoAP(
+		cyw43439.APConfig{
+			SSID:       setupSSID,
+			Password:   apPassword,
+			CaptiveDNS: true,
+		},
+		cyw43439.DefaultWifiConfig(),
+		cyw43439.StackConfig{
+			Hostname:    current.DeviceName,
+			MaxTCPPorts: 1,
+			Logger:      logger,
+		},
+	)
+	if err != nil {
+		printErrForever(logger, "setup access point", slog.Any("reason", err))
+	}
+	startCapture(logger, stack)
+	go stack.Loop(loopConfig(logger))
+
+	p := &provisioner{
+		logger:  logger,
+		current: current,
+		lcdMsgs: lcdMessages,
+	}
+	sv, err := httpd.New(stack.LnetoStack(), p.handle, httpd.Config{
+		MaxRequest: 2048,
+		Logger:     logger,
+	})
+	if err != nil {
+		printErrForever(logger, "setup http server", slog.Any("reason", err))
+	}
+	lcd.Send(lcdMessages, "Join WiFi:", setupSSID)
+	logger.Info("setup:ready", slog.String("ssid", setupSSID), slog.String("url", setupURL))
+	sv.Serve()
+}
+
+func (p *provisioner) handle(w *httpd.ResponseWriter, r *httpd.Request) {
+	switch {
+	case r.Path == "/" && r.Method == "GET":
+		writePageHead(w, "mqttsensor setup")
+		writeSettingsForm(w, "/save", p.current, "")
+		w.WriteString(pageTail)
+	case r.Path == "/save" && r.Method == "POST":
+		p.save(w, r)
+	default:
+		// Connectivity checks by phones and laptops land here and get
+		// redirected, which makes them open the setup page.
+		httpd.Redirect(w, setupURL, httpd.StatusFound)
+	}
+}
+
+func (p *provisioner) save(w *httpd.ResponseWriter, r *httpd.Request) {
+	cfg, err := parseSettingsForm(r, p.current)
+	if err == nil {
+		err = config.Save(machine.Flash, cfg)
+	}
+	if err != nil {
+		p.current = cfg // Prefill the form with what was entered.
+		w.WriteHeader(httpd.StatusBadRequest)
+		writePageHead(w, "mqttsensor setup")
+		writeSettingsForm(w, "/save", p.current, err.Error())
+		w.WriteString(pageTail)
+		return
+	}
+	p.logger.Info("setup:saved", slog.String("ssid", cfg.SSID), slog.String("name", cfg.DeviceName))
+	lcd.Send(p.lcdMsgs, "Settings saved", "Rebooting...")
+	writePageHead(w, "mqttsensor setup")
+	w.WriteString("<p>Settings saved. The device is restarting and will join <b>")
+	w.WriteEscaped(cfg.SSID)
+	w.WriteString("</b>.</p>")
+	w.WriteString(pageTail)
+	rebootSoon()
+}
@@ -0,0 +1,151 @@
+// Package rtc keeps wall time across reboots in a battery backed real time
+// clock on the I2C bus, a DS3231 or a PCF8523.
+package rtc
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"tinygo.org/x/drivers"
+	"tinygo.org/x/drivers/ds3231"
+	"tinygo.org/x/drivers/pcf8523"
+)
+
+// Address is the I2C address of both chips.
+const Address = 0x68
+
+const (
+	// pcfSeconds is the PCF8523 seconds register. Its top bit is the OS
+	// flag, set when the oscillator stopped and the time was lost.
+	pcfSeconds = 0x03
+	pcfOS      = 1 << 7
+	// tickPoll is how often Offset reads the clock while it waits for the
+	// seconds to change, and so its resolution.
+	tickPoll = 5 * time.Millisecond
+)
+
+var (
+	// ErrNotFound means nothing answered at Address.
+	ErrNotFound = errors.New("rtc: no clock at 0x68")
+	// ErrTimeLost means the clock's oscillator stopped, because the
+	// battery is flat or missing, and the time must be set again.
+	ErrTimeLost               = errors.New("rtc: time lost")
+	ErrTemperatureUnsupported = errors.New("rtc: chip has no temperature sensor")
+	errNoTick                 = errors.New("rtc: seconds did not change")
+)
+
+// Clock is a DS3231 or PCF8523 real time clock. It keeps UTC.
+type Clock struct {
+	bus  drivers.I2C
+	chip string
+	ds   ds3231.Device
+	pcf  pcf8523.Device
+}
+
+// New returns the clock of the named chip, "ds3231" or "pcf8523", after
+// checking that it answers. The bus must already be configured.
+func New(bus drivers.I2C, chip string) (*Clock, error) {
+	c := &Clock{bus: bus, chip: strings.ToLower(chip)}
+	switch c.chip {
+	case "ds3231":
+		c.ds = ds3231.New(bus)
+	case "pcf8523":
+		c.pcf = pcf8523.New(bus)
+	default:
+		return nil, errors.New("rtc: unknown chip " + chip + ", want ds3231 or pcf8523")
+	}
+	var b [1]byte
+	if bus.Tx(Address, []byte{0}, b[:]) != nil {
+		return nil, ErrNotFound
+	}
+	if c.chip == "pcf8523" {
+		// Out of reset the PCF8523 does not switch to its battery.
+		err := c.pcf.SetPowerManagement(pcf8523.PowerManagement_SwitchOver_ModeStandard)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Chip returns the chip name, in upper case as printed on it.
+func (c *Clock) Chip() string {
+	return strings.ToUpper(c.chip)
+}
+
+// read returns the clock's time, which has whole seconds.
+func (c *Clock) read() (time.Time, error) {
+	if c.chip == "ds3231" {
+		return c.ds.ReadTime()
+	}
+	return c.pcf.ReadTime()
+}
+
+// valid reports whether the clock has kept time since it was last set.
+func (c *Clock) valid() (bool, error) {
+	if c.chip == "ds3231" {
+		return c.ds.IsTimeValid() && c.ds.IsRunning(), nil
+	}
+	var b [1]byte
+	err := c.bus.Tx(Address, []byte{pcfSeconds}, b[:])
+	return b[0]&pcfOS == 0, err
+}
+
+// Offset returns the clock's time minus the system time. The clock only
+// counts whole seconds, so Offset waits up to a second for them to change
+// and compares the times at that instant, to within 5ms.
+func (c *Clock) Offset() (time.Duration, error) {
+	ok, err := c.valid()
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, ErrTimeLost
+	}
+	first, err := c.read()
+	if err != nil {
+		return 0, err
+	}
+	deadline := time.Now().Add(1100 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		time.Sleep(tickPoll)
+		t, err := c.read()
+		if err != nil {
+			return 0, err
+		}
+		if !t.Equal(first) {
+			// The seconds changed within the last poll; take the middle.
+			return t.Sub(time.Now().Add(-tickPoll / 2)), nil
+		}
+	}
+	return 0, errNoTick
+}
+
+// Set sets the clock to the system time. It waits for the next whole
+// second of the system time so that the clock's seconds start with it.
+func (c *Clock) Set() error {
+	now := time.Now()
+	next := now.Truncate(time.Second).Add(time.Second)
+	time.Sleep(next.Sub(now))
+	if c.chip == "ds3231" {
+		// Clears the oscillator stop flag as well.
+		err := c.ds.SetTime(next.UTC())
+		if err != nil {
+			return err
+		}
+		return c.ds.SetRunning(true)
+	}
+	// Writing the seconds clears the OS flag.
+	return c.pcf.SetTime(next.UTC())
+}
+
+// Temperature returns the DS3231's die temperature in millidegrees Celsius,
+// which it measures every 64 seconds to compensate its crystal. The
+// PCF8523 has no sensor and returns ErrTemperatureUnsupported.
+func (c *Clock) Temperature() (int32, error) {
+	if c.chip != "ds3231" {
+		return 0, ErrTemperatureUnsupported
+	}
+	return c.ds.ReadTemperature()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"machine"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/harveysanders/picoplayground/mqttsensor/config"
+	"github.com/harveysanders/picoplayground/mqttsensor/httpd"
+	"github.com/harveysanders/picoplayground/mqttsensor/mqtt"
+)
+
+// The settings form is shared by setup mode and the web interface. Saved
+// settings take effect after a reboot.
+
+var rebootOnce sync.Once
+
+// rebootSoon restarts the device once the current response has had time
+// to reach the client.
+func rebootSoon() {
+	rebootOnce.Do(func() {
+		go func() {
+			time.Sleep(2 * time.Second)
+			machine.CPUReset()
+		}()
+	})
+}
+
+// parseSettingsForm returns the settings submitted with r. Blank password
+// fields keep the passwords in cur; the WiFi password only if the network
+// is unchanged.
+func parseSettingsForm(r *httpd.Request, cur config.Config) (config.Config, error) {
+	cfg := config.Config{
+		SSID:          r.FormValue("ssid"),
+		Password:      r.FormValue("pass"),
+		BrokerURL:     r.FormValue("broker"),
+		DeviceName:    r.FormValue("name"),
+		AdminPassword: r.FormValue("admin"),
+	}
+	if cfg.Password == "" && cfg.SSID == cur.SSID {
+		cfg.Password = cur.Password
+	}
+	if cfg.AdminPassword == "" {
+		cfg.AdminPassword = cur.AdminPassword
+	}
+	if v := r.FormValue("interval"); v != "" {
+		sec, err := strconv.ParseUint(v, 10, 16)
+		if err != nil || sec == 0 {
+			return cfg, errors.New("sample interval must be a whole number of seconds")
+		}
+		cfg.SampleIntervalSec = uint16(sec)
+	}
+	if cfg.BrokerURL != "" {
+		_, err := mqtt.ParseBrokerURL(cfg.BrokerURL)
+		if err != nil {
+			return cfg, errors.New("broker URL: " + err.Error())
+		}
+	}
+	return cfg, cfg.Validate()
+}
+
+// writeSettingsForm writes a form posting to action, prefilled with cur.
+// Passwords are never sent back to the browser.
+func writeSettingsForm(w *httpd.ResponseWriter, action string, cur config.Config, errMsg string) {
+	if errMsg != "" {
+		w.WriteString(`<p class="err">`)
+		w.WriteEscaped(errMsg)
+		w.WriteString("</p>")
+	}
+	w.WriteString(`<form method="post" action="`)
+	w.WriteString(action)
+	w.WriteString(`"><label>WiFi network<input name="ssid" required maxlength="32" value="`)
+	w.WriteEscaped(cur.SSID)
+	w.WriteString(`"></label><label>WiFi password<input name="pass" type="password" maxlength="63" placeholder="Blank keeps the saved password"></label>`)
+	w.WriteString(`<label>MQTT broker<input name="broker" maxlength="255" placeholder="Blank finds one via mDNS" value="`)
+	w.WriteEscaped(cur.BrokerURL)
+	w.WriteString(`"></label><label>Device name<input name="name" required maxlength="63" value="`)
+	w.WriteEscaped(cur.DeviceName)
+	w.WriteString(`"></label><label>Sample interval (seconds)<input name="interval" type="number" min="1" max="`)
+	w.WriteString(strconv.Itoa(config.MaxSampleIntervalSec))
+	w.WriteString(`" placeholder="`)
+	w.WriteString(strconv.Itoa(defaultSampleIntervalSec))
+	w.WriteString(`" value="`)
+	if cur.SampleIntervalSec > 0 {
+		w.WriteString(strconv.Itoa(int(cur.SampleIntervalSec)))
+	}
+	w.WriteString(`"></label><label>Web interface password (user "`)
+	w.WriteString(webUser)
+	w.WriteString(`")<input name="admin" type="password" maxlength="63" placeholder="Blank keeps the current password"></label>`)
+	w.WriteString(`<button>Save and restart</button></form>`)
+}
+
+// writePageHead writes the common page header. Pages end with pageTail.
+func writePageHead(w *httpd.ResponseWriter, title string) {
+	w.SetHeader("Content-Type", "text/html; charset=utf-8")
+	w.SetHeader("Cache-Control", "no-store")
+	w.WriteString(`<!DOCTYPE html><html><head><meta charset="utf-8">` +
+		`<meta name="viewport" content="width=device-width,initial-scale=1"><title>`)
+	w.WriteEscaped(title)
+	w.WriteString(`</title><style>body{font-family:sans-serif;max-width:28em;margin:1em auto;padding:0 1em}` +
+		`label{display:block;margin:.8em 0}input{display:block;width:100%;padding:.4em;box-sizing:border-box}` +
+		`button{padding:.6em 1.2em}.err{color:#b00}th{text-align:left;padding-right:1em}</style></head><body><h1>`)
+	w.WriteEscaped(title)
+	w.WriteString("</h1>")
+}
+
+const pageTail = "</body></html>"
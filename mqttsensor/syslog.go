@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log/slog"
+	"machine"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/harveysanders/picoplayground/mqttsensor/cyw43439"
+	"github.com/harveysanders/picoplayground/mqttsensor/syslog"
+)
+
+// syslogAddr is the address of a syslog collector, as "host" or
+// "host:port" with port 514 by default. When set, logs are sent there over
+// UDP as well as to the serial console. Can be passed via linker flags.
+var syslogAddr string
+
+// syslogHandler queues records for the collector. Nil unless syslogAddr
+// is set.
+var syslogHandler *syslog.Handler
+
+// newLogger returns the logger writing to the serial console and, if
+// syslogAddr is set, queueing for the collector until startSyslog.
+func newLogger() *slog.Logger {
+	serial := slog.NewTextHandler(machine.Serial, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+	})
+	if syslogAddr == "" {
+		return slog.New(serial)
+	}
+	syslogHandler = syslog.NewHandler(syslog.Options{})
+	return slog.New(syslog.Tee(serial, syslogHandler))
+}
+
+// startSyslog resolves the collector and starts sending queued records,
+// identifying the device as hostname. It must be called once the stack has
+// an address.
+func startSyslog(logger *slog.Logger, stack *cyw43439.Stack, hostname string) {
+	if syslogHandler == nil {
+		return
+	}
+	host, port := syslogAddr, uint16(syslog.Port)
+	if h, p, err := net.SplitHostPort(syslogAddr); err == nil {
+		n, err := strconv.ParseUint(p, 10, 16)
+		if err != nil || n == 0 {
+			logger.Error("syslog:disabled", slog.String("reason", "invalid port "+strconv.Quote(p)))
+			return
+		}
+		host, port = h, uint16(n)
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		addrs, err := stack.LookupIP(host, 5*time.Second, 3)
+		if err != nil || len(addrs) == 0 {
+			reason := "no addresses returned"
+			if err != nil {
+				reason = err.Error()
+			}
+			logger.Error("syslog:disabled", slog.String("host", host), slog.String("reason", reason))
+			return
+		}
+		addr = addrs[0]
+	}
+	collector := netip.AddrPortFrom(addr, port)
+	go syslogHandler.Run(stack, collector, hostname)
+	logger.Info("syslog:started", slog.String("collector", collector.String()))
+}
@@ -0,0 +1,287 @@
+// Package syslog provides an [slog.Handler] that sends log records to a
+// syslog collector as RFC 5424 messages over UDP (RFC 5426), through the
+// cyw43439 stack.
+//
+// Records are formatted when logged and queued; [Handler.Run] sends them
+// from its own goroutine. The queue is bounded and logging never waits for
+// the network: records that find it full are dropped and counted. Records
+// logged before Run starts, e.g. during WiFi setup, wait in the queue.
+//
+// The message text is the record in the same key=value form as
+// [slog.TextHandler], without the time and level, which are carried in the
+// syslog header. Use [Tee] to log to the serial console as well.
+package syslog
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/harveysanders/picoplayground/mqttsensor/cyw43439"
+)
+
+// Port is the syslog UDP port, used as both source and default destination.
+const Port = 514
+
+const (
+	// maxMessage is the largest message sent. Collectors must accept 480
+	// bytes (RFC 5426 section 3.2); longer records are truncated.
+	maxMessage = 480
+	// Limits on the header fields, shorter than RFC 5424 allows so the
+	// header leaves most of maxMessage for the text.
+	maxHostName = 64
+	maxAppName  = 48
+	// maxHeader bounds the header: PRI and version, timestamp, host name,
+	// app name and the nil PROCID, MSGID and STRUCTURED-DATA.
+	maxHeader = 7 + 27 + 1 + maxHostName + 1 + maxAppName + 7
+	maxBody   = maxMessage - maxHeader
+
+	defaultQueueLen = 8
+	defaultAppName  = "mqttsensor"
+)
+
+// Facility is a syslog facility code.
+type Facility uint8
+
+// Facilities applications may log as.
+const (
+	FacilityUser   Facility = 1
+	FacilityDaemon Facility = 3
+	FacilityLocal0 Facility = 16
+	FacilityLocal1 Facility = 17
+	FacilityLocal2 Facility = 18
+	FacilityLocal3 Facility = 19
+	FacilityLocal4 Facility = 20
+	FacilityLocal5 Facility = 21
+	FacilityLocal6 Facility = 22
+	FacilityLocal7 Facility = 23
+)
+
+// Options configures a [Handler].
+type Options struct {
+	// Level is the minimum level sent. Nil means [slog.LevelInfo].
+	Level slog.Leveler
+	// Facility defaults to FacilityLocal0.
+	Facility Facility
+	// AppName is the APP-NAME field. Defaults to "mqttsensor".
+	AppName string
+	// QueueLen is the number of records that can await sending. Each
+	// takes about 500 bytes. Defaults to 8.
+	QueueLen int
+}
+
+type record struct {
+	time     time.Time
+	severity uint8
+	n        int
+	body     [maxBody]byte
+}
+
+// queue is shared by a Handler and those derived from it with WithAttrs
+// and WithGroup.
+type queue struct {
+	mu     sync.Mutex
+	slots  []record
+	head   int
+	queued int
+	// next is the record being formatted by the text handler.
+	next    record
+	ready   chan struct{}
+	dropped atomic.Uint64
+	sent    atomic.Uint64
+}
+
+// Write is called by the text handler with one formatted record while
+// Handler.Handle holds q.mu.
+func (q *queue) Write(p []byte) (int, error) {
+	p = bytes.TrimSuffix(p, []byte{'\n'})
+	q.next.n = copy(q.next.body[:], p)
+	return len(p), nil
+}
+
+// Handler is a [slog.Handler] that queues records for a syslog collector.
+type Handler struct {
+	opts  Options
+	text  slog.Handler
+	queue *queue
+}
+
+// NewHandler returns a handler that queues records until [Handler.Run]
+// sends them.
+func NewHandler(opts Options) *Handler {
+	if opts.Level == nil {
+		opts.Level = slog.LevelInfo
+	}
+	if opts.Facility == 0 {
+		opts.Facility = FacilityLocal0
+	}
+	if opts.AppName == "" {
+		opts.AppName = defaultAppName
+	}
+	if opts.QueueLen <= 0 {
+		opts.QueueLen = defaultQueueLen
+	}
+	q := &queue{
+		slots: make([]record, opts.QueueLen),
+		ready: make(chan struct{}, 1),
+	}
+	return &Handler{
+		opts:  opts,
+		queue: q,
+		text: slog.NewTextHandler(q, &slog.HandlerOptions{
+			Level: slog.LevelDebug, // Filtered by Enabled.
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey) {
+					return slog.Attr{}
+				}
+				return a
+			},
+		}),
+	}
+}
+
+// Enabled implements [slog.Handler].
+func (h *Handler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.opts.Level.Level()
+}
+
+// Handle implements [slog.Handler]. It formats the record and queues it,
+// or drops it if the queue is full.
+func (h *Handler) Handle(ctx context.Context, r slog.Record) error {
+	q := h.queue
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.queued == len(q.slots) {
+		q.dropped.Add(1)
+		return nil
+	}
+	q.next.time = r.Time
+	q.next.severity = severity(r.Level)
+	q.next.n = 0
+	err := h.text.Handle(ctx, r)
+	if err != nil {
+		return err
+	}
+	q.slots[(q.head+q.queued)%len(q.slots)] = q.next
+	q.queued++
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// WithAttrs implements [slog.Handler].
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &Handler{opts: h.opts, queue: h.queue, text: h.text.WithAttrs(attrs)}
+}
+
+// WithGroup implements [slog.Handler].
+func (h *Handler) WithGroup(name string) slog.Handler {
+	return &Handler{opts: h.opts, queue: h.queue, text: h.text.WithGroup(name)}
+}
+
+// Dropped returns the number of records dropped because the queue was full
+// or sending failed.
+func (h *Handler) Dropped() uint64 { return h.queue.dropped.Load() }
+
+// Sent returns the number of records sent.
+func (h *Handler) Sent() uint64 { return h.queue.sent.Load() }
+
+// Run sends queued records to collector, identifying the device as
+// hostname. It never returns. While the WiFi link is down records stay
+// queued, and new ones are dropped once the queue fills.
+//
+// Errors are counted in [Handler.Dropped] rather than logged, since the
+// log may well lead here.
+func (h *Handler) Run(stack *cyw43439.Stack, collector netip.AddrPort, hostname string) {
+	q := h.queue
+	host := appendField(nil, hostname, maxHostName)
+	app := appendField(nil, h.opts.AppName, maxAppName)
+	msg := make([]byte, 0, maxMessage)
+	for {
+		<-q.ready
+		for {
+			for !stack.IsLinkUp() {
+				time.Sleep(time.Second)
+			}
+			q.mu.Lock()
+			if q.queued == 0 {
+				q.mu.Unlock()
+				break
+			}
+			r := &q.slots[q.head]
+			msg = h.appendMessage(msg[:0], r, host, app)
+			q.head = (q.head + 1) % len(q.slots)
+			q.queued--
+			q.mu.Unlock()
+
+			err := stack.SendUDP(Port, collector, msg)
+			if err != nil {
+				q.dropped.Add(1)
+				// Most likely the stack's transmit queue is full; give it
+				// time to drain.
+				time.Sleep(50 * time.Millisecond)
+			} else {
+				q.sent.Add(1)
+			}
+		}
+	}
+}
+
+// appendMessage appends the RFC 5424 message for r:
+//
+//	<PRI>1 TIMESTAMP HOSTNAME APP-NAME - - - MSG
+func (h *Handler) appendMessage(dst []byte, r *record, host, app []byte) []byte {
+	dst = append(dst, '<')
+	dst = strconv.AppendUint(dst, uint64(h.opts.Facility)*8+uint64(r.severity), 10)
+	dst = append(dst, ">1 "...)
+	if r.time.Year() < 2024 {
+		// The clock hasn't been set yet.
+		dst = append(dst, '-')
+	} else {
+		dst = r.time.UTC().AppendFormat(dst, "2006-01-02T15:04:05.000000Z")
+	}
+	dst = append(dst, ' ')
+	dst = append(dst, host...)
+	dst = append(dst, ' ')
+	dst = append(dst, app...)
+	dst = append(dst, " - - - "...)
+	n := min(r.n, maxMessage-len(dst))
+	return append(dst, r.body[:n]...)
+}
+
+// severity maps a slog level to a syslog severity.
+func severity(l slog.Level) uint8 {
+	switch {
+	case l >= slog.LevelError:
+		return 3 // Error.
+	case l >= slog.LevelWarn:
+		return 4 // Warning.
+	case l >= slog.LevelInfo:
+		return 6 // Informational.
+	default:
+		return 7 // Debug.
+	}
+}
+
+// appendField appends s as a header field of at most n printable ASCII
+// characters, other bytes replaced by '_', or the nil value "-" if empty.
+func appendField(dst []byte, s string, n int) []byte {
+	if s == "" {
+		return append(dst, '-')
+	}
+	for i := 0; i < len(s) && i < n; i++ {
+		c := s[i]
+		if c <= ' ' || c > '~' {
+			c = '_'
+		}
+		dst = append(dst, c)
+	}
+	return dst
+}
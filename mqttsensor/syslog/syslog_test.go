@@ -0,0 +1,100 @@
+package syslog
+
+import (
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAppendMessage(t *testing.T) {
+	set := time.Date(2026, 10, 18, 12, 34, 56, 789_000_000, time.UTC)
+	tests := []struct {
+		name     string
+		facility Facility
+		level    slog.Level
+		time     time.Time
+		body     string
+		want     string
+	}{
+		{"default facility", 0, slog.LevelInfo, set, "msg=hi",
+			"<134>1 2026-10-18T12:34:56.789000Z pico mqttsensor - - - msg=hi"},
+		{"error", FacilityUser, slog.LevelError, set, "msg=fail",
+			"<11>1 2026-10-18T12:34:56.789000Z pico mqttsensor - - - msg=fail"},
+		{"warning", FacilityDaemon, slog.LevelWarn, set, "msg=x", "<28>1 2026-10-18T12:34:56.789000Z pico mqttsensor - - - msg=x"},
+		{"debug", FacilityLocal7, slog.LevelDebug, set, "msg=x", "<191>1 2026-10-18T12:34:56.789000Z pico mqttsensor - - - msg=x"},
+		// Timestamps are sent in UTC.
+		{"local time", 0, slog.LevelInfo, set.In(time.FixedZone("CEST", 2*3600)), "msg=x",
+			"<134>1 2026-10-18T12:34:56.789000Z pico mqttsensor - - - msg=x"},
+		// Before the clock is set the timestamp is the nil value.
+		{"clock unset", 0, slog.LevelInfo, time.Time{}, "msg=boot", "<134>1 - pico mqttsensor - - - msg=boot"},
+		{"clock since boot", 0, slog.LevelInfo, time.Unix(42, 0), "msg=boot", "<134>1 - pico mqttsensor - - - msg=boot"},
+		{"empty body", 0, slog.LevelInfo, time.Time{}, "", "<134>1 - pico mqttsensor - - - "},
+	}
+	host := appendField(nil, "pico", maxHostName)
+	for _, tt := range tests {
+		h := NewHandler(Options{Facility: tt.facility})
+		r := &record{time: tt.time, severity: severity(tt.level)}
+		r.n = copy(r.body[:], tt.body)
+		app := appendField(nil, h.opts.AppName, maxAppName)
+		got := string(h.appendMessage(nil, r, host, app))
+		if got != tt.want {
+			t.Errorf("%s: appendMessage = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAppendMessageTruncates(t *testing.T) {
+	h := NewHandler(Options{AppName: strings.Repeat("a", 100)})
+	slog.New(h).Info(strings.Repeat("x", 1000))
+	r := &h.queue.slots[0]
+	if h.queue.queued != 1 || r.n != maxBody {
+		t.Fatalf("queued %d records, body of %d bytes, want 1 of %d", h.queue.queued, r.n, maxBody)
+	}
+	r.time = time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	app := appendField(nil, h.opts.AppName, maxAppName)
+	tests := []struct {
+		host    string
+		wantLen int
+	}{
+		// The longest header still leaves room for the whole body.
+		{strings.Repeat("h", 100), maxMessage},
+		{"pico", maxMessage - maxHostName + len("pico")},
+	}
+	for _, tt := range tests {
+		got := string(h.appendMessage(nil, r, appendField(nil, tt.host, maxHostName), app))
+		if len(got) != tt.wantLen {
+			t.Errorf("host of %d bytes: message of %d bytes, want %d", len(tt.host), len(got), tt.wantLen)
+		}
+		if !strings.HasPrefix(got, "<134>1 2026-10-18T00:00:00.000000Z ") || !strings.Contains(got, " - - - msg=xxx") {
+			t.Errorf("host of %d bytes: message %q lost its header or body", len(tt.host), got)
+		}
+	}
+}
+
+func TestAppendField(t *testing.T) {
+	tests := []struct {
+		in   string
+		n    int
+		want string
+	}{
+		{"pico", maxHostName, "pico"},
+		{"tinygo-mqtt.local", maxHostName, "tinygo-mqtt.local"},
+		// Empty fields are the nil value.
+		{"", maxHostName, "-"},
+		// Only printable US-ASCII, without space, is allowed.
+		{"my sensor", maxHostName, "my_sensor"},
+		{"a\tb\nc", maxHostName, "a_b_c"},
+		{"\x00\x7f~!", maxHostName, "__~!"},
+		{"küche", maxHostName, "k__che"},
+		{"abcdef", 3, "abc"},
+		{strings.Repeat("h", 100), maxHostName, strings.Repeat("h", maxHostName)},
+		{" ", maxHostName, "_"},
+	}
+	for _, tt := range tests {
+		got := string(appendField(nil, tt.in, tt.n))
+		if got != tt.want {
+			t.Errorf("appendField(%q, %d) = %q, want %q", tt.in, tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package syslog
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+)
+
+type tee []slog.Handler
+
+// Tee returns a handler that passes records to each of handlers that is
+// enabled for their level, e.g. the serial console and a syslog [Handler].
+func Tee(handlers ...slog.Handler) slog.Handler {
+	return tee(handlers)
+}
+
+func (t tee) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t tee) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range t {
+		if h.Enabled(ctx, r.Level) {
+			err := h.Handle(ctx, r.Clone())
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (t tee) WithAttrs(attrs []slog.Attr) slog.Handler {
+	derived := make(tee, len(t))
+	for i, h := range t {
+		derived[i] = h.WithAttrs(attrs)
+	}
+	return derived
+}
+
+func (t tee) WithGroup(name string) slog.Handler {
+	derived := make(tee, len(t))
+	for i, h := range t {
+		derived[i] = h.WithGroup(name)
+	}
+	return derived
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/harveysanders/picoplayground/mqttsensor/cyw43439"
+	"github.com/harveysanders/picoplayground/mqttsensor/mqtt"
+	"github.com/harveysanders/picoplayground/mqttsensor/ntp"
+	"github.com/harveysanders/picoplayground/mqttsensor/rtc"
+	"tinygo.org/x/drivers"
+)
+
+// ntpIntervalMinutes is how often the clock is resynced with NTP after the
+// sync at boot. Empty means every 60 minutes. Can be passed via linker
+// flags.
+var ntpIntervalMinutes string
+
+// ntpServerList is a comma separated list of preferred NTP servers, as
+// host names or IP addresses. Servers from DHCP or the static configuration
+// are tried if none of them answer, and pool.ntp.org after that. Can be
+// passed via linker flags.
+var ntpServerList string
+
+// httpTimeServer is an HTTP server, as host or host:port, whose Date
+// header sets the clock if no NTP server answers. Empty means none. Can be
+// passed via linker flags.
+var httpTimeServer string
+
+// rtcChip is the RTC on the I2C bus, "ds3231" or "pcf8523". Empty means
+// there is none. Can be passed via linker flags.
+var rtcChip string
+
+// sharedI2C serialises transactions on an I2C bus used from several
+// goroutines: the LCD handler, the time keeper and the web interface.
+type sharedI2C struct {
+	mu  sync.Mutex
+	bus drivers.I2C
+}
+
+func (b *sharedI2C) Tx(addr uint16, w, r []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.bus.Tx(addr, w, r)
+}
+
+// loadRTC finds the RTC, if one is configured, and sets the clock from it
+// so that readings have timestamps before NTP is reached. It returns nil
+// if there is no RTC, and whether the clock was set.
+func loadRTC(logger *slog.Logger, bus drivers.I2C) (*rtc.Clock, bool) {
+	if rtcChip == "" {
+		return nil, false
+	}
+	clock, err := rtc.New(bus, rtcChip)
+	if err != nil {
+		logger.Error("rtc:init", slog.String("reason", err.Error()))
+		return nil, false
+	}
+	offset, err := ntp.LoadRTC(clock)
+	if err != nil {
+		logger.Error("rtc:load", slog.String("chip", clock.Chip()), slog.String("reason", err.Error()))
+		return clock, false
+	}
+	logger.Info("rtc:loaded",
+		slog.String("chip", clock.Chip()),
+		slog.Time("time", time.Now()),
+		slog.Duration("offset", offset),
+	)
+	return clock, true
+}
+
+// backfillTimestamps returns a Backfill function for the MQTT client. Once
+// clock has been set, readings taken before then are given the time they
+// would have had, the wall time of boot at start plus their time since
+// boot, and marked as derived.
+func backfillTimestamps(clock *ntp.Keeper, start time.Time) func(*mqtt.SensorReading) {
+	return func(r *mqtt.SensorReading) {
+		if !r.Timestamp.IsZero() {
+			return
+		}
+		boot, ok := bootTime(clock, start)
+		if !ok {
+			return
+		}
+		r.Timestamp = boot.Add(r.SinceBootNS)
+		r.TimestampDerived = true
+	}
+}
+
+// bootTime returns the wall time at start, once clock has been set.
+func bootTime(clock *ntp.Keeper, start time.Time) (time.Time, bool) {
+	if !clock.ClockSet() {
+		return time.Time{}, false
+	}
+	// Since is monotonic, so unaffected by the clock being set.
+	return time.Now().Add(-time.Since(start)), true
+}
+
+// newTimeKeeper returns the NTP time keeper, which sets rtcClock after
+// every sync if there is one. rtcLoaded reports whether the clock was set
+// from it at boot. Without NTP it falls back to httpTimeServer, then to
+// the time published over MQTT.
+func newTimeKeeper(logger *slog.Logger, stack *cyw43439.Stack, rtcClock *rtc.Clock, rtcLoaded bool, mqttTime *mqtt.TimeTopic) *ntp.Keeper {
+	cfg := ntp.KeeperConfig{
+		Servers:   stack.NTPServers,
+		RTCLoaded: rtcLoaded,
+		Logger:    logger,
+	}
+	if httpTimeServer != "" {
+		src, err := ntp.NewHTTPDate(stack, httpTimeServer, logger)
+		if err != nil {
+			logger.Error("ntp:config", slog.String("reason", err.Error()))
+		} else {
+			cfg.Fallbacks = append(cfg.Fallbacks, src)
+		}
+	}
+	cfg.Fallbacks = append(cfg.Fallbacks, mqttTime)
+	if rtcClock != nil {
+		cfg.RTC = rtcClock
+	}
+	for _, host := range strings.Split(ntpServerList, ",") {
+		host = strings.TrimSpace(host)
+		if host != "" {
+			cfg.Hosts = append(cfg.Hosts, host)
+		}
+	}
+	if ntpIntervalMinutes != "" {
+		n, err := strconv.ParseUint(ntpIntervalMinutes, 10, 16)
+		if err != nil || n == 0 {
+			logger.Error("ntp:config", slog.String("reason", "invalid interval "+strconv.Quote(ntpIntervalMinutes)))
+		} else {
+			cfg.Interval = time.Duration(n) * time.Minute
+		}
+	}
+	return ntp.NewKeeper(stack, cfg)
+}
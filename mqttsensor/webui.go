@@ -0,0 +1,365 @@
+package main
+
+import (
+	"cmp"
+	"log/slog"
+	"machine"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/harveysanders/picoplayground/mqttsensor/config"
+	"github.com/harveysanders/picoplayground/mqttsensor/cyw43439"
+	"github.com/harveysanders/picoplayground/mqttsensor/httpd"
+	"github.com/harveysanders/picoplayground/mqttsensor/mqtt"
+	"github.com/harveysanders/picoplayground/mqttsensor/ntp"
+	"github.com/harveysanders/picoplayground/mqttsensor/rtc"
+)
+
+// httpPassword protects the web interface until a password is saved in
+// its settings. If both are empty the web interface is not started.
+// Can be passed via linker flags.
+var httpPassword string
+
+// webUser is the user name of the web interface.
+const webUser = "admin"
+
+// webUI serves the status page, the live dashboard and the settings form
+// in station mode.
+type webUI struct {
+	logger   *slog.Logger
+	stack    *cyw43439.Stack
+	mqttC    *mqtt.Client
+	clock    *ntp.Keeper
+	rtc      *rtc.Clock // Nil without an RTC.
+	start    time.Time
+	settings config.Config
+	password string
+	sv       *httpd.Server // Nil if the web interface is disabled.
+	history  history
+
+	mu         sync.Mutex
+	reading    mqtt.SensorReading // Latest reading; zero before the first sample.
+	statsSince time.Time          // When the stack's counters were last reset.
+	eventbuf   [48]byte           // Used by setReading.
+
+	// Used while serving requests.
+	numbuf   [24]byte
+	csvbuf   [48]byte
+	framebuf [64]byte
+}
+
+func newWebUI(logger *slog.Logger, stack *cyw43439.Stack, mqttC *mqtt.Client, clock *ntp.Keeper, rtcClock *rtc.Clock, start time.Time, settings config.Config) *webUI {
+	return &webUI{
+		logger:     logger,
+		stack:      stack,
+		mqttC:      mqttC,
+		clock:      clock,
+		rtc:        rtcClock,
+		start:      start,
+		settings:   settings,
+		password:   cmp.Or(settings.AdminPassword, httpPassword),
+		statsSince: start,
+	}
+}
+
+// setReading records the latest sensor reading for the status page and
+// dashboard, and pushes it to open dashboards. Once the clock is set,
+// readings kept from before then are timestamped as they are on MQTT.
+func (ui *webUI) setReading(r mqtt.SensorReading) {
+	if boot, ok := bootTime(ui.clock, ui.start); ok {
+		ui.history.backfill(boot)
+	}
+	ui.history.add(r)
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	ui.reading = r
+	if ui.sv != nil {
+		sample := newHistorySample(r)
+		ui.sv.SendEvent("", sample.appendCSV(ui.eventbuf[:0]))
+	}
+}
+
+func (ui *webUI) handle(w *httpd.ResponseWriter, r *httpd.Request) {
+	if !httpd.CheckBasicAuth(w, r, "mqttsensor", webUser, ui.password) {
+		return
+	}
+	// Every POST changes state.
+	if r.Method == "POST" && !httpd.CheckSameOrigin(w, r) {
+		ui.logger.Error("http:cross-origin", slog.String("path", r.Path), slog.String("remote", r.RemoteAddr.String()))
+		return
+	}
+	switch {
+	case r.Path == "/" && (r.Method == "GET" || r.Method == "HEAD"):
+		ui.writeStatus(w)
+	case r.Path == "/dashboard" && r.Method == "GET":
+		writePageHead(w, ui.settings.DeviceName+" dashboard")
+		w.WriteString(dashboardBody)
+		w.WriteString(pageTail)
+	case r.Path == "/events" && r.Method == "GET":
+		ui.streamReadings(w)
+	case r.Path == "/config" && r.Method == "GET":
+		writePageHead(w, ui.settings.DeviceName+" settings")
+		writeSettingsForm(w, "/config", ui.settings, "")
+		w.WriteString(pageTail)
+	case r.Path == "/config" && r.Method == "POST":
+		ui.save(w, r)
+	case r.Path == "/stats/reset" && r.Method == "POST":
+		ui.stack.ResetStats()
+		ui.mu.Lock()
+		ui.statsSince = time.Now()
+		ui.mu.Unlock()
+		ui.logger.Info("http:stats-reset", slog.String("remote", r.RemoteAddr.String()))
+		httpd.Redirect(w, "/", httpd.StatusSeeOther)
+	case r.Path == "/" || r.Path == "/config" || r.Path == "/stats/reset":
+		httpd.Error(w, httpd.StatusMethodNotAllowed)
+	default:
+		httpd.Error(w, httpd.StatusNotFound)
+	}
+}
+
+func (ui *webUI) save(w *httpd.ResponseWriter, r *httpd.Request) {
+	cfg, err := parseSettingsForm(r, ui.settings)
+	if err == nil {
+		err = config.Save(machine.Flash, cfg)
+	}
+	if err != nil {
+		w.WriteHeader(httpd.StatusBadRequest)
+		writePageHead(w, ui.settings.DeviceName+" settings")
+		writeSettingsForm(w, "/config", cfg, err.Error())
+		w.WriteString(pageTail)
+		return
+	}
+	ui.logger.Info("http:settings-saved", slog.String("remote", r.RemoteAddr.String()))
+	writePageHead(w, ui.settings.DeviceName+" settings")
+	w.WriteString("<p>Settings saved. The device is restarting.</p>")
+	w.WriteString(pageTail)
+	rebootSoon()
+}
+
+func (ui *webUI) writeStatus(w *httpd.ResponseWriter) {
+	ui.mu.Lock()
+	reading := ui.reading
+	statsSince := ui.statsSince
+	ui.mu.Unlock()
+
+	// Refresh instead of scripting so the page stays small.
+	w.SetHeader("Refresh", "10")
+	writePageHead(w, ui.settings.DeviceName)
+	w.WriteString("<table>")
+	ui.row(w, "Uptime", time.Since(ui.start).Truncate(time.Second).String())
+
+	nw := ui.stack.Network()
+	link := "down"
+	if ui.stack.IsLinkUp() {
+		link = "up"
+	}
+	ui.row(w, "WiFi", nw.SSID+" ("+link+")")
+	addr := ui.stack.Addr().String()
+	if ui.stack.IsLinkLocal() {
+		addr += " (link-local)"
+	}
+	ui.row(w, "IP address", addr)
+	if addrs6 := ui.stack.Addrs6(); len(addrs6) > 0 {
+		v6 := ""
+		for i, a := range addrs6 {
+			if i > 0 {
+				v6 += ", "
+			}
+			v6 += a.String()
+		}
+		ui.row(w, "IPv6", v6)
+	}
+
+	broker := "a broker found via mDNS"
+	if b, err := mqtt.ParseBrokerURL(ui.settings.BrokerURL); err == nil {
+		// Only the host and port; the URL may carry credentials.
+		broker = b.HostPort()
+	}
+	mqttState := "disconnected"
+	if ui.mqttC.Connected() {
+		mqttState = "connected"
+	}
+	ui.row(w, "MQTT", mqttState+" to "+broker)
+	if rtt := ui.mqttC.PingRTT(); rtt > 0 {
+		ui.row(w, "MQTT ping", rtt.Round(100*time.Microsecond).String())
+	}
+
+	ui.writeClock(w)
+
+	if reading.SinceBootNS == 0 {
+		ui.row(w, "Reading", "none yet")
+	} else {
+		ui.rowFloat(w, "Voltage", reading.Voltage, "V")
+		ui.rowFloat(w, "Temperature", reading.Temperature, "°F")
+		ui.rowFloat(w, "Humidity", reading.Humidity, "%")
+		age := time.Since(ui.start) - reading.SinceBootNS
+		sampled := age.Truncate(time.Second).String() + " ago"
+		if reading.Timestamp.IsZero() {
+			if boot, ok := bootTime(ui.clock, ui.start); ok {
+				// Taken before the clock was set.
+				sampled += ", at " + boot.Add(reading.SinceBootNS).UTC().Format(time.DateTime) + " UTC (derived)"
+			}
+		} else {
+			sampled += ", at " + reading.Timestamp.UTC().Format(time.DateTime) + " UTC"
+		}
+		ui.row(w, "Sampled", sampled)
+	}
+	interval := cmp.Or(ui.settings.SampleIntervalSec, defaultSampleIntervalSec)
+	ui.row(w, "Sample interval", strconv.Itoa(int(interval))+" s")
+	w.WriteString(`</table><p><a href="/dashboard">Dashboard</a> · <a href="/config">Settings</a></p>`)
+
+	st := ui.stack.Stats()
+	w.WriteString("<h2>Network</h2><table>")
+	ui.rowCounts(w, "Received", count{st.FramesIn, "frames"}, count{st.BytesIn, "bytes"})
+	ui.rowCounts(w, "Sent", count{st.FramesOut, "frames"}, count{st.BytesOut, "bytes"})
+	ui.rowCounts(w, "Errors", count{st.PollErrors, "poll"}, count{st.EncapsulateErrors, "encapsulate"}, count{st.SendErrors, "send"})
+	ui.rowCounts(w, "DHCP", count{st.DHCPAttempts, "attempts"}, count{st.DHCPFailures, "failed"})
+	ui.rowCounts(w, "DNS", count{st.DNSLookups, "lookups"}, count{st.DNSFailures, "failed"})
+	ui.rowCounts(w, "ARP", count{st.ARPResolves, "resolves"}, count{st.ARPFailures, "failed"})
+	ui.rowCounts(w, "Loop", count{st.Polls, "polls"}, count{st.HostWakeups, "interrupts"}, count{st.Notifies, "notifies"})
+	if elapsed := time.Since(statsSince); elapsed > 0 {
+		busy := 100 * float64(st.PollTime) / float64(elapsed)
+		ui.row(w, "Polling", st.PollTime.Truncate(time.Millisecond).String()+" ("+strconv.FormatFloat(busy, 'f', 1, 64)+"% of the time)")
+	}
+	if syslogHandler != nil {
+		ui.rowCounts(w, "Syslog", count{syslogHandler.Sent(), "sent"}, count{syslogHandler.Dropped(), "dropped"})
+	}
+	w.WriteString(`</table><form method="post" action="/stats/reset"><button>Reset counters</button></form>`)
+	w.WriteString(pageTail)
+}
+
+// writeClock writes the time keeping rows: whether the clock is synced,
+// the last offset and the drift being corrected for, and the RTC's drift
+// and temperature.
+func (ui *webUI) writeClock(w *httpd.ResponseWriter) {
+	st := ui.clock.Status()
+	switch {
+	case !st.Synced && st.RTCLoaded:
+		ui.row(w, "Clock", time.Now().UTC().Format(time.DateTime)+" UTC (from RTC)")
+	case !st.Synced:
+		ui.row(w, "Clock", "not synced")
+	case st.Stale:
+		ui.row(w, "Clock", time.Now().UTC().Format(time.DateTime)+" UTC (stale)")
+	default:
+		ui.row(w, "Clock", time.Now().UTC().Format(time.DateTime)+" UTC")
+	}
+	if st.Synced {
+		ui.row(w, "NTP", "synced "+time.Since(st.LastSync).Truncate(time.Second).String()+
+			" ago, offset "+st.LastOffset.String()+
+			", drift "+strconv.FormatFloat(st.DriftPPM, 'f', 2, 64)+" ppm")
+		ui.row(w, "Time source", st.LastSource+", accurate to "+st.LastAccuracy.String())
+	}
+	for i := len(st.History) - 1; i >= 0; i-- {
+		if s := st.History[i]; s.Err == nil && s.Server.IsValid() {
+			ui.row(w, "NTP server", s.Server.String()+" ("+s.Source+", "+s.Delay.String()+" round trip)")
+			break
+		}
+	}
+	if st.LastErr != nil {
+		ui.row(w, "NTP error", st.LastErr.Error())
+	}
+	ui.rowCounts(w, "NTP syncs", count{uint64(st.Syncs), "ok"}, count{uint64(st.Failures), "failed"}, count{uint64(st.Steps), "stepped"})
+	if len(st.History) > 0 {
+		offsets := ""
+		for i, s := range st.History {
+			if i > 0 {
+				offsets += ", "
+			}
+			if s.Err != nil {
+				offsets += "failed"
+			} else {
+				offsets += s.Offset.String()
+			}
+		}
+		ui.row(w, "NTP offsets", offsets)
+	}
+	if ui.rtc != nil {
+		v := ui.rtc.Chip()
+		if st.RTCErr == nil && st.Syncs > 0 {
+			v += ", offset " + st.RTCOffset.String()
+		}
+		if st.RTCDriftPPM != 0 {
+			v += ", drift " + strconv.FormatFloat(st.RTCDriftPPM, 'f', 2, 64) + " ppm"
+		}
+		if mc, err := ui.rtc.Temperature(); err == nil {
+			v += ", " + strconv.FormatFloat(float64(mc)/1000, 'f', 2, 64) + " °C"
+		}
+		ui.row(w, "RTC", v)
+		if st.RTCErr != nil {
+			ui.row(w, "RTC error", st.RTCErr.Error())
+		}
+	}
+}
+
+func (ui *webUI) row(w *httpd.ResponseWriter, name, value string) {
+	w.WriteString("<tr><th>")
+	w.WriteString(name)
+	w.WriteString("</th><td>")
+	w.WriteEscaped(value)
+	w.WriteString("</td></tr>")
+}
+
+// rowFloat writes a row without formatting the value into a new string.
+func (ui *webUI) rowFloat(w *httpd.ResponseWriter, name string, v float32, unit string) {
+	w.WriteString("<tr><th>")
+	w.WriteString(name)
+	w.WriteString("</th><td>")
+	w.Write(strconv.AppendFloat(ui.numbuf[:0], float64(v), 'f', 1, 32))
+	w.WriteString(" ")
+	w.WriteString(unit)
+	w.WriteString("</td></tr>")
+}
+
+type count struct {
+	n     uint64
+	label string
+}
+
+// rowCounts writes a row of labelled counters, e.g. "12 frames, 3400 bytes".
+func (ui *webUI) rowCounts(w *httpd.ResponseWriter, name string, counts ...count) {
+	w.WriteString("<tr><th>")
+	w.WriteString(name)
+	w.WriteString("</th><td>")
+	for i, c := range counts {
+		if i > 0 {
+			w.WriteString(", ")
+		}
+		w.Write(strconv.AppendUint(ui.numbuf[:0], c.n, 10))
+		w.WriteString(" ")
+		w.WriteString(c.label)
+	}
+	w.WriteString("</td></tr>")
+}
+
+// streamReadings starts a stream of readings, beginning with the history.
+// Each event's data is the CSV written by [historySample.appendCSV].
+func (ui *webUI) streamReadings(w *httpd.ResponseWriter) {
+	w.Stream()
+	if boot, ok := bootTime(ui.clock, ui.start); ok {
+		ui.history.backfill(boot)
+	}
+	ui.history.each(func(s historySample) {
+		w.Write(httpd.AppendEvent(ui.framebuf[:0], "", s.appendCSV(ui.csvbuf[:0])))
+	})
+}
+
+// dashboardBody charts the readings streamed from /events. The history
+// is sent again on every (re)connect, so the chart starts over on open.
+// N matches historyLen.
+const dashboardBody = `<p id="st">Connecting...</p><canvas id="c" width="600" height="390" style="width:100%"></canvas>
+<p><a href="/">Status</a></p><script>
+const N=120,S=[[],[],[]],L=["Voltage (V)","Temperature (°F)","Humidity (%)"],D=[2,1,1],C=["#06c","#c60","#090"];
+const st=document.getElementById("st"),es=new EventSource("/events");let q=0;
+es.onopen=()=>{S.forEach(s=>s.length=0);st.textContent="Live"};
+es.onerror=()=>{st.textContent="Reconnecting..."};
+es.onmessage=e=>{const f=e.data.split(",").map(Number);
+S.forEach((s,i)=>{s.push(f[i+1]);if(s.length>N)s.shift()});if(f[4])st.textContent="Live, last reading at "+new Date(f[4]*1e3).toLocaleTimeString();
+if(!q){q=1;requestAnimationFrame(draw)}};
+function draw(){q=0;const c=document.getElementById("c"),x=c.getContext("2d"),w=c.width,h=c.height/3;
+x.clearRect(0,0,w,c.height);x.font="15px sans-serif";x.lineWidth=2;
+S.forEach((s,i)=>{if(!s.length)return;const y=i*h;let lo=Math.min(...s),hi=Math.max(...s);
+x.fillStyle="#000";x.fillText(L[i]+": "+s[s.length-1].toFixed(D[i])+"  ("+lo.toFixed(D[i])+" to "+hi.toFixed(D[i])+")",4,y+18);
+if(hi-lo<1e-3){lo-=.5;hi+=.5}x.strokeStyle=C[i];x.beginPath();
+s.forEach((v,j)=>{const px=j*w/(N-1),py=y+h-6-(v-lo)/(hi-lo)*(h-34);j?x.lineTo(px,py):x.moveTo(px,py)});x.stroke()})}
+</script>`
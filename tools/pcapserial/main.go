@@ -0,0 +1,118 @@
+// Command pcapserial converts the packet capture the mqttsensor firmware
+// writes to its USB serial console into a .pcapng file Wireshark can open.
+//
+// Capture lines are decoded into the output and every other line, the
+// firmware's log, is passed through to stderr. The input is a serial device
+// or, if none is given, stdin:
+//
+//	stty -F /dev/ttyACM0 raw
+//	go run ./tools/pcapserial -o capture.pcapng /dev/ttyACM0
+//
+// With "-o -" the capture goes to stdout for viewing live:
+//
+//	go run ./tools/pcapserial -o - /dev/ttyACM0 | wireshark -k -i -
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/harveysanders/picoplayground/mqttsensor/pcapng"
+)
+
+func main() {
+	out := flag.String("o", "capture.pcapng", "output file, or - for stdout")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: pcapserial [-o file] [serial device]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	in := os.Stdin
+	if flag.NArg() == 1 {
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+	w := os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	n, err := convert(w, in, os.Stderr)
+	fmt.Fprintf(os.Stderr, "pcapserial: %d packets written\n", n)
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// convert copies the capture blocks in r to w and the other lines to logw.
+// It returns the number of packets written.
+func convert(w io.Writer, r io.Reader, logw io.Writer) (packets int, err error) {
+	br := bufio.NewReader(r)
+	var block []byte
+	inSection := false
+	for {
+		line, err := br.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// Longer than any capture line; pass it on in pieces.
+			logw.Write(line)
+			continue
+		}
+		if len(line) == 0 && err != nil {
+			if err == io.EOF {
+				return packets, nil
+			}
+			return packets, err
+		}
+
+		var ok bool
+		block, ok = pcapng.DecodeLine(block[:0], line)
+		if !ok {
+			logw.Write(line)
+			continue
+		}
+		// Attaching after the device started means the headers were missed.
+		// Stand in for them so the file is readable; the snap length is
+		// unknown, so none is given.
+		switch typ := pcapng.BlockType(block); {
+		case typ == pcapng.BlockSectionHeader:
+			inSection = true
+		case !inSection:
+			hdr := pcapng.AppendSectionHeader(nil)
+			if typ != pcapng.BlockInterfaceDescription {
+				hdr = pcapng.AppendInterfaceDescription(hdr, pcapng.LinkTypeEthernet, 0)
+			}
+			if _, err := w.Write(hdr); err != nil {
+				return packets, err
+			}
+			inSection = true
+		}
+		if _, err := w.Write(block); err != nil {
+			return packets, err
+		}
+		if pcapng.BlockType(block) == pcapng.BlockEnhancedPacket {
+			packets++
+		}
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "pcapserial:", err)
+	os.Exit(1)
+}